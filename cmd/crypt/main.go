@@ -1,22 +1,55 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 
+	"git.woozle.org/neale/simpleauth/pkg/password"
 	"github.com/GehirnInc/crypt"
 	_ "github.com/GehirnInc/crypt/sha256_crypt"
 )
 
+// boolEnv returns true if an environment variable is "true"
+func boolEnv(key string) bool {
+	return os.Getenv(key) == "true"
+}
+
+// intEnv returns the integer in an environment variable, or a default
+func intEnv(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid integer in %s: %v", key, err)
+	}
+	return i
+}
+
 func main() {
-	if len(os.Args) != 3 {
-		log.Fatal("Usage: crypt USERNAME PASSWORD")
+	var policy password.Policy
+	flag.IntVar(&policy.MinLength, "min-length", intEnv("SIMPLEAUTH_PASSWORD_MIN_LENGTH", 0), "Minimum password length")
+	flag.BoolVar(&policy.RequireUpper, "require-upper", boolEnv("SIMPLEAUTH_PASSWORD_REQUIRE_UPPER"), "Require an uppercase letter")
+	flag.BoolVar(&policy.RequireLower, "require-lower", boolEnv("SIMPLEAUTH_PASSWORD_REQUIRE_LOWER"), "Require a lowercase letter")
+	flag.BoolVar(&policy.RequireDigit, "require-digit", boolEnv("SIMPLEAUTH_PASSWORD_REQUIRE_DIGIT"), "Require a digit")
+	flag.BoolVar(&policy.RequireSymbol, "require-symbol", boolEnv("SIMPLEAUTH_PASSWORD_REQUIRE_SYMBOL"), "Require a symbol")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		log.Fatal("Usage: crypt [options] USERNAME PASSWORD")
 	}
-	username := os.Args[1]
-	password := os.Args[2]
+	username := flag.Arg(0)
+	pw := flag.Arg(1)
+	if err := policy.Validate(pw); err != nil {
+		log.Fatal(err)
+	}
+
 	c := crypt.SHA256.New()
-	if crypted, err := c.Generate([]byte(password), nil); err != nil {
+	if crypted, err := c.Generate([]byte(pw), nil); err != nil {
 		log.Fatal(err)
 	} else {
 		fmt.Printf("%s:%s\n", username, crypted)
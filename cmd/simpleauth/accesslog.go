@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// accessLog records each forward-auth decision. It's nil if access logging is off.
+var accessLog *log.Logger
+
+// accessLogFormat is "text", "json",
+// or "common" or "combined" for Apache's Common and Combined Log Formats
+var accessLogFormat = "text"
+
+// clfTimeFormat is how Common Log Format writes times
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// newAccessLog returns a logger for the given format, writing wherever the main log goes
+func newAccessLog(format string) (*log.Logger, error) {
+	switch format {
+	case "text":
+		return log.New(log.Writer(), "", log.Flags()), nil
+	case "json", "common", "combined":
+		return log.New(log.Writer(), "", 0), nil
+	}
+	return nil, fmt.Errorf("unknown access log format %q", format)
+}
+
+// forwardedURL reconstructs the URL the client originally requested, from the proxy's headers
+func forwardedURL(req *http.Request, username string) *url.URL {
+	u := &url.URL{
+		Scheme: forwardedProto(req),
+		Host:   forwardedHostPort(req),
+		Path:   forwardedURI(req),
+	}
+	if username != "" {
+		u.User = url.UserPassword(username, "")
+	}
+	return u
+}
+
+// clfField returns s as a Common Log Format field:
+// "-" if it's empty, with quotes, backslashes, and unprintable bytes escaped the way Apache does
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// clfLine returns the access log line for req in Common Log Format,
+// or Combined Log Format, with the referer and user agent, if combined is true.
+// The request line has the forwarded URL, and the size of the response is unknown.
+func clfLine(req *http.Request, username string, code int, combined bool) string {
+	host := clientAddress(req)
+	if ip, ok := clientIPAddr(req); ok {
+		host = ip.String()
+	}
+	request := fmt.Sprintf("%s %s %s", forwardedMethod(req), forwardedURL(req, "").String(), req.Proto)
+	line := fmt.Sprintf(`%s - %s [%s] "%s" %d -`,
+		clfField(host), clfField(username), time.Now().Format(clfTimeFormat), clfField(request), code)
+	if combined {
+		line += fmt.Sprintf(` "%s" "%s"`, clfField(req.Referer()), clfField(req.UserAgent()))
+	}
+	return line
+}
+
+// logAccess writes an access log line for a forward-auth decision, and adds it to the request's span
+func logAccess(req *http.Request, username string, login bool, status string, code int) {
+	recordDecision(req, username, status, code)
+	if accessLog == nil {
+		return
+	}
+
+	clientIP := clientAddress(req)
+	method := forwardedMethod(req)
+	u := forwardedURL(req, username)
+
+	switch accessLogFormat {
+	case "json":
+		entry, _ := json.Marshal(map[string]interface{}{
+			"time":     time.Now().Format(time.RFC3339),
+			"client":   clientIP,
+			"method":   method,
+			"url":      u.String(),
+			"username": username,
+			"login":    login,
+			"status":   status,
+			"code":     code,
+		})
+		accessLog.Println(string(entry))
+	case "common", "combined":
+		accessLog.Println(clfLine(req, username, code, accessLogFormat == "combined"))
+	default:
+		accessLog.Printf("%s %s %s login:%v %s %d",
+			clientIP, method, u.String(),
+			login, status, code,
+		)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogText(t *testing.T) {
+	testConfig(t)
+	buf := new(bytes.Buffer)
+	override(t, &accessLog, log.New(buf, "", 0))
+	override(t, &accessLogFormat, "text")
+
+	req := basicRequest("alice", alicePassword)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-Method", "GET")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	req.Header.Set("X-Forwarded-Uri", "/private/")
+	serve(req)
+
+	want := "192.0.2.1:1234 GET https://alice:@example.com/private/ login:false succeeded 200\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Wrong log line:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	testConfig(t)
+	buf := new(bytes.Buffer)
+	override(t, &accessLog, log.New(buf, "", 0))
+	override(t, &accessLogFormat, "json")
+
+	serve(basicRequest("alice", "wrong"))
+
+	var entry map[string]any
+	if err := json.NewDecoder(strings.NewReader(buf.String())).Decode(&entry); err != nil {
+		t.Fatalf("Bad log line %q: %v", buf.String(), err)
+	}
+	if entry["status"] != "failed" || entry["code"] != float64(http.StatusUnauthorized) {
+		t.Errorf("Wrong log entry: %v", entry)
+	}
+}
+
+// clfPattern matches a Common Log Format line, with Combined's referer and user agent optional
+var clfPattern = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[(\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\] "([^"]*)" (\d{3}) (\S+)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?\n$`)
+
+func TestAccessLogCommon(t *testing.T) {
+	testConfig(t)
+	buf := new(bytes.Buffer)
+	override(t, &accessLog, log.New(buf, "", 0))
+	override(t, &accessLogFormat, "common")
+
+	req := basicRequest("alice", alicePassword)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Real-IP", "192.0.2.1")
+	req.Header.Set("X-Forwarded-Method", "GET")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	req.Header.Set("X-Forwarded-Uri", "/private/")
+	serve(req)
+
+	m := clfPattern.FindStringSubmatch(buf.String())
+	if m == nil {
+		t.Fatalf("Not Common Log Format: %q", buf.String())
+	}
+	if m[1] != "192.0.2.1" || m[3] != "alice" || m[5] != "GET https://example.com/private/ HTTP/1.1" || m[6] != "200" || m[7] != "-" {
+		t.Errorf("Wrong fields in %q", buf.String())
+	}
+	if m[8] != "" {
+		t.Errorf("Common log line has combined fields: %q", buf.String())
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	testConfig(t)
+	buf := new(bytes.Buffer)
+	override(t, &accessLog, log.New(buf, "", 0))
+	override(t, &accessLogFormat, "combined")
+
+	req := basicRequest("alice", "wrong")
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", `Mozilla/5.0 "quoted"`)
+	serve(req)
+
+	m := clfPattern.FindStringSubmatch(buf.String())
+	if m == nil {
+		t.Fatalf("Not Combined Log Format: %q", buf.String())
+	}
+	if m[1] != "192.0.2.1" || m[3] != "-" || m[6] != "401" {
+		t.Errorf("Wrong fields in %q", buf.String())
+	}
+	if m[8] != "-" || m[9] != `Mozilla/5.0 \"quoted\"` {
+		t.Errorf("Wrong referer or user agent in %q", buf.String())
+	}
+}
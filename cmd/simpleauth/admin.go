@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// adminToken must be presented as a bearer token to use the admin endpoints.
+// With no token, the admin endpoints are not served.
+var adminToken string
+
+// adminAuthorized returns true if req carries the admin token
+func adminAuthorized(req *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	presented, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(adminToken)) == 1
+}
+
+// requireAdmin wraps an admin endpoint, rejecting requests without the admin token
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		if !adminAuthorized(req) {
+			debugf("admin request rejected: missing or wrong admin token")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="simpleauth admin"`)
+			apiError(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// adminUser describes one user to the admin API
+type adminUser struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// adminUsersHandler lists the configured users.
+// With hashed usernames, only the hashes are known.
+func adminUsersHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	users := []adminUser{}
+	for key, entry := range currentUsers() {
+		users = append(users, adminUser{key, entryGroups(entry)})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users": users,
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// adminRequest runs a GET of /admin/users with the given Authorization header
+func adminRequest(authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	requireAdmin(adminUsersHandler)(w, req)
+	return w
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	testConfig(t)
+	override(t, &adminToken, "sekrit-admin-token")
+
+	if w := adminRequest(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("No token returned %d", w.Code)
+	}
+	if w := adminRequest("Bearer wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong token returned %d", w.Code)
+	}
+	if w := adminRequest("Basic sekrit-admin-token"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token without Bearer returned %d", w.Code)
+	}
+
+	w := adminRequest("Bearer sekrit-admin-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Right token returned %d", w.Code)
+	}
+	var body struct {
+		Users []adminUser `json:"users"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Users) != 1 || body.Users[0].Username != "alice" {
+		t.Errorf("Wrong users: %v", body.Users)
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	testConfig(t)
+	override(t, &adminToken, "")
+
+	if w := adminRequest("Bearer "); w.Code != http.StatusUnauthorized {
+		t.Errorf("Empty token returned %d", w.Code)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// allowedUsers, if not nil, are the only usernames allowed to authenticate,
+// whichever backend vouches for them.
+// It's guarded by configLock.
+var allowedUsers map[string]bool
+
+// parseAllowedUsers parses a comma-separated list of usernames
+func parseAllowedUsers(list string) map[string]bool {
+	users := make(map[string]bool)
+	for _, username := range strings.Split(list, ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			users[strings.ToLower(username)] = true
+		}
+	}
+	return users
+}
+
+// loadAllowedUsers reads usernames from a file, one per line.
+// Blank lines and lines starting with # are ignored.
+func loadAllowedUsers(allowPath string) (map[string]bool, error) {
+	f, err := os.Open(allowPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		username := strings.TrimSpace(scanner.Text())
+		if username == "" || strings.HasPrefix(username, "#") {
+			continue
+		}
+		users[strings.ToLower(username)] = true
+	}
+	return users, scanner.Err()
+}
+
+// userAllowed returns true if username may authenticate
+func userAllowed(username string) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return allowedUsers == nil || allowedUsers[strings.ToLower(username)]
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+func TestAllowedUsers(t *testing.T) {
+	testConfig(t)
+	hash := hashPassword(t, alicePassword)
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hash,
+		"bob":   hash,
+	})
+	override(t, &allowedUsers, parseAllowedUsers("Alice, carol"))
+
+	if w := serve(basicRequest("alice", alicePassword)); w.Code != http.StatusOK {
+		t.Errorf("Allowed user returned %d", w.Code)
+	}
+	if w := serve(basicRequest("bob", alicePassword)); w.Code == http.StatusOK {
+		t.Error("User not on the allowlist authenticated")
+	}
+
+	// Tokens issued before the allowlist don't get around it
+	secret, _ := currentSecrets()
+	if w := serve(requestWithToken(token.New(secret, "bob", time.Now().Add(time.Hour)))); w.Code == http.StatusOK {
+		t.Error("Token for a user not on the allowlist accepted")
+	}
+	if w := serve(requestWithToken(token.New(secret, "alice", time.Now().Add(time.Hour)))); w.Code != http.StatusOK {
+		t.Errorf("Token for an allowed user returned %d", w.Code)
+	}
+}
+
+func TestAllowedUsersFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "allowed")
+	if err := os.WriteFile(fn, []byte("# staff\nalice\n\nBob\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadAllowedUsers(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || !users["alice"] || !users["bob"] {
+		t.Errorf("Wrong users: %v", users)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// apiLoginRequest is the JSON body of a login from a single-page app
+type apiLoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Remember bool   `json:"remember,omitempty"`
+	// TOTP is the current authenticator code, for users enrolled in TOTP
+	TOTP string `json:"totp,omitempty"`
+}
+
+// apiLoginResponse is returned after a successful JSON login
+type apiLoginResponse struct {
+	Username   string    `json:"username"`
+	Expiration time.Time `json:"expires"`
+	Groups     []string  `json:"groups,omitempty"`
+}
+
+// apiError writes a JSON error response
+func apiError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": message,
+	})
+}
+
+// apiLoginHandler logs in with a JSON username and password,
+// setting the token cookie and describing the session in the response.
+func apiLoginHandler(w http.ResponseWriter, req *http.Request) {
+	stripUntrustedHeaders(req)
+	normalizeForwardedHeaders(req)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if csrfProtection && !csrfValid(req) {
+		debugf("api login rejected: missing or invalid CSRF token")
+		apiError(w, http.StatusForbidden, "missing or invalid CSRF token")
+		logAccess(req, "", true, "csrf-rejected", http.StatusForbidden)
+		return
+	}
+
+	var creds apiLoginRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&creds); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	username := strings.ToLower(creds.Username)
+
+	throttled := loginThrottle != nil && !throttleExempt(req)
+	if throttled && !loginThrottle.take(username) {
+		debugf("api login throttled for username:%v", logName(username))
+		w.Header().Set("Retry-After", "60")
+		apiError(w, http.StatusTooManyRequests, "too many login attempts")
+		logAccess(req, "", true, "throttled", http.StatusTooManyRequests)
+		return
+	}
+
+	release, ok := acquireVerifySlot(req.Context())
+	if !ok {
+		debugf("api login shed: too many verifications in progress")
+		w.Header().Set("Retry-After", "1")
+		apiError(w, http.StatusServiceUnavailable, "too busy, try again")
+		logAccess(req, "", true, "shed", http.StatusServiceUnavailable)
+		return
+	}
+	valid, refused := authenticationValid(req.Context(), username, creds.Password)
+	release()
+	if valid && !totpSatisfied(username, creds.TOTP) {
+		debugf("api login missing or wrong TOTP code for username:%v", logName(username))
+		valid = false
+	}
+	if !valid {
+		debugf("api login failed for username:%v", logName(username))
+		apiError(w, http.StatusUnauthorized, loginFailureDetail(refused))
+		logAccess(req, "", true, "failed", http.StatusUnauthorized)
+		return
+	}
+	if throttled {
+		loginThrottle.refund(username)
+	}
+	if loginCooldowns != nil && !throttleExempt(req) {
+		if ok, wait := loginCooldowns.allow(username); !ok {
+			debugf("api login cooldown for username:%v", logName(username))
+			w.Header().Set("Retry-After", retryAfter(wait))
+			apiError(w, http.StatusTooManyRequests, "logged in too recently")
+			logAccess(req, username, true, "cooldown", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	t := issueToken(w, req, username, creds.Remember, time.Now())
+	w.Header().Set("X-Simpleauth-Username", username)
+	logAccess(req, username, true, "succeeded", http.StatusOK)
+	json.NewEncoder(w).Encode(apiLoginResponse{
+		Username:   username,
+		Expiration: t.Expiration,
+		Groups:     t.Groups,
+	})
+}
+
+// validateRequest is the JSON body of a token validation
+type validateRequest struct {
+	Token string `json:"token"`
+}
+
+// validateHandler checks a token, without any forward-auth headers or cookies.
+// The token is sent as the body: either plain text, or JSON as {"token": "..."}.
+func validateHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, 8192))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	tokenStr := strings.TrimSpace(string(body))
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/json" {
+		var v validateRequest
+		if err := json.Unmarshal(body, &v); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		tokenStr = v.Token
+	}
+
+	t, err := token.ParseString(tokenStr)
+	if err == nil {
+		err = checkToken(t)
+	}
+	if err != nil {
+		debugf("validate: %v", err)
+		apiError(w, http.StatusUnauthorized, tokenReason(err))
+		return
+	}
+	json.NewEncoder(w).Encode(apiLoginResponse{
+		Username:   t.Username,
+		Expiration: t.Expiration,
+		Groups:     t.Groups,
+	})
+}
+
+// tokenReasons are the token problems worth telling a client about
+var tokenReasons = []error{
+	token.ErrMalformed,
+	token.ErrBadSignature,
+	token.ErrExpired,
+	token.ErrNotYetValid,
+	token.ErrRevoked,
+	errTokenTooLong,
+	errWrongAudience,
+}
+
+// tokenReason returns a short description of why a token was refused,
+// without the details of a parse failure
+func tokenReason(err error) string {
+	for _, reason := range tokenReasons {
+		if errors.Is(err, reason) {
+			return reason.Error()
+		}
+	}
+	return "invalid token"
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// apiLogin posts a JSON login to apiLoginHandler
+func apiLogin(username, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(apiLoginRequest{Username: username, Password: password})
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	apiLoginHandler(w, req)
+	return w
+}
+
+func TestAPILoginGroups(t *testing.T) {
+	testConfig(t)
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hashPassword(t, alicePassword) + " groups=admin,dev",
+		"bob":   hashPassword(t, "builder"),
+	})
+
+	w := apiLogin("Alice", alicePassword)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login returned %d: %s", w.Code, w.Body)
+	}
+	var resp apiLoginResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Username != "alice" {
+		t.Errorf("Wrong username: %q", resp.Username)
+	}
+	if strings.Join(resp.Groups, ",") != "admin,dev" {
+		t.Errorf("Wrong groups: %v", resp.Groups)
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Error("No cookie set")
+	}
+
+	w = apiLogin("bob", "builder")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login returned %d: %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), `"groups"`) {
+		t.Errorf("Groups sent for a user without any: %s", w.Body)
+	}
+}
+
+func TestAPILoginFailed(t *testing.T) {
+	testConfig(t)
+
+	if w := apiLogin("alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Bad password returned %d", w.Code)
+	} else if w.Header().Get("Set-Cookie") != "" {
+		t.Error("Cookie set for a bad password")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/login", nil)
+	w := httptest.NewRecorder()
+	apiLoginHandler(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned %d", w.Code)
+	}
+}
+
+// validate posts body to validateHandler
+func validate(contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	validateHandler(w, req)
+	return w
+}
+
+func TestValidate(t *testing.T) {
+	testConfig(t)
+	secret, _ := currentSecrets()
+	good := token.New(secret, "alice", time.Now().Add(time.Hour)).String()
+
+	w := validate("text/plain", good)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Valid token returned %d: %s", w.Code, w.Body)
+	}
+	var resp apiLoginResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Username != "alice" {
+		t.Errorf("Wrong username: %q", resp.Username)
+	}
+
+	if w := validate("application/json", `{"token": "`+good+`"}`); w.Code != http.StatusOK {
+		t.Errorf("Valid JSON token returned %d", w.Code)
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	testConfig(t)
+	secret, _ := currentSecrets()
+
+	cases := []struct {
+		name   string
+		token  string
+		reason error
+	}{
+		{"expired", token.New(secret, "alice", time.Now().Add(-time.Minute)).String(), token.ErrExpired},
+		{"bad secret", token.New([]byte("wrong secret"), "alice", time.Now().Add(time.Hour)).String(), token.ErrBadSignature},
+		{"garbage", "not a token", token.ErrMalformed},
+		{"empty", "", token.ErrMalformed},
+	}
+	for _, c := range cases {
+		w := validate("text/plain", c.token)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s token returned %d", c.name, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), c.reason.Error()) {
+			t.Errorf("%s token gave reason %s, wanted %q", c.name, w.Body, c.reason)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+// audience, if set, is the service this instance authenticates for.
+// Tokens it issues are only good for this audience and additionalAudiences,
+// and it only accepts tokens issued for it,
+// so a token for one service can't be used with an unrelated one sharing the secret.
+var audience string
+
+// additionalAudiences are other services that tokens issued here are also good for,
+// so one login works across a few related services
+var additionalAudiences []string
+
+// errWrongAudience means a token wasn't issued for this service
+var errWrongAudience = errors.New("token not issued for this audience")
+
+// issuedAudiences returns the audiences to put in tokens issued here, or nil for none
+func issuedAudiences() []string {
+	if audience == "" {
+		return nil
+	}
+	return append([]string{audience}, additionalAudiences...)
+}
+
+// checkAudience returns nil if a token issued for aud may be used here.
+// Tokens issued without an audience aren't accepted, once one is set.
+func checkAudience(aud []string) error {
+	if audience == "" || slices.Contains(aud, audience) {
+		return nil
+	}
+	return errWrongAudience
+}
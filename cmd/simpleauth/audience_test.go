@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+func TestAudiences(t *testing.T) {
+	testConfig(t)
+
+	// Log in to the wiki, whose tokens also work for files
+	override(t, &audience, "wiki")
+	override(t, &additionalAudiences, []string{"files"})
+	w := serve(loginRequest())
+	if w.Code != loginSuccessCode {
+		t.Fatalf("Login returned %d", w.Code)
+	}
+	tok := cookieToken(t, w.Header().Get("Set-Cookie"))
+	if !slices.Equal(tok.Audience, []string{"wiki", "files"}) {
+		t.Errorf("Token issued for %v", tok.Audience)
+	}
+
+	override(t, &additionalAudiences, nil)
+	for _, tc := range []struct {
+		audience string
+		code     int
+	}{
+		{"wiki", http.StatusOK},
+		{"files", http.StatusOK},
+		{"billing", http.StatusUnauthorized},
+		{"", http.StatusOK},
+	} {
+		override(t, &audience, tc.audience)
+		if w := serve(requestWithToken(tok)); w.Code != tc.code {
+			t.Errorf("Audience %q returned %d, want %d", tc.audience, w.Code, tc.code)
+		}
+	}
+}
+
+func TestAudienceRequired(t *testing.T) {
+	testConfig(t)
+	override(t, &audience, "wiki")
+
+	// Tokens issued without an audience are scoped away, once there is one
+	tok := token.New(secret, "alice", time.Now().Add(time.Hour))
+	if w := serve(requestWithToken(tok)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token without an audience returned %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	validateHandler(w, httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(tok.String())))
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), errWrongAudience.Error()) {
+		t.Errorf("Validate returned %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := tokenRoundTrip(); err != nil {
+		t.Errorf("Self-test failed with an audience: %v", err)
+	}
+}
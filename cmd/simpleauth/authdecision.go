@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// logAuthDecisions logs how each forward-auth response was chosen, even without verbose logging.
+// It's for working out why a client got the login page, or a token, or nothing at all.
+var logAuthDecisions bool
+
+// logAuthDecision logs how authHandler chose response, with status code, for req:
+// whether req was taken as a login, and why, the WWW-Authenticate challenges sent,
+// and the Accept header, which decides between a token body and the usual response.
+// It must be called before the header is written.
+func logAuthDecision(w http.ResponseWriter, req *http.Request, response string, code int) {
+	if !verbose && !logAuthDecisions {
+		return
+	}
+	login := loginReason(req)
+	if login == "" {
+		login = "no"
+	}
+	challenges := strings.Join(w.Header().Values("WWW-Authenticate"), ", ")
+	if challenges == "" {
+		// Without a challenge, browsers show the body instead of a Basic popup
+		challenges = "none"
+	}
+	log.Printf("auth decision: %s %s login:%s subrequest:%v response:%s code:%d www-authenticate:%s accept:%q",
+		req.Method, req.URL.Path, login, isSubrequest(req), response, code, challenges, req.Header.Get("Accept"))
+}
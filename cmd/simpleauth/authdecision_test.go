@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog collects the standard logger's output until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestAuthDecisionLog(t *testing.T) {
+	testConfig(t)
+	override(t, &logAuthDecisions, true)
+	override(t, &tokenBody, "accept")
+
+	browserAccept := "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	for _, tc := range []struct {
+		name string
+		req  *http.Request
+		want []string
+	}{
+		{
+			"browser",
+			httptest.NewRequest(http.MethodGet, "/", nil),
+			[]string{"login:no", "response:login page", "code:401", "www-authenticate:none", `accept:"` + browserAccept + `"`},
+		},
+		{
+			"browser login",
+			loginRequest(),
+			[]string{"login:X-Simpleauth-Login", "response:login page", "code:418", "www-authenticate:none"},
+		},
+		{
+			"script login",
+			loginRequest(),
+			[]string{"login:X-Simpleauth-Login", "response:token body (json)", "code:418", `accept:"application/json"`},
+		},
+	} {
+		if tc.name == "script login" {
+			tc.req.Header.Set("Accept", "application/json")
+		} else {
+			tc.req.Header.Set("Accept", browserAccept)
+		}
+		buf := captureLog(t)
+		serve(tc.req)
+		got := buf.String()
+		if strings.Count(got, "auth decision:") != 1 {
+			t.Errorf("%s: wrong decision log: %q", tc.name, got)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: decision log doesn't say %s: %q", tc.name, want, got)
+			}
+		}
+	}
+}
+
+func TestAuthDecisionLogOff(t *testing.T) {
+	testConfig(t)
+	buf := captureLog(t)
+	serve(httptest.NewRequest(http.MethodGet, "/", nil))
+	if strings.Contains(buf.String(), "auth decision:") {
+		t.Errorf("Decision logged without the option: %q", buf.String())
+	}
+}
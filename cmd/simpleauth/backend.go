@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A backend is a source of user credentials
+type backend interface {
+	// Name identifies the backend in logs and health reports
+	Name() string
+	// Health returns nil if the backend is usable
+	Health() error
+	// Authenticate returns true if the credentials are good.
+	// An error means the backend couldn't decide, not that the password was wrong,
+	// except for credentialsRefused, which says why they're wrong.
+	// Backends should give up when ctx is done.
+	Authenticate(ctx context.Context, username, password string) (bool, error)
+}
+
+// credentialsRefused is returned by a backend that turned down the credentials and knows why,
+// like errUnknownUser, so the reason can be given without checking them again
+type credentialsRefused struct {
+	reason error
+}
+
+func (e credentialsRefused) Error() string {
+	return e.reason.Error()
+}
+
+func (e credentialsRefused) Unwrap() error {
+	return e.reason
+}
+
+// backendTimeout limits how long each backend may take to authenticate (0 for no limit)
+var backendTimeout time.Duration
+
+// slowAuthThreshold, if set, logs a warning when a backend takes longer than this to authenticate
+var slowAuthThreshold time.Duration
+
+// authenticateWithTimeout asks b about the credentials, giving up when ctx is done or backendTimeout passes.
+// A backend that ignores its context is left to finish on its own.
+func authenticateWithTimeout(ctx context.Context, b backend, username, password string) (bool, error) {
+	if backendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, backendTimeout)
+		defer cancel()
+	}
+
+	type result struct {
+		ok  bool
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ok, err := b.Authenticate(ctx, username, password)
+		done <- result{ok, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.ok, r.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// backends are the configured credential sources, tried in order
+var backends []backend
+
+// optionalBackends names backends whose failure only degrades readiness
+var optionalBackends map[string]bool
+
+// passwordBackend authenticates against the loaded password file or users from the environment
+type passwordBackend struct{}
+
+func (passwordBackend) Name() string {
+	return "passwd"
+}
+
+func (passwordBackend) Health() error {
+	if len(currentUsers()) == 0 {
+		return fmt.Errorf("no users configured")
+	}
+	return nil
+}
+
+func (passwordBackend) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	if err := checkPassword(username, password); err != nil {
+		debugf("password check failed for username:%v: %v", logName(username), err)
+		return false, credentialsRefused{err}
+	}
+	if !breachAllowed(ctx, username, password) {
+		return false, nil
+	}
+	debugf("password verification succeeded for username:%v", logName(username))
+	return true, nil
+}
+
+// backendStatus is the readiness report for one backend
+type backendStatus struct {
+	Healthy  bool   `json:"healthy"`
+	Optional bool   `json:"optional"`
+	Error    string `json:"error,omitempty"`
+}
+
+// readyzHandler reports whether each backend is usable,
+// and whether tokens we issue would be accepted.
+//
+// A failing required backend, or a token that doesn't round-trip, makes the service unready (503);
+// a failing optional backend only marks it degraded.
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	status := "ready"
+	statuses := make(map[string]backendStatus, len(backends))
+	for _, b := range backends {
+		bs := backendStatus{
+			Healthy:  true,
+			Optional: optionalBackends[b.Name()],
+		}
+		if err := b.Health(); err != nil {
+			bs.Healthy = false
+			bs.Error = err.Error()
+			debugf("backend %s unhealthy: %v", b.Name(), err)
+			if !bs.Optional {
+				status = "unready"
+			} else if status == "ready" {
+				status = "degraded"
+			}
+		}
+		statuses[b.Name()] = bs
+	}
+	if len(backends) == 0 {
+		status = "unready"
+	}
+	tokens := "ok"
+	if err := tokenRoundTrip(); err != nil {
+		log.Printf("Token self-test failed: %v", err)
+		tokens = err.Error()
+		status = "unready"
+	}
+
+	if status == "unready" {
+		w.Header().Set("Retry-After", healthRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   status,
+		"backends": statuses,
+		"tokens":   tokens,
+	})
+}
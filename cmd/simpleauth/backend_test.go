@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockBackend is a backend with canned answers
+type mockBackend struct {
+	name   string
+	health error
+	users  map[string]string
+	err    error
+	calls  *[]string
+	delay  time.Duration
+}
+
+func (m mockBackend) Name() string  { return m.name }
+func (m mockBackend) Health() error { return m.health }
+
+func (m mockBackend) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	if m.calls != nil {
+		*m.calls = append(*m.calls, m.name)
+	}
+	time.Sleep(m.delay)
+	if m.err != nil {
+		return false, m.err
+	}
+	pw, ok := m.users[username]
+	return ok && pw == password, nil
+}
+
+func getReadyz(t *testing.T) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return w, body
+}
+
+func TestReadyzHealthy(t *testing.T) {
+	testConfig(t)
+	override(t, &backends, []backend{mockBackend{name: "good"}})
+	override(t, &optionalBackends, nil)
+
+	w, body := getReadyz(t)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if body["status"] != "ready" {
+		t.Errorf("Wrong status in body: %v", body["status"])
+	}
+}
+
+func TestReadyzUnhealthy(t *testing.T) {
+	testConfig(t)
+	override(t, &backends, []backend{
+		mockBackend{name: "good"},
+		mockBackend{name: "bad", health: errors.New("unreachable")},
+	})
+	override(t, &optionalBackends, nil)
+
+	w, body := getReadyz(t)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if body["status"] != "unready" {
+		t.Errorf("Wrong status in body: %v", body["status"])
+	}
+	bad := body["backends"].(map[string]any)["bad"].(map[string]any)
+	if bad["healthy"] != false || bad["error"] != "unreachable" {
+		t.Errorf("Wrong backend status: %v", bad)
+	}
+}
+
+func TestReadyzOptionalUnhealthy(t *testing.T) {
+	testConfig(t)
+	override(t, &backends, []backend{
+		mockBackend{name: "good"},
+		mockBackend{name: "bad", health: errors.New("unreachable")},
+	})
+	override(t, &optionalBackends, map[string]bool{"bad": true})
+
+	w, body := getReadyz(t)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if body["status"] != "degraded" {
+		t.Errorf("Wrong status in body: %v", body["status"])
+	}
+}
+
+func TestBackendOrder(t *testing.T) {
+	testConfig(t)
+	var calls []string
+	override(t, &backends, []backend{
+		mockBackend{name: "broken", err: errors.New("connection refused"), calls: &calls},
+		mockBackend{name: "first", users: map[string]string{"alice": "one"}, calls: &calls},
+		mockBackend{name: "second", users: map[string]string{"alice": "two", "bob": "two"}, calls: &calls},
+	})
+
+	// First matching backend wins, and later ones aren't consulted
+	if ok, _ := authenticationValid(context.Background(), "alice", "one"); !ok {
+		t.Error("alice rejected by first backend")
+	}
+	if got := strings.Join(calls, ","); got != "broken,first" {
+		t.Errorf("Wrong backends consulted: %s", got)
+	}
+
+	// Falls through to later backends
+	calls = nil
+	if ok, _ := authenticationValid(context.Background(), "alice", "two"); !ok {
+		t.Error("alice rejected by second backend")
+	}
+	if got := strings.Join(calls, ","); got != "broken,first,second" {
+		t.Errorf("Wrong backends consulted: %s", got)
+	}
+
+	calls = nil
+	if ok, _ := authenticationValid(context.Background(), "bob", "one"); ok {
+		t.Error("bob accepted with wrong password")
+	}
+}
+
+// slowBackend takes forever to answer, ignoring its context
+type slowBackend struct{ mockBackend }
+
+func (s slowBackend) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	time.Sleep(time.Minute)
+	return true, nil
+}
+
+func TestBackendTimeout(t *testing.T) {
+	override(t, &backends, []backend{slowBackend{mockBackend{name: "slow"}}})
+	override(t, &backendTimeout, 50*time.Millisecond)
+
+	start := time.Now()
+	if ok, _ := authenticationValid(context.Background(), "alice", "one"); ok {
+		t.Error("Timed-out backend authenticated")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Timeout took %v", elapsed)
+	}
+}
+
+func TestBackendCanceled(t *testing.T) {
+	override(t, &backends, []backend{slowBackend{mockBackend{name: "slow"}}})
+	override(t, &backendTimeout, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if ok, _ := authenticationValid(ctx, "alice", "one"); ok {
+		t.Error("Canceled backend authenticated")
+	}
+}
+
+func TestSlowAuthLogged(t *testing.T) {
+	testConfig(t)
+	override(t, &backends, []backend{
+		mockBackend{name: "ldap", users: map[string]string{"alice": "one"}, delay: 50 * time.Millisecond},
+	})
+	override(t, &slowAuthThreshold, 10*time.Millisecond)
+	logged := new(strings.Builder)
+	log.SetOutput(logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	authenticationValid(context.Background(), "alice", "one")
+	if !strings.Contains(logged.String(), "slow authentication: backend ldap") {
+		t.Errorf("Slow backend not logged: %q", logged)
+	}
+
+	logged.Reset()
+	override(t, &slowAuthThreshold, time.Minute)
+	authenticationValid(context.Background(), "alice", "one")
+	if strings.Contains(logged.String(), "slow authentication") {
+		t.Errorf("Fast backend logged as slow: %q", logged)
+	}
+}
+
+func TestReadyzTokenRoundTrip(t *testing.T) {
+	testConfig(t)
+	override(t, &backends, []backend{mockBackend{name: "good"}})
+	override(t, &optionalBackends, nil)
+
+	if _, body := getReadyz(t); body["tokens"] != "ok" {
+		t.Errorf("Wrong token status: %v", body["tokens"])
+	}
+
+	// A secret too short to sign with
+	override(t, &secret, []byte("short"))
+	w, body := getReadyz(t)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if body["status"] != "unready" || body["tokens"] == "ok" {
+		t.Errorf("Broken secret not reported: %v", body)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/password"
+)
+
+// breachMode is what to do when someone logs in with a password known from a breach: off, warn, or deny
+var breachMode = "off"
+
+// breachChecker looks up passwords in the HaveIBeenPwned range API
+var breachChecker = password.BreachChecker{
+	URL:    password.DefaultBreachURL,
+	Client: &http.Client{Timeout: 5 * time.Second},
+}
+
+// breachCacheMax limits how many answers are remembered
+const breachCacheMax = 10000
+
+// breachCache remembers answers, so clients sending Basic auth with every request don't hit the API every time.
+// It's keyed by a keyed hash of the password, so it doesn't hold anything crackable offline.
+var breachCache = struct {
+	sync.Mutex
+	breached map[string]bool
+}{breached: map[string]bool{}}
+
+// passwordBreached returns true if pw appears in the breach corpus.
+// If the API can't be reached, it logs the error and returns false,
+// so an outage doesn't lock everyone out.
+func passwordBreached(ctx context.Context, pw string) bool {
+	mac := hmac.New(sha256.New, usernameKey)
+	mac.Write([]byte(pw))
+	key := string(mac.Sum(nil))
+
+	breachCache.Lock()
+	breached, ok := breachCache.breached[key]
+	breachCache.Unlock()
+	if ok {
+		return breached
+	}
+
+	breached, err := breachChecker.Breached(ctx, pw)
+	if err != nil {
+		log.Printf("Checking for breached password: %v", err)
+		return false
+	}
+
+	breachCache.Lock()
+	if len(breachCache.breached) >= breachCacheMax {
+		breachCache.breached = map[string]bool{}
+	}
+	breachCache.breached[key] = breached
+	breachCache.Unlock()
+	return breached
+}
+
+// breachAllowed applies breachMode to a login with good credentials, returning false to deny it
+func breachAllowed(ctx context.Context, username, pw string) bool {
+	if breachMode == "off" || !passwordBreached(ctx, pw) {
+		return true
+	}
+	if breachMode == "deny" {
+		log.Printf("Denying login for username:%v: password appears in a known breach", logName(username))
+		return false
+	}
+	log.Printf("Warning: username:%v logged in with a password that appears in a known breach", logName(username))
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// mockBreachAPI serves a range API that knows breached, and counts requests
+func mockBreachAPI(t *testing.T, breached string) *int {
+	sum := sha1.Sum([]byte(breached))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	requests := new(int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*requests += 1
+		if strings.HasSuffix(req.URL.Path, "/"+digest[:5]) {
+			fmt.Fprintf(w, "%s:42\r\n", digest[5:])
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	override(t, &breachChecker.URL, ts.URL+"/range/")
+	override(t, &breachCache.breached, map[string]bool{})
+	return requests
+}
+
+func TestBreachedPasswordDenied(t *testing.T) {
+	testConfig(t)
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hashPassword(t, alicePassword),
+		"bob":   hashPassword(t, "unbreached-builder-7f3a"),
+	})
+	override(t, &breachMode, "deny")
+	requests := mockBreachAPI(t, alicePassword)
+
+	if w := serve(basicRequest("alice", alicePassword)); w.Code == http.StatusOK {
+		t.Error("Breached password allowed in deny mode")
+	}
+	if w := serve(basicRequest("bob", "unbreached-builder-7f3a")); w.Code != http.StatusOK {
+		t.Errorf("Unbreached password returned %d", w.Code)
+	}
+
+	// Answers are cached
+	serve(basicRequest("bob", "unbreached-builder-7f3a"))
+	if *requests != 2 {
+		t.Errorf("Made %d API requests, expected 2", *requests)
+	}
+}
+
+func TestBreachedPasswordWarn(t *testing.T) {
+	testConfig(t)
+	override(t, &breachMode, "warn")
+	mockBreachAPI(t, alicePassword)
+
+	if w := serve(basicRequest("alice", alicePassword)); w.Code != http.StatusOK {
+		t.Errorf("Breached password denied in warn mode: %d", w.Code)
+	}
+}
+
+func TestBreachedPasswordWrongPasswordNotChecked(t *testing.T) {
+	testConfig(t)
+	override(t, &breachMode, "deny")
+	requests := mockBreachAPI(t, alicePassword)
+
+	serve(basicRequest("alice", "wrong"))
+	if *requests != 0 {
+		t.Error("Checked a password that didn't match")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// clientCertUsers maps client certificate identities (CN, DNS or email SAN) to usernames.
+// Client certificates are only checked if simpleauth is serving TLS itself, with a client CA.
+var clientCertUsers map[string]string
+
+// parseClientCertUsers parses "identity=username,identity=username"
+func parseClientCertUsers(s string) (map[string]string, error) {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		identity, username, ok := strings.Cut(pair, "=")
+		identity = strings.TrimSpace(identity)
+		username = strings.ToLower(strings.TrimSpace(username))
+		if !ok || identity == "" || username == "" {
+			return nil, fmt.Errorf("invalid client certificate mapping %q, expected 'identity=username'", pair)
+		}
+		users[identity] = username
+	}
+	return users, nil
+}
+
+// clientCertTLSConfig returns a TLS configuration that verifies client certificates against the CA in caPath.
+// Clients without a certificate can still connect, and log in some other way.
+func clientCertTLSConfig(caPath string) (*tls.Config, error) {
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caPath)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// clientCertUsername returns the username mapped to the request's verified client certificate, if any
+func clientCertUsername(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(clientCertUsers) == 0 {
+		return ""
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	identities := []string{cert.Subject.CommonName}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, identity := range identities {
+		if username, ok := clientCertUsers[identity]; ok && identity != "" {
+			debugf("client certificate %q maps to username:%v", identity, logName(username))
+			return username
+		}
+	}
+	debugf("client certificate %q is not mapped to a user", cert.Subject.CommonName)
+	return ""
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority for issuing client certificates in tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert, key}
+}
+
+// writePEM writes the CA certificate to a file, returning its path
+func (ca testCA) writePEM(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(path, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns a client certificate for commonName
+func (ca testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// clientCertServer starts a TLS server that trusts client certificates from ca
+func clientCertServer(t *testing.T, ca testCA) *httptest.Server {
+	config, err := clientCertTLSConfig(ca.writePEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(rootHandler))
+	ts.TLS = config
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func clientCertLogin(ts *httptest.Server, cert tls.Certificate) (*http.Response, error) {
+	client := ts.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Simpleauth-Login", "true")
+	return client.Do(req)
+}
+
+func TestParseClientCertUsers(t *testing.T) {
+	users, err := parseClientCertUsers("alice.example.com=alice, bob@example.com=Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users["alice.example.com"] != "alice" || users["bob@example.com"] != "bob" {
+		t.Errorf("Wrong mapping: %v", users)
+	}
+
+	if _, err := parseClientCertUsers("alice.example.com"); err == nil {
+		t.Error("Mapping without a username was accepted")
+	}
+}
+
+func TestClientCertLogin(t *testing.T) {
+	testConfig(t)
+	override(t, &clientCertUsers, map[string]string{"alice.example.com": "alice"})
+	ca := newTestCA(t)
+	ts := clientCertServer(t, ca)
+
+	resp, err := clientCertLogin(ts, ca.issue(t, "alice.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot {
+		t.Errorf("Client certificate login returned %d", resp.StatusCode)
+	}
+	if len(resp.Cookies()) == 0 {
+		t.Error("No token issued for client certificate login")
+	}
+}
+
+func TestClientCertUnmapped(t *testing.T) {
+	testConfig(t)
+	override(t, &clientCertUsers, map[string]string{"alice.example.com": "alice"})
+	ca := newTestCA(t)
+	ts := clientCertServer(t, ca)
+
+	resp, err := clientCertLogin(ts, ca.issue(t, "mallory.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(resp.Cookies()) > 0 {
+		t.Error("Unmapped client certificate logged in")
+	}
+}
+
+func TestClientCertUntrusted(t *testing.T) {
+	testConfig(t)
+	override(t, &clientCertUsers, map[string]string{"alice.example.com": "alice"})
+	ts := clientCertServer(t, newTestCA(t))
+
+	// Same name, wrong CA
+	resp, err := clientCertLogin(ts, newTestCA(t).issue(t, "alice.example.com"))
+	if err == nil {
+		resp.Body.Close()
+		if len(resp.Cookies()) > 0 {
+			t.Error("Client certificate from untrusted CA logged in")
+		}
+	}
+}
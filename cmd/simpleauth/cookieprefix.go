@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Browsers hold cookies with these name prefixes to extra requirements,
+// refusing to store them otherwise:
+// __Secure- must be Secure;
+// __Host- must be Secure, with Path=/ and no Domain;
+// __Http- must be Secure and HttpOnly;
+// __Host-Http- must be all of those.
+//
+// The auth cookie is always Secure with Path=/, so only Domain and HttpOnly need minding.
+
+// hasCookiePrefix returns true if name starts with prefix, which browsers compare without regard to case
+func hasCookiePrefix(name, prefix string) bool {
+	return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+}
+
+// hostOnlyCookie returns true if a cookie called name must not have a Domain
+func hostOnlyCookie(name string) bool {
+	return hasCookiePrefix(name, "__Host-")
+}
+
+// httpOnlyCookie returns true if a cookie called name must be HttpOnly
+func httpOnlyCookie(name string) bool {
+	return hasCookiePrefix(name, "__Http-") || hasCookiePrefix(name, "__Host-Http-")
+}
+
+// checkCookiePrefix returns an error if the cookie called name
+// would have to break its prefix's requirements, with the attributes in omit left off
+func checkCookiePrefix(name string, omit map[string]bool) error {
+	if httpOnlyCookie(name) && omit["HttpOnly"] {
+		return fmt.Errorf("cookie name %q must be HttpOnly, which SIMPLEAUTH_COOKIE_OMIT leaves off: pick a name without the prefix", name)
+	}
+	return nil
+}
+
+// cookieDomain returns the Domain for the auth cookie sent to req, or "" for none
+func cookieDomain(req *http.Request) string {
+	// Set if Caddy specified one (via header_up).
+	// An invalid domain is left off, and logged by net/http.
+	domain := req.Header.Get("X-Simpleauth-Domain")
+	if domain != "" && hostOnlyCookie(cookieName) {
+		debugf("leaving Domain=%s off %s cookie", domain, cookieName)
+		return ""
+	}
+	return domain
+}
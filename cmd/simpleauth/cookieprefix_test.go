@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// prefixedCookie returns the auth cookie sent for a request asking for Domain=example.com
+func prefixedCookie(t *testing.T) *http.Cookie {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Simpleauth-Domain", "example.com")
+	w := httptest.NewRecorder()
+	setAuthCookie(w, req, "token", 0)
+	return parseSetCookie(t, w.Header().Get("Set-Cookie"))
+}
+
+func TestHostCookiePrefix(t *testing.T) {
+	testConfig(t)
+
+	for _, name := range []string{"__Host-simpleauth", "__host-simpleauth", "__Host-Http-simpleauth"} {
+		override(t, &cookieName, name)
+		cookie := prefixedCookie(t)
+		if cookie.Domain != "" {
+			t.Errorf("%s: Domain set: %q", name, cookie.Domain)
+		}
+		if !cookie.Secure || cookie.Path != "/" {
+			t.Errorf("%s: missing required attributes: %s", name, cookie)
+		}
+	}
+}
+
+func TestOtherCookiePrefixesKeepDomain(t *testing.T) {
+	testConfig(t)
+
+	for _, name := range []string{"__Secure-simpleauth", "__Http-simpleauth", "simpleauth"} {
+		override(t, &cookieName, name)
+		if cookie := prefixedCookie(t); cookie.Domain != "example.com" || !cookie.Secure {
+			t.Errorf("%s: wrong attributes: %s", name, cookie)
+		}
+	}
+}
+
+func TestCheckCookiePrefix(t *testing.T) {
+	omitHttpOnly := map[string]bool{"HttpOnly": true}
+	for _, name := range []string{"__Http-simpleauth", "__Host-Http-simpleauth"} {
+		if err := checkCookiePrefix(name, omitHttpOnly); err == nil {
+			t.Errorf("%s: no error omitting HttpOnly", name)
+		}
+		if err := checkCookiePrefix(name, map[string]bool{}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"__Host-simpleauth", "__Secure-simpleauth", "simpleauth"} {
+		if err := checkCookiePrefix(name, omitHttpOnly); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"git.woozle.org/neale/simpleauth/web"
+)
+
+func TestCSPNonce(t *testing.T) {
+	testConfig(t)
+	override(t, &cspTemplate, suggestedCSP)
+	if err := setLoginHtml(web.LoginHTML); err != nil {
+		t.Fatal(err)
+	}
+
+	nonceRE := regexp.MustCompile(`script-src 'nonce-([^']+)'`)
+	var nonces []string
+	for i := 0; i < 2; i++ {
+		w := serve(httptest.NewRequest(http.MethodGet, "/", nil))
+		csp := w.Header().Get("Content-Security-Policy")
+		m := nonceRE.FindStringSubmatch(csp)
+		if m == nil {
+			t.Fatalf("No nonce in policy: %q", csp)
+		}
+		nonce := m[1]
+		body := w.Body.String()
+		if !strings.Contains(body, `<script nonce="`+nonce+`">`) || !strings.Contains(body, `<style nonce="`+nonce+`">`) {
+			t.Errorf("Page doesn't carry the header's nonce %q", nonce)
+		}
+		if strings.Contains(csp, "{nonce}") {
+			t.Errorf("Placeholder left in policy: %q", csp)
+		}
+		nonces = append(nonces, nonce)
+	}
+	if nonces[0] == nonces[1] {
+		t.Error("Nonce reused between responses")
+	}
+}
+
+func TestNoCSPByDefault(t *testing.T) {
+	testConfig(t)
+	w := serve(httptest.NewRequest(http.MethodGet, "/", nil))
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "" {
+		t.Errorf("Unexpected policy: %q", csp)
+	}
+}
+
+func TestSuggestedCSPAllowsLogo(t *testing.T) {
+	if !strings.Contains(suggestedCSP, "img-src 'self' https:;") {
+		t.Errorf("Suggested policy would block a brand logo: %q", suggestedCSP)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CSRF protection uses the double-submit pattern:
+// the token is set in a cookie, and must also be sent back in a header,
+// or in a form field from the login form.
+// A cross-site attacker can make the browser send the cookie,
+// but can't read it to fill in the header.
+const (
+	csrfCookieName = "simpleauth-csrf"
+	csrfHeaderName = "X-Csrf-Token"
+	csrfFormField  = "forward-auth-csrf"
+)
+
+// csrfProtection requires a CSRF token on login attempts
+var csrfProtection bool
+
+// newCSRFToken returns a random CSRF token
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// csrfValid returns true if the request's CSRF header, or posted form field, matches its CSRF cookie
+func csrfValid(req *http.Request) bool {
+	cookie, err := req.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		debugf("csrf: no cookie")
+		return false
+	}
+	presented := req.Header.Get(csrfHeaderName)
+	if presented == "" {
+		presented = req.PostForm.Get(csrfFormField)
+	}
+	if presented == "" {
+		debugf("csrf: no %s header or %s field", csrfHeaderName, csrfFormField)
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(presented)) == 1
+}
+
+// setCSRFCookie sets the CSRF cookie to csrfToken
+func setCSRFCookie(w http.ResponseWriter, csrfToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// pageCSRFToken returns the CSRF token for the login page to post back, or "" if CSRF protection is off.
+// A browser that already has one keeps it, so a page that's still open stays good.
+func pageCSRFToken(w http.ResponseWriter, req *http.Request) (string, error) {
+	if !csrfProtection {
+		return "", nil
+	}
+	if cookie, err := req.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	setCSRFCookie(w, csrfToken)
+	return csrfToken, nil
+}
+
+// requestOrigin returns the origin of the original request, like "https://example.com"
+func requestOrigin(req *http.Request) string {
+	scheme := strings.ToLower(forwardedProto(req))
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+	host := forwardedHostPort(req)
+	if host == "" {
+		host = req.Host
+	}
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil && port == defaultPorts[scheme] {
+		host = h
+	}
+	return scheme + "://" + host
+}
+
+// formFromSameOrigin returns false if the browser says the login form was posted from another site.
+// A cross-site form post needs no preflight, so without this anybody's page could log visitors in as somebody else.
+// Browsers send Origin, and most send Sec-Fetch-Site, with form posts;
+// clients that send neither aren't browsers, and can't be made to post for anyone else.
+func formFromSameOrigin(req *http.Request) bool {
+	switch site := req.Header.Get("Sec-Fetch-Site"); site {
+	case "", "same-origin", "none":
+	default:
+		debugf("login form posted from %s", site)
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !strings.EqualFold(origin, requestOrigin(req)) {
+		debugf("login form posted from %s, not %s", origin, requestOrigin(req))
+		return false
+	}
+	return true
+}
+
+// csrfHandler issues a fresh CSRF token, for single-page apps to send with their login request
+func csrfHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "method not allowed",
+		})
+		return
+	}
+
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "unable to generate token",
+		})
+		return
+	}
+
+	setCSRFCookie(w, csrfToken)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"csrf_token": csrfToken,
+		"header":     csrfHeaderName,
+	})
+}
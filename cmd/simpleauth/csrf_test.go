@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"git.woozle.org/neale/simpleauth/web"
+)
+
+func TestCSRFTokenEndpoint(t *testing.T) {
+	testConfig(t)
+	override(t, &csrfProtection, true)
+
+	w := httptest.NewRecorder()
+	csrfHandler(w, httptest.NewRequest(http.MethodGet, "/csrf", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status: %d", w.Code)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	csrfToken := body["csrf_token"]
+	if csrfToken == "" {
+		t.Fatal("No token returned")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName || cookies[0].Value != csrfToken {
+		t.Fatalf("Wrong cookie: %v", cookies)
+	}
+
+	// Login with the paired cookie and header
+	req := loginRequest()
+	req.AddCookie(cookies[0])
+	req.Header.Set(csrfHeaderName, csrfToken)
+	if w := serve(req); w.Code != http.StatusTeapot {
+		t.Errorf("Login with CSRF token: got %d", w.Code)
+	}
+
+	// Without the header
+	req = loginRequest()
+	req.AddCookie(cookies[0])
+	if w := serve(req); w.Code != http.StatusForbidden {
+		t.Errorf("Login without CSRF header: got %d", w.Code)
+	}
+
+	// With a mismatched header
+	req = loginRequest()
+	req.AddCookie(cookies[0])
+	req.Header.Set(csrfHeaderName, "forged")
+	if w := serve(req); w.Code != http.StatusForbidden {
+		t.Errorf("Login with forged CSRF header: got %d", w.Code)
+	}
+}
+
+func TestCSRFLoginForm(t *testing.T) {
+	testConfig(t)
+	override(t, &csrfProtection, true)
+	override(t, &loginTemplate, template.Must(parseLoginHtml(web.LoginHTML)))
+
+	// The login page carries a token, matching the cookie it sets
+	w := serve(httptest.NewRequest(http.MethodGet, "/", nil))
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("Login page set no CSRF cookie")
+	}
+	if !strings.Contains(w.Body.String(), `name="forward-auth-csrf" value="`+cookie.Value+`"`) {
+		t.Fatalf("Login page has no CSRF field: %s", w.Body)
+	}
+
+	// A browser that already has a token keeps it
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	if w := serve(req); w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("CSRF cookie replaced: %s", w.Header().Get("Set-Cookie"))
+	}
+
+	for _, tc := range []struct {
+		field string
+		code  int
+	}{
+		{cookie.Value, http.StatusSeeOther},
+		{"", http.StatusForbidden},
+		{"wrong", http.StatusForbidden},
+	} {
+		req := formRequest("/", url.Values{
+			"forward-auth-username": {"alice"},
+			"forward-auth-password": {alicePassword},
+			"forward-auth-csrf":     {tc.field},
+		})
+		req.AddCookie(cookie)
+		if w := serve(req); w.Code != tc.code {
+			t.Errorf("Form with CSRF field %q returned %d, want %d", tc.field, w.Code, tc.code)
+		}
+	}
+}
+
+func TestCSRFLoginPageScript(t *testing.T) {
+	testConfig(t)
+	override(t, &csrfProtection, true)
+	override(t, &loginTemplate, template.Must(parseLoginHtml(web.LoginHTML)))
+
+	// The page's script logs in with fetch, so it has to send the token as a header
+	body := serve(httptest.NewRequest(http.MethodGet, "/", nil)).Body.String()
+	for _, want := range []string{`fetch("/csrf"`, `headers.set("X-Csrf-Token", token)`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Login page script doesn't have %s", want)
+		}
+	}
+}
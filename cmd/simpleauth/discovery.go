@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// discoveryDocument tells clients how to authenticate
+type discoveryDocument struct {
+	// Methods are the enabled ways to authenticate: password, totp, client_certificate
+	Methods []string `json:"methods"`
+	// Endpoints maps what an endpoint does to its path
+	Endpoints map[string]string `json:"endpoints"`
+	// Cookie is the name of the cookie holding the token
+	Cookie string `json:"cookie"`
+	// CSRF is true if logins must carry a token from the csrf endpoint
+	CSRF bool `json:"csrf"`
+}
+
+// discovery describes the enabled authentication methods and endpoints
+func discovery() discoveryDocument {
+	doc := discoveryDocument{
+		Methods: []string{"password"},
+		Endpoints: map[string]string{
+			"login":     "/",
+			"api_login": "/api/login",
+			"validate":  "/validate",
+			"logout":    "/logout",
+		},
+		Cookie: cookieName,
+		CSRF:   csrfProtection,
+	}
+	if loginPath != "" {
+		doc.Endpoints["login"] = loginPath
+	}
+	if totpEnabled() {
+		doc.Methods = append(doc.Methods, "totp")
+	}
+	if totpPath != "" {
+		doc.Endpoints["totp_enroll"] = "/totp/enroll"
+	}
+	if len(clientCertUsers) > 0 {
+		doc.Methods = append(doc.Methods, "client_certificate")
+	}
+	if csrfProtection {
+		doc.Endpoints["csrf"] = "/csrf"
+	}
+	if len(mutationPaths) > 0 {
+		doc.Endpoints["mutation_token"] = "/mutation-token"
+	}
+	return doc
+}
+
+// discoveryHandler serves the discovery document, at /.well-known/simpleauth
+func discoveryHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	json.NewEncoder(w).Encode(discovery())
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// getDiscovery fetches the discovery document
+func getDiscovery(t *testing.T) discoveryDocument {
+	t.Helper()
+	w := httptest.NewRecorder()
+	discoveryHandler(w, httptest.NewRequest(http.MethodGet, "/.well-known/simpleauth", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Discovery returned %d", w.Code)
+	}
+	var doc discoveryDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestDiscoveryDefaults(t *testing.T) {
+	testConfig(t)
+	override(t, &clientCertUsers, nil)
+
+	doc := getDiscovery(t)
+	if !slices.Equal(doc.Methods, []string{"password"}) {
+		t.Errorf("Wrong methods: %v", doc.Methods)
+	}
+	if doc.Cookie != cookieName {
+		t.Errorf("Wrong cookie name: %q", doc.Cookie)
+	}
+	if doc.Endpoints["login"] != "/" || doc.Endpoints["api_login"] != "/api/login" {
+		t.Errorf("Wrong endpoints: %v", doc.Endpoints)
+	}
+	if _, ok := doc.Endpoints["totp_enroll"]; ok {
+		t.Error("TOTP enrollment listed with TOTP off")
+	}
+	if doc.CSRF {
+		t.Error("CSRF listed as required")
+	}
+}
+
+func TestDiscoveryFeatures(t *testing.T) {
+	testConfig(t)
+	override(t, &totpPath, "/tmp/totp")
+	override(t, &clientCertUsers, map[string]string{"alice.example.com": "alice"})
+	override(t, &csrfProtection, true)
+	override(t, &loginPath, "/login")
+
+	doc := getDiscovery(t)
+	if !slices.Equal(doc.Methods, []string{"password", "totp", "client_certificate"}) {
+		t.Errorf("Wrong methods: %v", doc.Methods)
+	}
+	if doc.Endpoints["login"] != "/login" {
+		t.Errorf("Wrong login endpoint: %q", doc.Endpoints["login"])
+	}
+	if doc.Endpoints["totp_enroll"] != "/totp/enroll" || doc.Endpoints["csrf"] != "/csrf" {
+		t.Errorf("Wrong endpoints: %v", doc.Endpoints)
+	}
+	if !doc.CSRF {
+		t.Error("CSRF not listed as required")
+	}
+}
+
+func TestDiscoveryClientCertificate(t *testing.T) {
+	testConfig(t)
+
+	override(t, &clientCertUsers, map[string]string{})
+	if doc := getDiscovery(t); slices.Contains(doc.Methods, "client_certificate") {
+		t.Errorf("Client certificates listed with no identities mapped: %v", doc.Methods)
+	}
+
+	override(t, &clientCertUsers, map[string]string{"alice.example.com": "alice"})
+	if doc := getDiscovery(t); !slices.Contains(doc.Methods, "client_certificate") {
+		t.Errorf("Client certificates not listed: %v", doc.Methods)
+	}
+}
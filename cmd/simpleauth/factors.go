@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Authentication factors a login can satisfy
+const (
+	factorPassword = "password"
+	factorTOTP     = "totp"
+	factorCert     = "cert"
+	factorAddress  = "address"
+)
+
+// knownFactors are the factors that can appear in a factor lifespan rule
+var knownFactors = []string{factorPassword, factorTOTP, factorCert, factorAddress}
+
+// factorLifespanRule gives the token lifespan for logins satisfying every one of its factors
+type factorLifespanRule struct {
+	factors  []string
+	lifespan time.Duration
+}
+
+// factorLifespans, if any, set the token lifespan by which factors a login satisfied.
+// They replace lifespan, and rememberLifespan.
+var factorLifespans []factorLifespanRule
+
+// parseFactorLifespans parses rules like "password=1h,password+totp=720h,cert=720h"
+func parseFactorLifespans(spec string) ([]factorLifespanRule, error) {
+	var rules []factorLifespanRule
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		combo, d, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("factor lifespan %q should look like password+totp=720h", pair)
+		}
+		lifespan, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, fmt.Errorf("factor lifespan %q: %w", pair, err)
+		}
+		rule := factorLifespanRule{lifespan: lifespan}
+		for _, factor := range strings.Split(combo, "+") {
+			factor = strings.ToLower(strings.TrimSpace(factor))
+			if !slices.Contains(knownFactors, factor) {
+				return nil, fmt.Errorf("factor lifespan %q: unknown factor %q, expected one of %s", pair, factor, strings.Join(knownFactors, ", "))
+			}
+			rule.factors = append(rule.factors, factor)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// loginFactors returns the factors satisfied by a successful login of username from req.
+// A client certificate or a service account address logs in on its own;
+// otherwise it took a password, and a TOTP code too if the user is enrolled.
+func loginFactors(req *http.Request, username string) []string {
+	if clientCertUsername(req) != "" {
+		return []string{factorCert}
+	}
+	if _, _, ok := req.BasicAuth(); !ok && serviceAccount(req) == username {
+		return []string{factorAddress}
+	}
+	factors := []string{factorPassword}
+	if totpSecret(username) != "" {
+		factors = append(factors, factorTOTP)
+	}
+	return factors
+}
+
+// factorLifespan returns the longest lifespan of the rules whose factors are all satisfied,
+// and false if none are
+func factorLifespan(satisfied []string) (time.Duration, bool) {
+	var longest time.Duration
+	found := false
+	for _, rule := range factorLifespans {
+		all := true
+		for _, factor := range rule.factors {
+			all = all && slices.Contains(satisfied, factor)
+		}
+		if all && (!found || rule.lifespan > longest) {
+			longest = rule.lifespan
+			found = true
+		}
+	}
+	return longest, found
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestParseFactorLifespans(t *testing.T) {
+	rules, err := parseFactorLifespans("password=1h, Password+TOTP=720h,cert=720h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[1].lifespan != 720*time.Hour || len(rules[1].factors) != 2 || rules[1].factors[1] != "totp" {
+		t.Errorf("Wrong rules: %v", rules)
+	}
+	for _, bad := range []string{"password", "password=soon", "sms=1h"} {
+		if _, err := parseFactorLifespans(bad); err == nil {
+			t.Errorf("Accepted %q", bad)
+		}
+	}
+}
+
+// loginLifespan logs in as alice, with a TOTP code if code isn't empty,
+// returning how long the token lasts
+func loginLifespan(t *testing.T, code string) time.Duration {
+	t.Helper()
+	req := loginRequest()
+	if code != "" {
+		req.Header.Set("X-Simpleauth-Totp", code)
+	}
+	w := serve(req)
+	if w.Code != loginSuccessCode {
+		t.Fatalf("Login returned %d", w.Code)
+	}
+	tok := cookieToken(t, w.Header().Get("Set-Cookie"))
+	return time.Until(tok.Expiration).Round(time.Hour)
+}
+
+func TestFactorLifespans(t *testing.T) {
+	testConfig(t)
+	rules, _ := parseFactorLifespans("password=1h,password+totp=720h")
+	override(t, &factorLifespans, rules)
+
+	if got := loginLifespan(t, ""); got != time.Hour {
+		t.Errorf("Password-only login lasts %v", got)
+	}
+
+	secret := "JBSWY3DPEHPK3PXP"
+	override(t, &totpPath, "/nonexistent/totp")
+	override(t, &totpSecrets, map[string]string{"alice": secret})
+	override(t, &totpLastStep, map[string]int64{})
+	code, _ := totp.GenerateCode(secret, time.Now())
+	if got := loginLifespan(t, code); got != 720*time.Hour {
+		t.Errorf("Password and TOTP login lasts %v", got)
+	}
+}
+
+func TestFactorLifespansNoMatch(t *testing.T) {
+	testConfig(t)
+	rules, _ := parseFactorLifespans("cert=720h")
+	override(t, &factorLifespans, rules)
+
+	if got := loginLifespan(t, ""); got != lifespan.Round(time.Hour) {
+		t.Errorf("Login matching no rule lasts %v, not %v", got, lifespan)
+	}
+}
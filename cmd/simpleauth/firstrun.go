@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// exitFirstRun is the exit code when simpleauth hasn't been set up yet.
+// It's EX_CONFIG from sysexits.h, so container platforms can tell it from a crash.
+const exitFirstRun = 78
+
+// isFirstRun returns true if there's no secret and no users configured anywhere,
+// which means nobody has set simpleauth up yet
+func isFirstRun(passwordPath, secretPath string) bool {
+	if usersEnvVar() != "" || os.Getenv("SIMPLEAUTH_SECRET") != "" {
+		return false
+	}
+	for _, p := range []string{passwordPath, secretPath} {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			return false
+		}
+	}
+	return true
+}
+
+// firstRunInstructions explains how to set simpleauth up
+func firstRunInstructions(w io.Writer, passwordPath, secretPath string) {
+	fmt.Fprintf(w, `simpleauth isn't set up yet: there's no secret and no users.
+
+1. Create a secret, to sign login tokens:
+
+       dd if=/dev/urandom of=%[2]s bs=1 count=64
+
+   or set SIMPLEAUTH_SECRET to the output of:
+
+       openssl rand -base64 64
+
+2. Add users, with hashes from the crypt tool:
+
+       crypt alice 'alice password' >> %[1]s
+
+   or set SIMPLEAUTH_USERS_JSON to a JSON list of users, like
+   [{"username": "alice", "hash": "(crypt's output)"}].
+
+Use -passwd and -secret (SIMPLEAUTH_PASSWORD_FILE and SIMPLEAUTH_SECRET_FILE)
+to keep these files somewhere else.
+
+To try simpleauth out without a secret, run it with -dev.
+`, passwordPath, secretPath)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFirstRun(t *testing.T) {
+	t.Setenv("SIMPLEAUTH_USERS", "")
+	t.Setenv("SIMPLEAUTH_SECRET", "")
+	dir := t.TempDir()
+	passwordPath := filepath.Join(dir, "passwd")
+	secretPath := filepath.Join(dir, "simpleauth.key")
+
+	if !isFirstRun(passwordPath, secretPath) {
+		t.Fatal("Missing secret and users not taken as first run")
+	}
+	buf := new(bytes.Buffer)
+	firstRunInstructions(buf, passwordPath, secretPath)
+	for _, want := range []string{passwordPath, secretPath, "openssl rand", "SIMPLEAUTH_USERS", "-dev"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Instructions don't mention %q", want)
+		}
+	}
+
+	t.Setenv("SIMPLEAUTH_SECRET", "c2VjcmV0")
+	if isFirstRun(passwordPath, secretPath) {
+		t.Error("Secret in the environment taken as first run")
+	}
+	t.Setenv("SIMPLEAUTH_SECRET", "")
+	if err := os.WriteFile(passwordPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if isFirstRun(passwordPath, secretPath) {
+		t.Error("Existing password file taken as first run")
+	}
+}
+
+// TestFirstRunExit runs main in a new process, since it exits
+func TestFirstRunExit(t *testing.T) {
+	if os.Getenv("SIMPLEAUTH_TEST_FIRST_RUN") != "" {
+		os.Args = []string{"simpleauth"}
+		main()
+		return
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFirstRunExit$")
+	cmd.Env = append(os.Environ(),
+		"SIMPLEAUTH_TEST_FIRST_RUN=1",
+		"SIMPLEAUTH_USERS=",
+		"SIMPLEAUTH_SECRET=",
+		"SIMPLEAUTH_PASSWORD_FILE="+filepath.Join(dir, "passwd"),
+		"SIMPLEAUTH_SECRET_FILE="+filepath.Join(dir, "simpleauth.key"),
+	)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitFirstRun {
+		t.Fatalf("Wanted exit code %d, got %v", exitFirstRun, err)
+	}
+	if !strings.Contains(stderr.String(), "isn't set up yet") {
+		t.Errorf("No setup instructions: %s", stderr)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaderNames are the request headers a proxy uses to describe the original request
+type forwardedHeaderNames struct {
+	Proto  string
+	Host   string
+	Port   string
+	URI    string
+	Method string
+}
+
+// forwardedPresets are the header names used by common proxies
+var forwardedPresets = map[string]forwardedHeaderNames{
+	"caddy": {
+		Proto:  "X-Forwarded-Proto",
+		Host:   "X-Forwarded-Host",
+		Port:   "X-Forwarded-Port",
+		URI:    "X-Forwarded-Uri",
+		Method: "X-Forwarded-Method",
+	},
+	"traefik": {
+		Proto:  "X-Forwarded-Proto",
+		Host:   "X-Forwarded-Host",
+		Port:   "X-Forwarded-Port",
+		URI:    "X-Forwarded-Uri",
+		Method: "X-Forwarded-Method",
+	},
+	// nginx has no convention: these match the auth_request examples in its documentation
+	"nginx": {
+		Proto:  "X-Forwarded-Proto",
+		Host:   "X-Forwarded-Host",
+		Port:   "X-Forwarded-Port",
+		URI:    "X-Original-URI",
+		Method: "X-Original-Method",
+	},
+}
+
+// forwardedHeaders are the header names in use
+var forwardedHeaders = forwardedPresets["caddy"]
+
+// parseForwardedHeaders starts with a preset, and replaces header names from overrides,
+// which look like "uri=X-Original-URI,method=X-Original-Method".
+func parseForwardedHeaders(preset, overrides string) (forwardedHeaderNames, error) {
+	names, ok := forwardedPresets[strings.ToLower(preset)]
+	if !ok {
+		return names, fmt.Errorf("unknown forwarded header preset %q, expected caddy, traefik, or nginx", preset)
+	}
+	for _, pair := range strings.Split(overrides, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		field, name, _ := strings.Cut(pair, "=")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			return names, fmt.Errorf("invalid forwarded header %q, expected field=Header-Name", pair)
+		}
+		switch strings.ToLower(strings.TrimSpace(field)) {
+		case "proto":
+			names.Proto = name
+		case "host":
+			names.Host = name
+		case "port":
+			names.Port = name
+		case "uri":
+			names.URI = name
+		case "method":
+			names.Method = name
+		default:
+			return names, fmt.Errorf("unknown forwarded header field %q, expected proto, host, port, uri, or method", field)
+		}
+	}
+	return names, nil
+}
+
+// forwardedProto returns the original request's scheme, according to the proxy
+func forwardedProto(req *http.Request) string {
+	return req.Header.Get(forwardedHeaders.Proto)
+}
+
+// forwardedHost returns the original request's host, according to the proxy
+func forwardedHost(req *http.Request) string {
+	return req.Header.Get(forwardedHeaders.Host)
+}
+
+// forwardedPort returns the original request's port, according to the proxy
+func forwardedPort(req *http.Request) string {
+	return req.Header.Get(forwardedHeaders.Port)
+}
+
+// defaultPorts are the ports URLs leave out for each scheme
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// forwardedHostPort returns the original request's host,
+// with the port added if the proxy gave one that isn't the scheme's default
+func forwardedHostPort(req *http.Request) string {
+	host := forwardedHost(req)
+	port := forwardedPort(req)
+	if host == "" || port == "" || port == defaultPorts[strings.ToLower(forwardedProto(req))] {
+		return host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		// The host header already has a port
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// forwardedURI returns the original request's URI, according to the proxy
+func forwardedURI(req *http.Request) string {
+	return req.Header.Get(forwardedHeaders.URI)
+}
+
+// forwardedMethod returns the original request's method, according to the proxy
+func forwardedMethod(req *http.Request) string {
+	return req.Header.Get(forwardedHeaders.Method)
+}
+
+// rawForwardedHeaders turns off normalizeForwardedHeaders, leaving headers as the proxy sent them
+var rawForwardedHeaders bool
+
+// listHeaders are forwarded headers whose values are lists.
+// Normalizing joins their values, rather than keeping the last.
+// Only headers read with the client's entries in mind belong here:
+// X-Simpleauth-Required-Groups doesn't, since a group the client adds would widen access.
+var listHeaders = map[string]bool{
+	"X-Forwarded-For": true,
+}
+
+// caselessHeaders are forwarded headers whose values don't depend on case,
+// which normalizing lowercases
+var caselessHeaders = map[string]bool{
+	"X-Simpleauth-Login":    true,
+	"X-Simpleauth-Domain":   true,
+	"X-Simpleauth-Remember": true,
+}
+
+// isForwardedHeader returns true if name is a header the proxy uses to tell us about a request.
+// name must be canonical.
+func isForwardedHeader(name string) bool {
+	if strings.HasPrefix(name, "X-Forwarded-") || strings.HasPrefix(name, "X-Simpleauth-") || name == "X-Real-Ip" {
+		return true
+	}
+	// Presets use the spelling in proxy documentation, like X-Original-URI
+	for _, h := range []string{forwardedHeaders.URI, forwardedHeaders.Method} {
+		if name == http.CanonicalHeaderKey(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeForwardedHeaders tidies up the headers the proxy describes a request with,
+// since proxies differ in whitespace, and some send a header twice.
+//
+// Values are trimmed, and only the last is kept, except for list headers, whose values are joined.
+// The proto, host, and port headers keep only their last comma-separated value.
+// Proxies append to what they're sent, so the earlier values could have come from the client,
+// and only the last, from the proxy nearest simpleauth, can be believed.
+// Schemes, hosts, and caseless X-Simpleauth-* headers are lowercased.
+func normalizeForwardedHeaders(req *http.Request) {
+	if rawForwardedHeaders {
+		return
+	}
+	for name, values := range req.Header {
+		if !isForwardedHeader(name) || len(values) == 0 {
+			continue
+		}
+		var value string
+		if listHeaders[name] {
+			trimmed := make([]string, 0, len(values))
+			for _, v := range values {
+				if v = strings.TrimSpace(v); v != "" {
+					trimmed = append(trimmed, v)
+				}
+			}
+			value = strings.Join(trimmed, ", ")
+		} else {
+			value = strings.TrimSpace(values[len(values)-1])
+		}
+		proto := name == http.CanonicalHeaderKey(forwardedHeaders.Proto)
+		host := name == http.CanonicalHeaderKey(forwardedHeaders.Host)
+		if proto || host || name == http.CanonicalHeaderKey(forwardedHeaders.Port) {
+			if i := strings.LastIndex(value, ","); i >= 0 {
+				value = value[i+1:]
+			}
+			value = strings.TrimSpace(value)
+		}
+		if proto || host || caselessHeaders[name] {
+			value = strings.ToLower(value)
+		}
+		if len(values) > 1 || value != values[0] {
+			debugf("normalized inbound header %s: %q", name, values)
+		}
+		req.Header[name] = []string{value}
+	}
+}
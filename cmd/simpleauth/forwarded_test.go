@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwardedNginxPreset(t *testing.T) {
+	testConfig(t)
+	names, err := parseForwardedHeaders("nginx", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &forwardedHeaders, names)
+	buf := new(bytes.Buffer)
+	override(t, &accessLog, log.New(buf, "", 0))
+	override(t, &accessLogFormat, "text")
+
+	req := basicRequest("alice", alicePassword)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Original-Method", "POST")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	req.Header.Set("X-Original-URI", "/private/")
+	req.Header.Set("X-Forwarded-Uri", "/wrong/")
+	serve(req)
+
+	want := "192.0.2.1:1234 POST https://alice:@example.com/private/ login:false succeeded 200\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Wrong log line:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestForwardedNginxLoginPath(t *testing.T) {
+	testConfig(t)
+	override(t, &forwardedHeaders, forwardedPresets["nginx"])
+	override(t, &loginPath, "/auth/login")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Original-URI", "/auth/login?next=/")
+	if !isLoginRequest(req) {
+		t.Error("Login path in X-Original-URI not recognized")
+	}
+}
+
+func TestForwardedOverrides(t *testing.T) {
+	names, err := parseForwardedHeaders("caddy", "uri=x-original-url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names.URI != "X-Original-Url" || names.Method != "X-Forwarded-Method" || names.Port != "X-Forwarded-Port" {
+		t.Errorf("Wrong header names: %+v", names)
+	}
+
+	if _, err := parseForwardedHeaders("apache", ""); err == nil {
+		t.Error("Unknown preset accepted")
+	}
+	if _, err := parseForwardedHeaders("caddy", "path=X-Path"); err == nil {
+		t.Error("Unknown field accepted")
+	}
+}
+
+func TestForwardedURLPort(t *testing.T) {
+	testConfig(t)
+
+	for _, tc := range []struct {
+		proto, host, port, want string
+	}{
+		{"https", "example.com", "", "https://example.com/private/"},
+		{"https", "example.com", "443", "https://example.com/private/"},
+		{"http", "example.com", "80", "http://example.com/private/"},
+		{"https", "example.com", "8443", "https://example.com:8443/private/"},
+		{"http", "example.com", "443", "http://example.com:443/private/"},
+		{"https", "example.com:8443", "8443", "https://example.com:8443/private/"},
+		{"https", "[2001:db8::1]", "8443", "https://[2001:db8::1]:8443/private/"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-Proto", tc.proto)
+		req.Header.Set("X-Forwarded-Host", tc.host)
+		req.Header.Set("X-Forwarded-Port", tc.port)
+		req.Header.Set("X-Forwarded-Uri", "/private/")
+		if got := forwardedURL(req, "").String(); got != tc.want {
+			t.Errorf("%s %s port %q: got %s, want %s", tc.proto, tc.host, tc.port, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeForwardedHeaders(t *testing.T) {
+	testConfig(t)
+	override(t, &forwardedHeaders, forwardedPresets["nginx"])
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	// The client's values come first, and the proxy appends its own
+	req.Header["X-Forwarded-Proto"] = []string{"http", " http , HTTPS "}
+	req.Header["X-Forwarded-Host"] = []string{"evil.example.net", "\tExample.com "}
+	req.Header["X-Forwarded-Port"] = []string{" 443,8443 "}
+	req.Header["X-Original-Uri"] = []string{"/other/", " /Private/a,b "}
+	req.Header["X-Forwarded-For"] = []string{" 192.0.2.1, 198.51.100.1 ", "203.0.113.1 "}
+	req.Header["X-Simpleauth-Login"] = []string{"false", " TRUE "}
+	req.Header["X-Real-Ip"] = []string{"10.0.0.5", "192.0.2.7"}
+	req.Header["X-Simpleauth-Required-Groups"] = []string{"admin ", " dev"}
+	req.Header["Authorization"] = []string{" Basic x ", "Basic y"}
+	normalizeForwardedHeaders(req)
+
+	for name, want := range map[string]string{
+		"X-Forwarded-Proto":            "https",
+		"X-Forwarded-Host":             "example.com",
+		"X-Forwarded-Port":             "8443",
+		"X-Original-Uri":               "/Private/a,b",
+		"X-Forwarded-For":              "192.0.2.1, 198.51.100.1, 203.0.113.1",
+		"X-Simpleauth-Login":           "true",
+		"X-Simpleauth-Required-Groups": "dev",
+		"X-Real-Ip":                    "192.0.2.7",
+	} {
+		if got := req.Header.Values(name); len(got) != 1 || got[0] != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if got := req.Header.Values("Authorization"); len(got) != 2 {
+		t.Errorf("Normalized a header that isn't forwarded: %q", got)
+	}
+	if got := forwardedURL(req, "").String(); got != "https://example.com:8443/Private/a,b" {
+		t.Errorf("Wrong URL: %s", got)
+	}
+	if !isLoginRequest(req) {
+		t.Error("Padded X-Simpleauth-Login not taken as a login")
+	}
+}
+
+func TestRawForwardedHeaders(t *testing.T) {
+	testConfig(t)
+	override(t, &rawForwardedHeaders, true)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header["X-Forwarded-Host"] = []string{"evil.example.net", " Example.com "}
+	normalizeForwardedHeaders(req)
+	if got := req.Header.Values("X-Forwarded-Host"); len(got) != 2 || got[1] != " Example.com " {
+		t.Errorf("Headers changed: %q", got)
+	}
+}
+
+func TestNormalizedHeadersLogin(t *testing.T) {
+	testConfig(t)
+	override(t, &trustedHeaders, map[string]bool{"X-Simpleauth-Login": true, "X-Simpleauth-Domain": true})
+
+	// Some proxies repeat headers that are also set upstream, or that the client sent
+	req := loginRequest()
+	req.Header["X-Simpleauth-Login"] = []string{" true", "true"}
+	req.Header["X-Simpleauth-Domain"] = []string{"evil.example.net", " Example.com "}
+	w := serve(req)
+	if w.Code != loginSuccessCode {
+		t.Fatalf("Login returned %d", w.Code)
+	}
+	cookie := w.Header().Get("Set-Cookie")
+	if !strings.Contains(cookie, "Domain=example.com") {
+		t.Errorf("Cookie has the wrong domain: %s", cookie)
+	}
+}
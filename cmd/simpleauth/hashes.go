@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// errHashMismatch means the password doesn't match the hash
+var errHashMismatch = errors.New("hashed value is not the hash of the given password")
+
+// verifyHash checks password against a hash, picking the algorithm by the hash's prefix.
+//
+// Besides SHA256-crypt ($5$), which the crypt utility generates,
+// this verifies PBKDF2 ($pbkdf2-sha256$) and scrypt ($scrypt$) hashes
+// in the formats used by Python's passlib,
+// and bcrypt ($2a$, $2b$, $2y$) hashes from htpasswd and PHP's password_hash,
+// for importing users from elsewhere.
+func verifyHash(hash string, password []byte) error {
+	switch {
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		return verifyPBKDF2(hash, password)
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return verifyScrypt(hash, password)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return verifyBcrypt(hash, password)
+	}
+	return crypt.SHA256.New().Verify(hash, password)
+}
+
+// verifyBcrypt checks a bcrypt hash.
+// PHP writes $2y$, which is the same algorithm as $2a$ under another name.
+func verifyBcrypt(hash string, password []byte) error {
+	if strings.HasPrefix(hash, "$2y$") {
+		hash = "$2a$" + hash[len("$2y$"):]
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return errHashMismatch
+	}
+	return err
+}
+
+// decodeHashBase64 decodes unpadded base64, as passlib writes it.
+// passlib's PBKDF2 hashes use '.' instead of '+'.
+func decodeHashBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.ReplaceAll(s, ".", "+"))
+}
+
+// compareHash returns nil if derived matches want
+func compareHash(derived, want []byte) error {
+	if subtle.ConstantTimeCompare(derived, want) != 1 {
+		return errHashMismatch
+	}
+	return nil
+}
+
+// verifyPBKDF2 checks a "$pbkdf2-sha256$rounds$salt$checksum" hash
+func verifyPBKDF2(hash string, password []byte) error {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 {
+		return fmt.Errorf("invalid pbkdf2-sha256 hash")
+	}
+	rounds, err := strconv.Atoi(fields[2])
+	if err != nil || rounds < 1 {
+		return fmt.Errorf("invalid pbkdf2-sha256 rounds %q", fields[2])
+	}
+	salt, err := decodeHashBase64(fields[3])
+	if err != nil {
+		return fmt.Errorf("invalid pbkdf2-sha256 salt: %w", err)
+	}
+	want, err := decodeHashBase64(fields[4])
+	if err != nil || len(want) == 0 {
+		return fmt.Errorf("invalid pbkdf2-sha256 checksum")
+	}
+	return compareHash(pbkdf2.Key(password, salt, rounds, len(want), sha256.New), want)
+}
+
+// verifyScrypt checks a "$scrypt$ln=N,r=R,p=P$salt$checksum" hash, where the cost is 2^ln
+func verifyScrypt(hash string, password []byte) error {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 {
+		return fmt.Errorf("invalid scrypt hash")
+	}
+	params := map[string]int{}
+	for _, param := range strings.Split(fields[2], ",") {
+		key, value, _ := strings.Cut(param, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid scrypt parameter %q", param)
+		}
+		params[key] = n
+	}
+	ln, r, p := params["ln"], params["r"], params["p"]
+	if ln < 1 || ln > 30 || r < 1 || p < 1 {
+		return fmt.Errorf("invalid scrypt parameters %q", fields[2])
+	}
+	salt, err := decodeHashBase64(fields[3])
+	if err != nil {
+		return fmt.Errorf("invalid scrypt salt: %w", err)
+	}
+	want, err := decodeHashBase64(fields[4])
+	if err != nil || len(want) == 0 {
+		return fmt.Errorf("invalid scrypt checksum")
+	}
+	derived, err := scrypt.Key(password, salt, 1<<ln, r, p, len(want))
+	if err != nil {
+		return err
+	}
+	return compareHash(derived, want)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// These vectors were generated with Python's hashlib.pbkdf2_hmac and hashlib.scrypt
+const (
+	vectorPassword = "correct horse battery staple"
+	vectorPBKDF2   = "$pbkdf2-sha256$29000$c2ltcGxlYXV0aC1zYWx0IQ$yubjtUATET01hiaBb.5Flmgg39uLoxtWHD7.63YMZ/Y"
+	vectorScrypt   = "$scrypt$ln=10,r=8,p=1$c2ltcGxlYXV0aC1zYWx0IQ$UFQt+1W/Ww+j4gA+mP48gPwYOsOA+lFluYmAHX2zyTQ"
+)
+
+func TestVerifyHash(t *testing.T) {
+	cases := []struct {
+		name, hash string
+	}{
+		{"pbkdf2-sha256", vectorPBKDF2},
+		{"scrypt", vectorScrypt},
+		{"sha256-crypt", hashPassword(t, vectorPassword)},
+	}
+	for _, c := range cases {
+		if err := verifyHash(c.hash, []byte(vectorPassword)); err != nil {
+			t.Errorf("%s: right password rejected: %v", c.name, err)
+		}
+		if err := verifyHash(c.hash, []byte("wrong")); err == nil {
+			t.Errorf("%s: wrong password accepted", c.name)
+		}
+	}
+}
+
+func TestVerifyHashMalformed(t *testing.T) {
+	for _, hash := range []string{
+		"$pbkdf2-sha256$many$c2FsdA$c2FsdA",
+		"$pbkdf2-sha256$1000$c2FsdA",
+		"$scrypt$ln=99,r=8,p=1$c2FsdA$c2FsdA",
+		"$scrypt$ln=10,r=8,p=1$c2FsdA$",
+	} {
+		if err := verifyHash(hash, []byte(vectorPassword)); err == nil {
+			t.Errorf("Malformed hash %q accepted", hash)
+		}
+	}
+}
+
+func TestImportedHashLogin(t *testing.T) {
+	testConfig(t)
+	override(t, &cryptedPasswords, map[string]string{
+		"pat": vectorPBKDF2,
+		"sam": vectorScrypt,
+	})
+
+	for _, username := range []string{"pat", "sam"} {
+		if w := serve(basicRequest(username, vectorPassword)); w.Code != http.StatusOK {
+			t.Errorf("%s returned %d", username, w.Code)
+		}
+	}
+}
+
+// The example from PHP's password_verify documentation
+const (
+	phpPassword = "rasmuslerdorf"
+	phpBcrypt   = "$2y$10$.vGA1O9wmRjrwAVXD98HNOgsNpDczlqm3Jq7KnEd1rVAGv3Fykk1a"
+)
+
+func TestVerifyPHPBcrypt(t *testing.T) {
+	if err := verifyHash(phpBcrypt, []byte(phpPassword)); err != nil {
+		t.Errorf("Right password rejected: %v", err)
+	}
+	if err := verifyHash(phpBcrypt, []byte("wrong")); err != errHashMismatch {
+		t.Errorf("Wrong password: %v", err)
+	}
+	// The same hash, as written by other bcrypt implementations
+	for _, prefix := range []string{"$2a$", "$2b$"} {
+		if err := verifyHash(prefix+phpBcrypt[4:], []byte(phpPassword)); err != nil {
+			t.Errorf("%s: right password rejected: %v", prefix, err)
+		}
+	}
+
+	testConfig(t)
+	override(t, &cryptedPasswords, map[string]string{"rasmus": phpBcrypt})
+	if w := serve(basicRequest("rasmus", phpPassword)); w.Code != http.StatusOK {
+		t.Errorf("Login with a PHP hash returned %d", w.Code)
+	}
+}
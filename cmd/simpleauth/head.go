@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// headRequests says how rootHandler answers HEAD requests:
+// "get" answers as it would GET, with the same status and headers, but no body;
+// "reject" answers 405 Method Not Allowed.
+var headRequests = "get"
+
+// parseHeadRequests checks a headRequests setting
+func parseHeadRequests(s string) (string, error) {
+	switch s {
+	case "get", "reject":
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown HEAD request handling %q, expected get or reject", s)
+}
+
+// headResponseWriter drops the body of a response to HEAD, keeping its status and headers
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
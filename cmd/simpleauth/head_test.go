@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+	"git.woozle.org/neale/simpleauth/web"
+)
+
+func TestHeadRequest(t *testing.T) {
+	testConfig(t)
+	if err := setLoginHtml(web.LoginHTML); err != nil {
+		t.Fatal(err)
+	}
+
+	get := serve(httptest.NewRequest(http.MethodGet, "/", nil))
+	head := serve(httptest.NewRequest(http.MethodHead, "/", nil))
+	if head.Code != http.StatusUnauthorized || head.Code != get.Code {
+		t.Errorf("HEAD returned %d, GET returned %d", head.Code, get.Code)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD returned a body: %q", head.Body.String())
+	}
+	for _, name := range []string{"Content-Type", "X-Simpleauth-Authentication", "Cache-Control"} {
+		if got, want := head.Header().Get(name), get.Header().Get(name); got != want {
+			t.Errorf("HEAD %s is %q, GET has %q", name, got, want)
+		}
+	}
+
+	req := requestWithToken(token.New(secret, "alice", time.Now().Add(time.Hour)))
+	req.Method = http.MethodHead
+	w := serve(req)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Authenticated HEAD returned %d with %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Simpleauth-Username") != "alice" {
+		t.Error("Authenticated HEAD has no identity headers")
+	}
+
+	override(t, &authPaths, []string{"/auth/"})
+	w = serve(httptest.NewRequest(http.MethodHead, "/elsewhere", nil))
+	if w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+		t.Errorf("HEAD outside the auth paths returned %d with %q", w.Code, w.Body.String())
+	}
+}
+
+func TestHeadRequestReject(t *testing.T) {
+	testConfig(t)
+	override(t, &headRequests, "reject")
+
+	w := serve(httptest.NewRequest(http.MethodHead, "/", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Body.Len() != 0 {
+		t.Errorf("Rejected HEAD returned %d with %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Allow") == "" {
+		t.Error("No Allow header")
+	}
+	if _, err := parseHeadRequests("ignore"); err == nil {
+		t.Error("Unknown HEAD handling accepted")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/web"
+)
+
+// loginTemplate is the parsed login page
+var loginTemplate *template.Template
+
+// loginTemplateLock guards loginTemplate, which may be refreshed in the background
+var loginTemplateLock sync.RWMutex
+
+// htmlFetchTimeout bounds how long we wait for a remote login page
+const htmlFetchTimeout = 10 * time.Second
+
+// loginPage is the data available to the login page template
+type loginPage struct {
+	// LoginPath is where the login form sends credentials; empty means the current page
+	LoginPath string
+	// Banner is a notice shown to everyone on the login page
+	Banner string
+	// Remember is true if users may ask to stay logged in
+	Remember bool
+	// Nonce goes in script and style tags, to satisfy the Content-Security-Policy
+	Nonce string
+	// LoginSuccessCode is the status returned for a successful login
+	LoginSuccessCode int
+	// TOTP is true if users may be asked for an authenticator code
+	TOTP bool
+	// CSRFToken, if set, goes back in the forward-auth-csrf form field, or the X-Csrf-Token header
+	CSRFToken string
+	// Title, LogoURL, and Color brand the page: see brandTitle
+	Title   string
+	LogoURL string
+	Color   string
+}
+
+// brandTitle, brandLogoURL, and brandColor brand the built-in login page,
+// for deployments that don't want to maintain their own:
+// the page's title and heading, an image shown above it ("" for none), and its background color.
+var (
+	brandTitle   = "Login"
+	brandLogoURL string
+	brandColor   = "seagreen"
+)
+
+// brandColorRE matches the CSS colors brandColor may be: a name or a hex color.
+// html/template won't put functions like rgb() in a style sheet.
+var brandColorRE = regexp.MustCompile(`^(#([0-9a-fA-F]{3,4}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})|[a-zA-Z]+)$`)
+
+// checkBranding returns an error if the branding settings can't go in the page
+func checkBranding() error {
+	if !brandColorRE.MatchString(brandColor) {
+		return fmt.Errorf("invalid brand color %q, expected a CSS color like seagreen or #2e8b57", brandColor)
+	}
+	if brandLogoURL != "" && !isHtmlURL(brandLogoURL) && !strings.HasPrefix(brandLogoURL, "/") {
+		return fmt.Errorf("invalid brand logo URL %q, expected http(s) or a path starting with /", brandLogoURL)
+	}
+	return nil
+}
+
+// banner is the current login page notice, guarded by loginTemplateLock
+var banner string
+
+// currentBanner returns the login page notice
+func currentBanner() string {
+	loginTemplateLock.RLock()
+	defer loginTemplateLock.RUnlock()
+	return banner
+}
+
+// setBanner replaces the login page notice
+func setBanner(text string) {
+	loginTemplateLock.Lock()
+	defer loginTemplateLock.Unlock()
+	banner = text
+}
+
+// loadBanner returns the login page notice, from a file if one is given, otherwise from text
+func loadBanner(bannerPath, text string) (string, error) {
+	if bannerPath == "" {
+		return text, nil
+	}
+	b, err := os.ReadFile(bannerPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// currentLoginTemplate returns the login page template currently in use
+func currentLoginTemplate() *template.Template {
+	loginTemplateLock.RLock()
+	defer loginTemplateLock.RUnlock()
+	return loginTemplate
+}
+
+// parseLoginHtml parses a login page template.
+//
+// Only pages that use template fields, with "{{.", are templates.
+// Anything else, like a page written before login pages were templates, is served as it is,
+// and so is a page that doesn't parse, with a warning, rather than refusing to start.
+func parseLoginHtml(html []byte) (*template.Template, error) {
+	if !bytes.Contains(html, []byte("{{.")) {
+		return rawLoginHtml(html)
+	}
+	tmpl, err := template.New("login.html").Parse(string(html))
+	if err != nil {
+		log.Printf("Warning: login page isn't a valid template, serving it as it is: %v", err)
+		return rawLoginHtml(html)
+	}
+	return tmpl, nil
+}
+
+// rawLoginHtml returns a template that renders html exactly as it is
+func rawLoginHtml(html []byte) (*template.Template, error) {
+	page := template.HTML(html)
+	return template.New("login.html").Funcs(template.FuncMap{
+		"page": func() template.HTML { return page },
+	}).Parse("{{page}}")
+}
+
+// setLoginHtml parses and replaces the login page
+func setLoginHtml(html []byte) error {
+	tmpl, err := parseLoginHtml(html)
+	if err != nil {
+		return err
+	}
+	loginTemplateLock.Lock()
+	defer loginTemplateLock.Unlock()
+	loginTemplate = tmpl
+	return nil
+}
+
+// renderLogin renders the login page for req, with nonce for its script and style tags,
+// and csrfToken for it to send back.
+// The forwarded host's own page is used, if it has one.
+func renderLogin(req *http.Request, nonce, csrfToken string) ([]byte, error) {
+	tmpl := hostTheme(forwardedHost(req))
+	if tmpl == nil {
+		tmpl = currentLoginTemplate()
+	}
+	if tmpl == nil {
+		return nil, fmt.Errorf("no login page loaded")
+	}
+	return renderPage(tmpl, req, nonce, csrfToken)
+}
+
+// renderPage renders a page template for req, with nonce for its script and style tags,
+// and csrfToken for it to send back
+func renderPage(tmpl *template.Template, req *http.Request, nonce, csrfToken string) ([]byte, error) {
+	page := loginPage{
+		LoginPath:        loginPath,
+		Banner:           currentBanner(),
+		Remember:         rememberLifespan > 0,
+		Nonce:            nonce,
+		LoginSuccessCode: loginSuccessCode,
+		TOTP:             totpEnabled(),
+		CSRFToken:        csrfToken,
+		Title:            brandTitle,
+		LogoURL:          brandLogoURL,
+		Color:            brandColor,
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, page); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// successTemplate, if set, is shown instead of the login page after a successful login.
+// It's guarded by configLock.
+var successTemplate *template.Template
+
+// currentSuccessTemplate returns the login success page, or nil if there isn't one
+func currentSuccessTemplate() *template.Template {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return successTemplate
+}
+
+// successRedirect, if set, is where the login page sends the browser after a successful login
+var successRedirect string
+
+// loadSuccessHtml reads and parses the login success page
+func loadSuccessHtml(successPath string) (*template.Template, error) {
+	html, err := os.ReadFile(successPath)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("success.html").Parse(string(html))
+}
+
+// isHtmlURL returns true if htmlPath is an http(s) URL rather than a directory
+func isHtmlURL(htmlPath string) bool {
+	return strings.HasPrefix(htmlPath, "http://") || strings.HasPrefix(htmlPath, "https://")
+}
+
+// fetchHtml retrieves a login page from an http(s) URL
+func fetchHtml(htmlURL string) ([]byte, error) {
+	client := http.Client{Timeout: htmlFetchTimeout}
+	resp, err := client.Get(htmlURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", htmlURL, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, fmt.Errorf("fetching %s: empty response", htmlURL)
+	}
+	return body, nil
+}
+
+// loadLoginHtml loads login.html from a directory, or fetches it from a URL.
+// If a URL can't be fetched, the embedded default page is used instead.
+func loadLoginHtml(htmlPath string) ([]byte, error) {
+	if !isHtmlURL(htmlPath) {
+		return os.ReadFile(path.Join(htmlPath, "login.html"))
+	}
+
+	html, err := fetchHtml(htmlPath)
+	if err != nil {
+		log.Printf("Warning: %v; using built-in login page", err)
+		return web.LoginHTML, nil
+	}
+	return html, nil
+}
+
+// refreshLoginHtml periodically re-fetches the login page from htmlURL.
+// On failure, the previously loaded page is kept.
+func refreshLoginHtml(htmlURL string, interval time.Duration) {
+	for range time.Tick(interval) {
+		html, err := fetchHtml(htmlURL)
+		if err != nil {
+			log.Printf("Warning: refreshing login page: %v; keeping previous page", err)
+			continue
+		}
+		if err := setLoginHtml(html); err != nil {
+			log.Printf("Warning: refreshed login page: %v; keeping previous page", err)
+			continue
+		}
+		debugf("refreshed login page from %s", htmlURL)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.woozle.org/neale/simpleauth/web"
+)
+
+func TestLoadLoginHtmlFromURL(t *testing.T) {
+	page := []byte("<html>branded login</html>")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(page)
+	}))
+	defer ts.Close()
+
+	html, err := loadLoginHtml(ts.URL + "/login.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(html, page) {
+		t.Errorf("Wrong page: %s", html)
+	}
+}
+
+func TestLoadLoginHtmlFallback(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	html, err := loadLoginHtml(ts.URL + "/login.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(html, web.LoginHTML) {
+		t.Error("Failed fetch didn't fall back to built-in page")
+	}
+}
+
+func TestDefaultLoginTemplate(t *testing.T) {
+	testConfig(t)
+	if err := setLoginHtml(web.LoginHTML); err != nil {
+		t.Fatal(err)
+	}
+	override(t, &loginPath, "/auth/login")
+
+	body, err := renderLogin(httptest.NewRequest(http.MethodGet, "/", nil), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte(`let loginPath = "/auth/login"`)) {
+		t.Errorf("Login path not rendered into page")
+	}
+}
+
+func TestRawLoginHtml(t *testing.T) {
+	testConfig(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// Pages that aren't templates, or can't be, are served exactly as written
+	for _, page := range []string{
+		`<html><script>let x = "a<b" && {{ vue }}</script></html>`,
+		`<html>{{.Broken</html>`,
+	} {
+		if err := setLoginHtml([]byte(page)); err != nil {
+			t.Fatalf("Page %q refused: %v", page, err)
+		}
+		body, err := renderLogin(httptest.NewRequest(http.MethodGet, "/", nil), "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != page {
+			t.Errorf("Page changed:\n got %q\nwant %q", body, page)
+		}
+	}
+	if !strings.Contains(buf.String(), "isn't a valid template") {
+		t.Errorf("No warning about the broken template: %q", buf.String())
+	}
+}
+
+func TestLoginAtPath(t *testing.T) {
+	testConfig(t)
+	override(t, &loginPath, "/auth/login")
+
+	// Without X-Simpleauth-Login, at the login path
+	req := basicRequest("alice", alicePassword)
+	req.URL.Path = "/auth/login"
+	if w := serve(req); w.Code != http.StatusTeapot || w.Header().Get("Set-Cookie") == "" {
+		t.Errorf("Login at path: got %d", w.Code)
+	}
+
+	// Forwarded to the login path
+	req = basicRequest("alice", alicePassword)
+	req.Header.Set("X-Forwarded-Uri", "/auth/login?next=/")
+	if w := serve(req); w.Code != http.StatusTeapot {
+		t.Errorf("Forwarded login at path: got %d", w.Code)
+	}
+
+	// Anywhere else is a regular forward-auth check
+	req = basicRequest("alice", alicePassword)
+	req.Header.Set("X-Forwarded-Uri", "/app/")
+	if w := serve(req); w.Code != http.StatusOK {
+		t.Errorf("Forward auth elsewhere: got %d", w.Code)
+	}
+}
+
+func TestSuccessPage(t *testing.T) {
+	testConfig(t)
+	fn := filepath.Join(t.TempDir(), "success.html")
+	if err := os.WriteFile(fn, []byte("<html>welcome back</html>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := loadSuccessHtml(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &successTemplate, tmpl)
+	override(t, &successRedirect, "https://example.com/home")
+
+	w := serve(loginRequest())
+	if w.Code != http.StatusTeapot {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if body := w.Body.String(); body != "<html>welcome back</html>" {
+		t.Errorf("Wrong body: %q", body)
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Error("No cookie set")
+	}
+	if next := w.Header().Get("X-Simpleauth-Redirect"); next != "https://example.com/home" {
+		t.Errorf("Wrong redirect: %q", next)
+	}
+
+	// Failed logins still get the login page
+	req := basicRequest("alice", "wrong")
+	req.Header.Set("X-Simpleauth-Login", "true")
+	w = serve(req)
+	if body := w.Body.String(); body != "<html>login</html>" {
+		t.Errorf("Wrong body for failed login: %q", body)
+	}
+	if w.Header().Get("X-Simpleauth-Redirect") != "" {
+		t.Error("Redirect set for failed login")
+	}
+}
+
+func TestBanner(t *testing.T) {
+	testConfig(t)
+	if err := setLoginHtml(web.LoginHTML); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "banner")
+	if err := os.WriteFile(fn, []byte("Maintenance <Saturday> 02:00 UTC\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	text, err := loadBanner(fn, "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &banner, text)
+
+	body := serve(httptest.NewRequest(http.MethodGet, "/", nil)).Body.String()
+	if !strings.Contains(body, `<div id="banner">Maintenance &lt;Saturday&gt; 02:00 UTC</div>`) {
+		t.Errorf("Banner not rendered")
+	}
+
+	banner = ""
+	body = serve(httptest.NewRequest(http.MethodGet, "/", nil)).Body.String()
+	if strings.Contains(body, `<div id="banner">`) {
+		t.Errorf("Empty banner rendered")
+	}
+}
+
+func TestBranding(t *testing.T) {
+	testConfig(t)
+	if err := setLoginHtml(web.LoginHTML); err != nil {
+		t.Fatal(err)
+	}
+	override(t, &brandTitle, "Example <Intranet>")
+	override(t, &brandLogoURL, "https://cdn.example.com/logo.png")
+	override(t, &brandColor, "#2e8b57")
+	if err := checkBranding(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := serve(httptest.NewRequest(http.MethodGet, "/", nil)).Body.String()
+	for _, want := range []string{
+		"<title>Example &lt;Intranet&gt;</title>",
+		"<h1>Example &lt;Intranet&gt;</h1>",
+		`<img id="logo" src="https://cdn.example.com/logo.png" alt="">`,
+		"background: #2e8b57 linear-gradient",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Page doesn't have %s", want)
+		}
+	}
+
+	override(t, &brandLogoURL, "")
+	body = serve(httptest.NewRequest(http.MethodGet, "/", nil)).Body.String()
+	if strings.Contains(body, `id="logo"`) {
+		t.Error("Logo rendered without a URL")
+	}
+}
+
+func TestBrandingDefault(t *testing.T) {
+	testConfig(t)
+	if err := setLoginHtml(web.LoginHTML); err != nil {
+		t.Fatal(err)
+	}
+	body := serve(httptest.NewRequest(http.MethodGet, "/", nil)).Body.String()
+	if !strings.Contains(body, "<h1>Login</h1>") || !strings.Contains(body, "background: seagreen linear-gradient") {
+		t.Error("Default branding changed")
+	}
+}
+
+func TestBrandingInvalid(t *testing.T) {
+	testConfig(t)
+	for _, color := range []string{"red; background-image: url(x)", "}", "rgb(46, 139, 87)", "#12", ""} {
+		override(t, &brandColor, color)
+		if err := checkBranding(); err == nil {
+			t.Errorf("Accepted color %q", color)
+		}
+	}
+	override(t, &brandColor, "DarkSlateBlue")
+	if err := checkBranding(); err != nil {
+		t.Errorf("Rejected named color: %v", err)
+	}
+	override(t, &brandLogoURL, "javascript:alert(1)")
+	if err := checkBranding(); err == nil {
+		t.Error("Accepted javascript: logo URL")
+	}
+}
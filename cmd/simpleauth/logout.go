@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// logoutRedirect is where /logout sends people, unless the request asks for somewhere allowed.
+// Empty means to just say they're logged out.
+var logoutRedirect string
+
+// logoutRedirectHosts are the hosts a logout may ask to be sent to, besides this one
+var logoutRedirectHosts []string
+
+// logoutTarget returns where to send someone after logging out, or false if the requested target isn't allowed.
+// A target may be a path on this site, or a URL on one of logoutRedirectHosts.
+func logoutTarget(req *http.Request) (string, bool) {
+	target := req.URL.Query().Get("redirect")
+	if target == "" {
+		return logoutRedirect, true
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		// Same origin
+		return target, localPath(target)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", false
+	}
+	return target, slices.Contains(logoutRedirectHosts, strings.ToLower(u.Hostname()))
+}
+
+// logoutHandler clears the auth cookie, and sends the browser on to logoutTarget
+func logoutHandler(w http.ResponseWriter, req *http.Request) {
+	stripUntrustedHeaders(req)
+	normalizeForwardedHeaders(req)
+	w.Header().Set("Cache-Control", "no-store")
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target, ok := logoutTarget(req)
+	if !ok {
+		debugf("logout redirect not allowed: %q", req.URL.Query().Get("redirect"))
+		http.Error(w, "Redirect not allowed", http.StatusBadRequest)
+		return
+	}
+
+	// A negative Max-Age tells the browser to drop the cookie now
+	setAuthCookie(w, req, "", -time.Second)
+	for _, name := range oldCookieNames {
+		cookie := newAuthCookie(req, "", -time.Second)
+		cookie.Name = name
+		http.SetCookie(w, cookie)
+	}
+
+	if target == "" {
+		http.Error(w, "Logged out", http.StatusOK)
+		return
+	}
+	http.Redirect(w, req, target, http.StatusSeeOther)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// logout requests /logout with query
+func logout(query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	logoutHandler(w, httptest.NewRequest(http.MethodGet, "/logout"+query, nil))
+	return w
+}
+
+func TestLogoutClearsCookie(t *testing.T) {
+	testConfig(t)
+	override(t, &oldCookieNames, []string{"old-token"})
+
+	w := logout("")
+	if w.Code != http.StatusOK {
+		t.Errorf("Logout returned %d", w.Code)
+	}
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("Wrong cookies: %v", w.Header()["Set-Cookie"])
+	}
+	for i, name := range []string{cookieName, "old-token"} {
+		if cookies[i].Name != name || cookies[i].Value != "" || cookies[i].MaxAge >= 0 {
+			t.Errorf("Cookie %s not cleared: %s", name, cookies[i])
+		}
+	}
+}
+
+func TestLogoutRedirect(t *testing.T) {
+	testConfig(t)
+	override(t, &logoutRedirect, "https://www.example.com/goodbye")
+	override(t, &logoutRedirectHosts, []string{"app.example.com"})
+
+	cases := []struct {
+		query, location string
+	}{
+		{"", "https://www.example.com/goodbye"},
+		{"?redirect=/login", "/login"},
+		{"?redirect=https://app.example.com/", "https://app.example.com/"},
+		{"?redirect=https://APP.example.com/", "https://APP.example.com/"},
+	}
+	for _, c := range cases {
+		w := logout(c.query)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != c.location {
+			t.Errorf("%q: got %d to %q, want %q", c.query, w.Code, w.Header().Get("Location"), c.location)
+		}
+	}
+}
+
+func TestLogoutRedirectRejected(t *testing.T) {
+	testConfig(t)
+	override(t, &logoutRedirectHosts, []string{"app.example.com"})
+
+	for _, query := range []string{
+		"?redirect=https://evil.example.net/",
+		"?redirect=//evil.example.net/",
+		"?redirect=/%5Cevil.example.net/",
+		"?redirect=javascript:alert(1)",
+		"?redirect=relative",
+	} {
+		w := logout(query)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q returned %d", query, w.Code)
+		}
+		if w.Header().Get("Set-Cookie") != "" {
+			t.Errorf("%q cleared the cookie", query)
+		}
+	}
+}
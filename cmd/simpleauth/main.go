@@ -2,29 +2,43 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"git.woozle.org/neale/simpleauth/pkg/password"
 	"git.woozle.org/neale/simpleauth/pkg/token"
-	"github.com/GehirnInc/crypt"
-	_ "github.com/GehirnInc/crypt/sha256_crypt"
 )
 
 const DefaultCookieName = "__Http-simpleauth-token"
 
 var (
-	secret    []byte
+	secret     []byte
 	cookieName string
+	// oldCookieNames are earlier names of the token cookie, still read so sessions survive a rename.
+	// Cookies are only ever set with cookieName.
+	oldCookieNames []string
+	// verifySecrets are older secrets, still accepted for tokens issued before a rotation
+	verifySecrets [][]byte
 )
 
 // getEnvWithFallback returns environment value or fallback to default
@@ -35,6 +49,51 @@ func getEnvWithFallback(key, defaultValue string) string {
 	return defaultValue
 }
 
+// durationEnv returns the duration in an environment variable, or a default
+func durationEnv(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid duration in %s: %v", key, err)
+	}
+	return d
+}
+
+// intEnv returns the integer in an environment variable, or a default
+func intEnv(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid integer in %s: %v", key, err)
+	}
+	return i
+}
+
+// floatEnv returns the number in an environment variable, or a default
+func floatEnv(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid number in %s: %v", key, err)
+	}
+	return f
+}
+
+// secretLength is how many bytes of secret are used; shorter secrets are rejected, longer ones truncated
+var secretLength = 64
+
+// minSecretLength is the shortest secretLength allowed: any less is too easy to brute-force
+const minSecretLength = 32
+
 // getSecret loads secret from environment variable or file
 func getSecret(secretPath string) ([]byte, error) {
 	// Try environment variable first
@@ -43,10 +102,10 @@ func getSecret(secretPath string) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid SIMPLEAUTH_SECRET: %w", err)
 		}
-		if len(decodedSecret) < 64 {
-			return nil, fmt.Errorf("SIMPLEAUTH_SECRET must be at least 64 bytes (got %d)", len(decodedSecret))
+		if len(decodedSecret) < secretLength {
+			return nil, fmt.Errorf("SIMPLEAUTH_SECRET must be at least %d bytes (got %d)", secretLength, len(decodedSecret))
 		}
-		return decodedSecret[:64], nil
+		return decodedSecret[:secretLength], nil
 	}
 
 	// Try to read from file
@@ -54,81 +113,350 @@ func getSecret(secretPath string) ([]byte, error) {
 		return nil, fmt.Errorf("secret not configured (no SIMPLEAUTH_SECRET env var and no file at %s): %w", secretPath, err)
 	}
 
+	return readSecretFile(secretPath)
+}
+
+// readSecretFile reads a single secret file
+func readSecretFile(secretPath string) ([]byte, error) {
 	content, err := ioutil.ReadFile(secretPath)
 	if err != nil {
 		return nil, err
 	}
-	if len(content) < 64 {
-		return nil, fmt.Errorf("secret file at %s must be at least 64 bytes (got %d)", secretPath, len(content))
+	if len(content) < secretLength {
+		return nil, fmt.Errorf("secret file at %s must be at least %d bytes (got %d)", secretPath, secretLength, len(content))
 	}
-	return content[:64], nil
+	return content[:secretLength], nil
 }
 
-// loadPasswordsFromEnv loads passwords from SIMPLEAUTH_USERS env var
-// Format: SIMPLEAUTH_USERS="user1:password1,user2:password2"
-func loadPasswordsFromEnv() (map[string]string, error) {
-	passwords := make(map[string]string)
-	users := os.Getenv("SIMPLEAUTH_USERS")
-	if users == "" {
-		return passwords, nil
+// getSecrets loads the signing secret, plus any older secrets still accepted for verification.
+//
+// If secretPath is a directory, the newest file in it is the signing secret,
+// and the rest are only used to verify tokens issued before a rotation.
+func getSecrets(secretPath string) ([]byte, [][]byte, error) {
+	if os.Getenv("SIMPLEAUTH_SECRET") != "" {
+		primary, err := getSecret(secretPath)
+		return primary, nil, err
+	}
+	if info, err := os.Stat(secretPath); err != nil || !info.IsDir() {
+		primary, err := getSecret(secretPath)
+		return primary, nil, err
+	}
+
+	entries, err := os.ReadDir(secretPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	type secretFile struct {
+		path    string
+		modTime time.Time
+	}
+	files := []secretFile{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		files = append(files, secretFile{path.Join(secretPath, entry.Name()), info.ModTime()})
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("secret directory %s contains no secret files", secretPath)
 	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
 
-	pairs := strings.Split(users, ",")
-	for _, pair := range pairs {
-		parts := strings.SplitN(pair, ":", 2)
-		if len(parts) != 2 {
-			log.Printf("Warning: invalid user format '%s', expected 'username:password'", pair)
+	primary, err := readSecretFile(files[0].path)
+	if err != nil {
+		return nil, nil, err
+	}
+	older := [][]byte{}
+	for _, file := range files[1:] {
+		content, err := readSecretFile(file.path)
+		if err != nil {
+			log.Printf("Warning: ignoring old secret: %v", err)
 			continue
 		}
-		username := strings.ToLower(strings.TrimSpace(parts[0]))
-		hash := strings.TrimSpace(parts[1])
-		passwords[username] = hash
+		older = append(older, content)
+	}
+	return primary, older, nil
+}
+
+// errTokenTooLong means a token was issued for longer than the current max lifespan
+var errTokenTooLong = errors.New("token expires after max lifespan")
+
+// checkToken returns nil if t is valid, and within the current lifespan cap,
+// or an error saying why not
+func checkToken(t token.T) error {
+	if err := verifyToken(t); err != nil {
+		return err
+	}
+	if maxLifespan > 0 && !t.ExpiresWithin(maxLifespan) {
+		// Issued before the cap was lowered
+		return fmt.Errorf("%w (%v)", errTokenTooLong, maxLifespan)
+	}
+	if err := checkRevoked(t); err != nil {
+		return err
+	}
+	return checkAudience(t.Audience)
+}
+
+// tokenRoundTrip issues a token and checks it, the way a login and the next request would.
+// It catches a secret that loads, but can't validate what it signs.
+func tokenRoundTrip() error {
+	secret, _ := currentSecrets()
+	if len(secret) < minSecretLength {
+		return fmt.Errorf("signing secret is %d bytes, need at least %d", len(secret), minSecretLength)
+	}
+	now := time.Now()
+	issued := token.T{
+		Username:   "simpleauth-self-test",
+		Expiration: now.Add(clampLifespan(time.Minute)),
+		IssuedAt:   &now,
+		Audience:   issuedAudiences(),
+	}.Sign(secret)
+	t, err := token.ParseString(issued.String())
+	if err != nil {
+		return err
+	}
+	return checkToken(t)
+}
+
+// devMode allows running without a configured secret, for local testing
+var devMode bool
+
+// loadSecrets loads the secrets, like getSecrets.
+// In dev mode, if there's no secret, it makes up a random one, which won't outlive this process.
+func loadSecrets(secretPath string) ([]byte, [][]byte, error) {
+	primary, older, err := getSecrets(secretPath)
+	if err == nil || !devMode {
+		return primary, older, err
+	}
+
+	primary = make([]byte, secretLength)
+	if _, err := rand.Read(primary); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("WARNING: DEV MODE: no secret configured (%v)", err)
+	log.Printf("WARNING: DEV MODE: using a random secret: logins will not survive a restart")
+	log.Printf("WARNING: DEV MODE: do not use -dev in production")
+	return primary, nil, nil
+}
+
+// verifyToken returns nil if t was signed by the current secret or a previous one,
+// including one replaced by a reload within the grace period, and is in date.
+// Otherwise it returns the token package's reason.
+func verifyToken(t token.T) error {
+	secret, verifySecrets := currentSecrets()
+	secrets := append([][]byte{secret}, verifySecrets...)
+	secrets = append(secrets, graceSecrets()...)
+	err := token.ErrBadSignature
+	for _, s := range secrets {
+		switch e := t.Check(s); {
+		case e == nil:
+			return nil
+		case !errors.Is(e, token.ErrBadSignature):
+			// Signed by this secret, but out of date
+			err = e
+		}
+	}
+	return err
+}
+
+// passwdSeparator separates the username from the hash in the password file
+var passwdSeparator = ":"
+
+// parseSeparator interprets a separator setting, allowing "tab" and "\t" for tab
+func parseSeparator(sep string) string {
+	switch sep {
+	case "tab", `\t`:
+		return "\t"
+	}
+	return sep
+}
+
+// parseUserLine splits a "username:hash" line on the first separator,
+// so hashes may themselves contain the separator.
+func parseUserLine(line, sep string) (username, hash string, ok bool) {
+	parts := strings.SplitN(line, sep, 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	username = strings.ToLower(strings.TrimSpace(parts[0]))
+	hash = strings.TrimSpace(parts[1])
+	if username == "" || hash == "" {
+		return "", "", false
 	}
-	return passwords, nil
+	return username, hash, true
 }
 
-// getPasswords loads passwords from file or environment variable
+// strictUsers makes malformed user entries a fatal error, rather than a warning
+var strictUsers bool
+
+// entryUsername returns the username of a malformed entry split on sep, for malformedUser.
+// Without a sep, it returns "": the entry might be nothing but a password someone forgot to hash.
+func entryUsername(entry, sep string) string {
+	username, _, found := strings.Cut(entry, sep)
+	if !found {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// malformedUser reports a user entry that couldn't be parsed.
+// username is as much of the entry as is safe to log, or "" to give only where it is.
+// It returns an error in strict mode; otherwise it logs a warning and returns nil.
+func malformedUser(where, username string) error {
+	what := "invalid user format"
+	if username != "" {
+		what = fmt.Sprintf("invalid user format for %q", logName(username))
+	}
+	if strictUsers {
+		return fmt.Errorf("%s: %s, expected 'username:hash'", where, what)
+	}
+	log.Printf("Warning: %s: %s, expected 'username:hash'; skipping", where, what)
+	return nil
+}
+
+// duplicateUser reports a username that appears more than once.
+// The last entry wins, unless we're in strict mode, where it's an error.
+func duplicateUser(where, username string, first, again int) error {
+	if strictUsers {
+		return fmt.Errorf("%s %d and %d: duplicate username %q", where, first, again, logName(username))
+	}
+	log.Printf("Warning: %s %d and %d: duplicate username %q; using the last one", where, first, again, logName(username))
+	return nil
+}
+
+// usersPolicy says what to do when both users in the environment and the password file are present:
+// "override" uses only the environment, "merge" uses both, with the environment winning for overlapping users.
+var usersPolicy = "override"
+
+// getPasswords loads passwords from file or environment variable, according to usersPolicy.
+// usersEnv is the environment variable users are in, from usersEnvVar.
 func getPasswords(passwordPath string, usersEnv string) (map[string]string, error) {
-	// If environment variable is set, use it
-	if usersEnv != "" {
-		passwords, err := loadPasswordsFromEnv()
+	if usersEnv == "" {
+		passwords, err := loadPasswordsFromFile(passwordPath)
 		if err != nil {
 			return nil, err
 		}
+		log.Printf("Users: %d from %s", len(passwords), passwordPath)
 		return passwords, nil
 	}
 
-	// Otherwise use password file
-	if _, err := os.Stat(passwordPath); err != nil {
+	passwords, err := loadPasswordsFromEnv()
+	if err != nil {
 		return nil, err
 	}
 
+	switch usersPolicy {
+	case "override":
+		log.Printf("Users: %d from %s (ignoring %s)", len(passwords), usersEnv, passwordPath)
+		return passwords, nil
+	case "merge":
+		filePasswords, err := loadPasswordsFromFile(passwordPath)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("Users: %d from %s (no %s to merge)", len(passwords), usersEnv, passwordPath)
+			return passwords, nil
+		} else if err != nil {
+			return nil, err
+		}
+		envCount := len(passwords)
+		overlap := 0
+		for username, hash := range filePasswords {
+			if _, ok := passwords[username]; ok {
+				overlap += 1
+				continue
+			}
+			passwords[username] = hash
+		}
+		log.Printf("Users: %d from %s, %d from %s, %d in both (%s wins)",
+			envCount, usersEnv, len(filePasswords), passwordPath, overlap, usersEnv)
+		return passwords, nil
+	}
+	return nil, fmt.Errorf("unknown users policy %q, expected override or merge", usersPolicy)
+}
+
+// loadPasswordsFromFile loads passwords from a password file
+func loadPasswordsFromFile(passwordPath string) (map[string]string, error) {
 	f, err := os.Open(passwordPath)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
+	return readPasswords(passwordPath, f)
+}
+
+// readPasswords reads users in password file format from f.
+// where says where they came from, for error messages.
+func readPasswords(where string, f io.Reader) (map[string]string, error) {
+	r, err := passwordFileReader(where, f)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(r)
 	passwords := make(map[string]string)
+	seen := make(map[string]int)
+	lineno := 0
 	for scanner.Scan() {
+		lineno += 1
 		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if len(parts) >= 2 {
-			username := strings.ToLower(parts[0])
-			hash := parts[1]
-			passwords[username] = hash
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		username, hash, ok := parseUserLine(line, passwdSeparator)
+		if !ok {
+			if err := malformedUser(fmt.Sprintf("%s:%d", where, lineno), entryUsername(line, passwdSeparator)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if _, attrs := splitUserEntry(hash); attrs["totp"] != "" && !validTOTPSecret(attrs["totp"]) {
+			return nil, fmt.Errorf("%s:%d: invalid TOTP secret for %q, expected base32", where, lineno, logName(username))
+		}
+		key := userKey(username)
+		if first, dup := seen[key]; dup {
+			if err := duplicateUser(where+" lines", username, first, lineno); err != nil {
+				return nil, err
+			}
+		} else {
+			seen[key] = lineno
 		}
+		passwords[key] = hash
 	}
 	return passwords, scanner.Err()
 }
 
 var startTime = time.Now()
 var lifespan time.Duration
+var maxLifespan time.Duration
 var cryptedPasswords map[string]string
-var loginHtml []byte
+var loginPath string
+var loginDelay time.Duration
+var cookiePartitioned bool
+var sessionCookie bool
+var loginThrottle *usernameThrottle
 var verbose bool
 
+// loginSuccessCode is the status for a successful login, which carries the new cookie.
+// It's 418 by default, since Caddy passes that back to the client, and nothing else uses it.
+var loginSuccessCode = http.StatusTeapot
+
+// loginFailureCodes are statuses the login page takes to mean the login failed
+var loginFailureCodes = map[int]bool{
+	http.StatusUnauthorized:        true,
+	http.StatusForbidden:           true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusServiceUnavailable:  true,
+}
+
+// successCode is the status for a successful forward-auth request: 200, or 204 for proxies that would rather not buffer a body
+var successCode = http.StatusOK
+
 func debugln(v ...any) {
 	if verbose {
 		log.Println(v...)
@@ -141,177 +469,820 @@ func debugf(fmt string, v ...any) {
 	}
 }
 
-func authenticationValid(username, password string) bool {
-	c := crypt.SHA256.New()
-	if crypted, ok := cryptedPasswords[username]; ok {
-		debugf("verifying password for username:%v", username)
-		if err := c.Verify(crypted, []byte(password)); err == nil {
-			debugf("password verification succeeded for username:%v", username)
-			return true
-		} else {
-			debugf("password verification failed for username:%v error:%v", username, err)
-			if strings.Contains(err.Error(), "invalid salt") {
-				debugf("INVALID SALT FORMAT: This usually means dollar signs in hash were not wrapped in single quotes in the environment variable")
+// trimPasswords removes leading and trailing whitespace from submitted passwords,
+// for forms and password managers that add some.
+// Passwords that really do start or end with whitespace can't log in with it on.
+var trimPasswords bool
+
+// authenticationValid returns true if a backend accepts the credentials, recording metrics about it.
+// Otherwise it returns why they were refused, if a backend said, for loginFailureDetail.
+func authenticationValid(ctx context.Context, username, password string) (bool, error) {
+	if trimPasswords {
+		password = strings.TrimSpace(password)
+	}
+	if !userAllowed(username) {
+		debugf("username:%v is not on the allowlist", logName(username))
+		statsd.incr("auth.failure")
+		return false, nil
+	}
+	start := time.Now()
+	valid, reason := tryBackends(ctx, username, password)
+	statsd.timing("auth.latency", time.Since(start))
+	if valid {
+		statsd.incr("auth.success")
+	} else {
+		statsd.incr("auth.failure")
+	}
+	return valid, reason
+}
+
+// tryBackends tries each backend in order, stopping at the first that accepts the credentials.
+// If none does, it returns the first reason a backend gave for refusing them.
+func tryBackends(ctx context.Context, username, password string) (bool, error) {
+	var reason error
+	var errs []error
+	for _, b := range backends {
+		start := time.Now()
+		ok, err := authenticateWithTimeout(ctx, b, username, password)
+		if elapsed := time.Since(start); slowAuthThreshold > 0 && elapsed > slowAuthThreshold {
+			log.Printf("Warning: slow authentication: backend %s took %v for username:%v", b.Name(), elapsed.Round(time.Millisecond), logName(username))
+		}
+		var refused credentialsRefused
+		if errors.As(err, &refused) {
+			if reason == nil {
+				reason = refused.reason
 			}
+			continue
 		}
-	} else {
-		debugf("no hash found for username:%v", username)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+			continue
+		}
+		if ok {
+			debugf("backend %s accepted username:%v", b.Name(), logName(username))
+			return true, nil
+		}
+	}
+	if len(errs) > 0 {
+		log.Printf("authentication errors for username:%v: %v", logName(username), errors.Join(errs...))
+	}
+	return false, reason
+}
+
+// clampLifespan limits a requested token lifespan to maxLifespan, if one is set
+func clampLifespan(requested time.Duration) time.Duration {
+	if maxLifespan > 0 && requested > maxLifespan {
+		debugf("clamping lifespan %v to maximum %v", requested, maxLifespan)
+		return maxLifespan
+	}
+	return requested
+}
+
+// omitCookieAttributes are security attributes left off the auth cookie, for proxies that mishandle them
+var omitCookieAttributes = map[string]bool{}
+
+// omittableCookieAttributes are the attributes that may be omitted, with why that's risky
+var omittableCookieAttributes = map[string]string{
+	"HttpOnly": "scripts on the page can read the auth token",
+	"SameSite": "other sites can make authenticated requests (CSRF)",
+}
+
+// parseCookieOmit parses a comma-separated list of cookie attributes to omit,
+// warning about each one, since they weaken the cookie.
+func parseCookieOmit(s string) (map[string]bool, error) {
+	omit := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for attr, risk := range omittableCookieAttributes {
+			if strings.EqualFold(name, attr) {
+				log.Printf("Warning: omitting %s from the auth cookie: %s", attr, risk)
+				omit[attr] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("can't omit cookie attribute %q: only HttpOnly and SameSite may be omitted", name)
+		}
+	}
+	return omit, nil
+}
+
+// newAuthCookie returns the cookie carrying an auth token.
+// A zero maxAge makes a session cookie, which the browser drops when it closes.
+func newAuthCookie(req *http.Request, value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieName,
+		Value:    value,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: !omitCookieAttributes["HttpOnly"],
+		SameSite: sameSiteMode(req),
+		MaxAge:   int(maxAge.Seconds()),
+		Domain:   cookieDomain(req),
+	}
+}
+
+// authCookie builds the Set-Cookie header value carrying an auth token
+func authCookie(req *http.Request, value string, maxAge time.Duration) string {
+	cookieValue := newAuthCookie(req, value, maxAge).String()
+
+	// CHIPS: keyed to the top-level site, for use in embedded iframes.
+	// Go's http.Cookie can't emit this until Go 1.23, so it's added by hand.
+	if cookiePartitioned {
+		cookieValue += "; Partitioned"
+	}
+
+	return cookieValue
+}
+
+// setAuthCookie adds a Set-Cookie header carrying an auth token to w
+func setAuthCookie(w http.ResponseWriter, req *http.Request, value string, maxAge time.Duration) {
+	if !cookiePartitioned {
+		http.SetCookie(w, newAuthCookie(req, value, maxAge))
+		return
 	}
-	return false
+	w.Header().Add("Set-Cookie", authCookie(req, value, maxAge))
 }
 
+// usernameIfAuthenticated returns the authenticated username, or "" if there isn't one.
+// Users left off the allowlist aren't authenticated, however they got here.
 func usernameIfAuthenticated(req *http.Request) string {
+	username, _, _ := authenticateRequest(req)
+	return username
+}
+
+// authenticateRequest returns the authenticated username, or "" if there isn't one,
+// and when they last presented credentials.
+// If Basic credentials were refused, it also returns why, if a backend said.
+func authenticateRequest(req *http.Request) (string, time.Time, error) {
+	username, at, refused := authenticatedUsername(req)
+	if username == "" {
+		return "", time.Time{}, refused
+	}
+	if !userAllowed(username) {
+		debugf("username:%v is not on the allowlist", logName(username))
+		return "", time.Time{}, nil
+	}
+	return username, at, nil
+}
+
+// authenticatedUsername returns the username from a client certificate, basic auth, token cookie,
+// or service account address, and when they presented credentials: now, or when the token was issued.
+// Tokens issued before that was recorded give the zero time.
+// Refused Basic credentials also give why, as authenticationValid does.
+func authenticatedUsername(req *http.Request) (string, time.Time, error) {
+	if username := clientCertUsername(req); username != "" {
+		return username, time.Now(), nil
+	}
+
+	var refused error
 	if authUsername, authPassword, ok := req.BasicAuth(); ok {
 		authUsername = strings.ToLower(authUsername)
-		valid := authenticationValid(authUsername, authPassword)
-		debugf("basic auth valid:%v username:%v", valid, authUsername)
+		var valid bool
+		valid, refused = authenticationValid(req.Context(), authUsername, authPassword)
+		if valid && !totpSatisfied(authUsername, req.Header.Get("X-Simpleauth-Totp")) {
+			debugf("missing or wrong TOTP code for username:%v", logName(authUsername))
+			valid = false
+		}
+		debugf("basic auth valid:%v username:%v", valid, logName(authUsername))
 		if valid {
-			return authUsername
+			return authUsername, time.Now(), nil
+		}
+	}
+
+	if t, ok := tokenFromCookies(req); ok {
+		var issued time.Time
+		if t.IssuedAt != nil {
+			issued = *t.IssuedAt
 		}
+		return t.Username, issued, nil
 	}
 
+	if username := serviceAccount(req); username != "" {
+		debugf("service account username:%v for %s", logName(username), clientAddress(req))
+		return username, time.Now(), nil
+	}
+
+	return "", time.Time{}, refused
+}
+
+// tokenFromCookies returns the first valid token in req's cookies
+func tokenFromCookies(req *http.Request) (token.T, bool) {
 	ncookies := 0
 	for i, cookie := range req.Cookies() {
-		if cookie.Name != cookieName {
+		if cookie.Name != cookieName && !slices.Contains(oldCookieNames, cookie.Name) {
 			continue
 		}
-		t, _ := token.ParseString(cookie.Value)
-		valid := t.Valid(secret)
-		debugf("cookie %d valid:%v username:%v", i, valid, t.Username)
-		if valid {
-			return t.Username
+		if maxTokenCookies > 0 && ncookies >= maxTokenCookies {
+			// Anyone can send this, so it's not worth a warning that would let them flood the log
+			debugf("%s sent more than %d token cookies; ignoring the rest", clientAddress(req), maxTokenCookies)
+			break
+		}
+		t, err := token.ParseString(cookie.Value)
+		if err == nil {
+			err = checkToken(t)
+		}
+		if err == nil && !uaMatches(t, req) {
+			err = errors.New("issued to a different User-Agent")
+		}
+		if err != nil {
+			debugf("cookie %d invalid: %v", i, err)
+		} else {
+			debugf("cookie %d valid username:%v", i, logName(t.Username))
+			return t, true
 		}
 		ncookies += 1
 	}
 	if ncookies == 0 {
 		debugf("no cookies")
 	}
-
-	return ""
+	return token.T{}, false
 }
 
-func rootHandler(w http.ResponseWriter, req *http.Request) {
-	var status string
-	username := usernameIfAuthenticated(req)
-	login := req.Header.Get("X-Simpleauth-Login") == "true"
+// maxTokenCookies limits how many token cookies are parsed per request (0 for no limit),
+// so a client can't make us check thousands of them
+var maxTokenCookies = 10
 
-	if username == "" {
-		status = "failed"
-		debugf("authentication failed")
-	} else {
-		status = "succeeded"
-		debugf("authentication succeeded for username:%v", username)
-		w.Header().Set("X-Simpleauth-Username", username)
+// maxHeaderBytes limits the size of request headers, so a client can't tie up memory with huge ones.
+// net/http answers requests over the limit with 431 itself, so handlers never see them, truncated or not.
+var maxHeaderBytes = 32 << 10
 
-		if login {
-			// Send back a token as a Set-Cookie header
-			t := token.New(secret, username, time.Now().Add(lifespan))
+// newServer returns the server for handler, listening on addr
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		MaxHeaderBytes: maxHeaderBytes,
+	}
+}
 
-			// Build Set-Cookie header with standard attributes
-			cookieValue := fmt.Sprintf("%s=%s; Path=/; Secure; HttpOnly; SameSite=Strict; Max-Age=%d",
-				cookieName, t.String(), int(lifespan.Seconds()))
+// trustedHeaders are the inbound X-Simpleauth-* headers the proxy may set.
+// Keys are canonical header names.
+var trustedHeaders = map[string]bool{
+	"X-Simpleauth-Login":           true,
+	"X-Simpleauth-Domain":          true,
+	"X-Simpleauth-Remember":        true,
+	"X-Simpleauth-Required-Groups": true,
+	"X-Simpleauth-Totp":            true,
+}
 
-			// Add domain if Caddy specified one (via header_up)
-			if domain := req.Header.Get("X-Simpleauth-Domain"); domain != "" {
-				cookieValue += fmt.Sprintf("; Domain=%s", domain)
-			}
+// trustedHeaderList returns the trusted header names, sorted and
+// comma-separated, as they would be given to -trusted-headers.
+func trustedHeaderList() string {
+	names := make([]string, 0, len(trustedHeaders))
+	for name := range trustedHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
 
-			w.Header().Set("Set-Cookie", cookieValue)
-		} else {
-			// This is the only time simpleauth returns 200
-			// That will cause Caddy to proceed with the original request
-			w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-			http.Error(w, "Success", http.StatusOK)
-			return
+// stripUntrustedHeaders removes inbound X-Simpleauth-* headers we don't trust,
+// so a client can't inject values that look like they came from us.
+func stripUntrustedHeaders(req *http.Request) {
+	for name := range req.Header {
+		if strings.HasPrefix(name, "X-Simpleauth-") && !trustedHeaders[name] {
+			debugf("dropping untrusted inbound header %s", name)
+			req.Header.Del(name)
 		}
-		// Fall through to the 401 response, though,
-		// so that Caddy will send our response back to the client,
-		// which needs these headers to set the cookie and try again.
 	}
+}
 
-	// Extract client IP for logging
-	clientIP := req.Header.Get("X-Real-IP")
-	if clientIP == "" {
-		clientIP = req.RemoteAddr
+// clientAddress returns the client's address, as reported by the proxy if possible
+func clientAddress(req *http.Request) string {
+	if clientIP := req.Header.Get("X-Real-IP"); clientIP != "" {
+		return clientIP
 	}
-	forwardedFor := req.Header.Get("X-Forwarded-For")
+	return req.RemoteAddr
+}
 
-	// Log authentication attempt in verbose mode
-	if verbose {
-		debugf("auth attempt - client:%s forwarded:%s method:%s path:%s login:%v status:%s",
-			clientIP, forwardedFor, req.Method, req.URL.Path, login, status)
+// clientIPAddr returns the client's IP address, as reported by the proxy if possible
+func clientIPAddr(req *http.Request) (netip.Addr, bool) {
+	addr := clientAddress(req)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
 	}
-
-	forwardedMethod := req.Header.Get("X-Forwarded-Method")
-	forwardedURL := url.URL{
-		Scheme: req.Header.Get("X-Forwarded-Proto"),
-		Host:   req.Header.Get("X-Forwarded-Host"),
-		Path:   req.Header.Get("X-Forwarded-Uri"),
-		User:   url.UserPassword(username, ""),
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Addr{}, false
 	}
+	return ip.Unmap(), true
+}
+
+// isLoginRequest returns true if req is a login attempt, rather than a forward-auth check.
+// That's either flagged by the login page with X-Simpleauth-Login,
+// or a request to the configured login path.
+func isLoginRequest(req *http.Request) bool {
+	return loginReason(req) != ""
+}
 
-	// Log the request
-	if false {
-		log.Printf("%s %s %s login:%v %s",
-			clientIP, forwardedMethod, forwardedURL.String(),
-			login, status,
-		)
+// loginReason returns why req is a login attempt, or "" if it isn't one
+func loginReason(req *http.Request) string {
+	if req.Header.Get("X-Simpleauth-Login") == "true" {
+		return "X-Simpleauth-Login"
+	}
+	if loginPath == "" {
+		return ""
 	}
+	if req.URL.Path == loginPath {
+		return "login path"
+	}
+	if uri := forwardedURI(req); uri != "" {
+		if u, err := url.Parse(uri); err == nil && u.Path == loginPath {
+			return "forwarded login path"
+		}
+	}
+	return ""
+}
 
-	w.Header().Set("Content-Type", "text/html")
-	w.Header().Set("X-Simpleauth-Authentication", status)
-	// Prevent search engine indexing
-	w.Header().Set("X-Robots-Tag", "noindex")
-	// Prevent caching of authentication responses
-	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+// rememberLifespan, if set, is the token lifespan for users who ask to stay logged in.
+// Everyone else gets a session cookie, lasting at most lifespan.
+var rememberLifespan time.Duration
 
-	// Return appropriate status code
-	if username != "" && login {
-		// Authentication succeeded in login mode - return 418 with Set-Cookie
-		w.WriteHeader(http.StatusTeapot)
-	} else {
-		// Authentication failed - return 401
-		w.WriteHeader(http.StatusUnauthorized)
+// tokenNotBefore, if in the future, is when newly issued tokens start working.
+// People can log in ahead of time for something that opens later.
+var tokenNotBefore time.Time
+
+// issueToken sends back a token for username as a Set-Cookie header.
+// remember asks for a long-lived, persistent cookie, if that's enabled.
+// If a factor lifespan applies to the login, that's how long the token lasts, remembered or not.
+// authenticatedAt is when credentials were last presented, from authenticateRequest,
+// and becomes the token's issue time: a login renewed with only a cookie keeps the cookie's,
+// so it can't pass for a recent login. The zero time leaves the issue time out.
+func issueToken(w http.ResponseWriter, req *http.Request, username string, remember bool, authenticatedAt time.Time) token.T {
+	tokenLifespan := clampLifespan(lifespan)
+	persistent := !sessionCookie
+	if rememberLifespan > 0 {
+		persistent = remember
+		if remember {
+			tokenLifespan = clampLifespan(rememberLifespan)
+		}
 	}
+	if d, ok := factorLifespan(loginFactors(req, username)); ok {
+		tokenLifespan = clampLifespan(d)
+	}
+	secret, _ := currentSecrets()
+	now := time.Now()
+	t := token.T{
+		Username:   username,
+		Groups:     userGroups(username),
+		Expiration: now.Add(tokenLifespan),
+		Lifespan:   tokenLifespan,
+		Audience:   issuedAudiences(),
+	}
+	if !authenticatedAt.IsZero() {
+		t.IssuedAt = &authenticatedAt
+	}
+	if limit := sessionLimit(authenticatedAt); !limit.IsZero() && t.Expiration.After(limit) {
+		t.Expiration = limit
+	}
+	if time.Now().Before(tokenNotBefore) {
+		nbf := tokenNotBefore
+		t.NotBefore = &nbf
+	}
+	if uaBinding != "off" {
+		t.UserAgent = uaHash(req)
+	}
+	t = t.Sign(secret)
+
+	cookieMaxAge := tokenLifespan
+	if !persistent {
+		// The token still expires on its own
+		cookieMaxAge = 0
+	}
+	setAuthCookie(w, req, t.String(), cookieMaxAge)
 
-	w.Write(loginHtml)
+	// Anybody could claim a known device's address in X-Real-IP
+	clientIP := req.RemoteAddr
+	if ip, ok := trustedClientIP(req); ok {
+		clientIP = ip.String()
+	}
+	notifyLogin(username, clientIP, req.UserAgent())
+	return t
 }
 
-// healthHandler returns health status for monitoring
-func healthHandler(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// rootHandler serves forward-auth checks, the login page, and logins.
+//
+// The login form is normally sent by JavaScript as a GET with Basic credentials,
+// like any other forward-auth request.
+// Without JavaScript, the browser POSTs the form instead.
+func rootHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodHead {
+		if headRequests == "reject" {
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w = headResponseWriter{w}
+	}
+	if !isAuthPath(req.URL.EscapedPath()) {
+		debugf("not an auth path: %s", req.URL.Path)
+		http.NotFound(w, req)
 		return
 	}
+	stripUntrustedHeaders(req)
+	normalizeForwardedHeaders(req)
+	if isLoginForm(req) {
+		loginFormHandler(w, req)
+		return
+	}
+	authHandler(w, req, false)
+}
 
-	w.Header().Set("Content-Type", "application/json")
+// authPaths, if set, are the request paths rootHandler answers, as path patterns.
+// Anything else gets a plain 404, instead of the login page.
+var authPaths []string
 
-	// Check if we have users and secret configured
-	status := map[string]interface{}{
-		"status":     "healthy",
-		"users":      len(cryptedPasswords),
-		"secret_set": len(secret) >= 64,
-		"uptime":     time.Since(startTime).String(), // Actual uptime
+// isAuthPath returns true if rootHandler should answer a request for p, as it was escaped in the request
+func isAuthPath(p string) bool {
+	if len(authPaths) == 0 || (loginPath != "" && p == loginPath) {
+		return true
 	}
+	return pathMatches(authPaths, p)
+}
 
-	// If no users configured, mark as unhealthy
-	if len(cryptedPasswords) == 0 {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		status["status"] = "unhealthy"
-		status["error"] = "no users configured"
+// isLoginForm returns true if req is the login form, posted by the browser
+func isLoginForm(req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
 	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
+}
 
-	// If secret not configured, mark as unhealthy
-	if len(secret) < 64 {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		status["status"] = "unhealthy"
-		status["error"] = "secret not properly configured"
+// loginFormHandler processes credentials posted by the login form
+func loginFormHandler(w http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(w, req.Body, 8192)
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
 	}
-
+	username := req.PostForm.Get("forward-auth-username")
+	if username == "" {
+		// Not our form: treat it like any other request
+		authHandler(w, req, false)
+		return
+	}
+
+	if !formFromSameOrigin(req) {
+		http.Error(w, "Cross-site login rejected", http.StatusForbidden)
+		logAccess(req, "", true, "csrf-rejected", http.StatusForbidden)
+		return
+	}
+
+	req.SetBasicAuth(username, req.PostForm.Get("forward-auth-password"))
+	req.Header.Set("X-Simpleauth-Login", "true")
+	if req.PostForm.Get("forward-auth-remember") != "" {
+		req.Header.Set("X-Simpleauth-Remember", "true")
+	}
+	if code := req.PostForm.Get("forward-auth-totp"); code != "" {
+		req.Header.Set("X-Simpleauth-Totp", code)
+	}
+	authHandler(w, req, true)
+}
+
+// localPath returns true if target is a path on this site:
+// it starts with /, but not //host or /\host, which browsers take as another host
+func localPath(target string) bool {
+	return strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.HasPrefix(target, "/\\")
+}
+
+// formRedirect is where the browser goes after logging in with a posted form.
+// It's the page the browser asked for, as long as that's on this site.
+func formRedirect(req *http.Request) string {
+	if successRedirect != "" {
+		return successRedirect
+	}
+	if uri := forwardedURI(req); uri != "" {
+		if localPath(uri) {
+			return uri
+		}
+		return "/"
+	}
+	if uri := req.URL.RequestURI(); req.URL.Path != loginPath && localPath(uri) {
+		return uri
+	}
+	return "/"
+}
+
+// authHandler decides a forward-auth request, or a login.
+// form is true if the credentials came from a posted login form.
+func authHandler(w http.ResponseWriter, req *http.Request, form bool) {
+	var status string
+
+	login := isLoginRequest(req)
+	if login && csrfProtection && !csrfValid(req) {
+		debugf("login rejected: missing or invalid CSRF token")
+		http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+		logAccess(req, "", login, "csrf-rejected", http.StatusForbidden)
+		return
+	}
+
+	// Throttle password attempts per username, before spending time verifying them
+	throttledUsername := ""
+	if authUsername, _, ok := req.BasicAuth(); ok && loginThrottle != nil && !throttleExempt(req) {
+		throttledUsername = strings.ToLower(authUsername)
+		if !loginThrottle.take(throttledUsername) {
+			debugf("login throttled for username:%v", logName(throttledUsername))
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Too many login attempts", http.StatusTooManyRequests)
+			logAccess(req, "", login, "throttled", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	// Limit concurrent password verifications, shedding what we can't get to
+	release := func() {}
+	if _, _, ok := req.BasicAuth(); ok {
+		if release, ok = acquireVerifySlot(req.Context()); !ok {
+			debugf("login shed: too many verifications in progress")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too busy, try again", http.StatusServiceUnavailable)
+			logAccess(req, "", login, "shed", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	username, authenticatedAt, refused := authenticateRequest(req)
+	release()
+	if throttledUsername != "" && username == throttledUsername {
+		loginThrottle.refund(throttledUsername)
+	}
+
+	if username == "" && !login && policyPublic(req) {
+		// Let anonymous requests through, without identity headers
+		debugf("public by policy: %s %s", forwardedMethod(req), forwardedURI(req))
+		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		if successCode == http.StatusNoContent || isSubrequest(req) {
+			w.WriteHeader(successCode)
+		} else {
+			http.Error(w, "Success", successCode)
+		}
+		logAccess(req, "", login, "public", successCode)
+		return
+	}
+
+	// Sensitive paths need a recent login, however long the token lasts.
+	// Logins count too: one carrying only a cookie hasn't presented anything new.
+	stale := username != "" && stepUpRequired(forwardedURI(req), authenticatedAt)
+	if stale {
+		debugf("username:%v must log in again for %v", logName(username), forwardedURI(req))
+		username = ""
+	}
+	expired := username != "" && sessionExpired(authenticatedAt)
+	if expired {
+		debugf("session for username:%v has reached its maximum age", logName(username))
+		username = ""
+	}
+
+	if username == "" {
+		status = "failed"
+		if stale {
+			status = "stale"
+		} else if expired {
+			status = "expired"
+		} else if _, _, ok := req.BasicAuth(); ok {
+			detail := loginFailureDetail(refused)
+			if revealLoginFailures || detail != genericLoginFailure {
+				w.Header().Set("X-Simpleauth-Failure", detail)
+			}
+		}
+		debugf("authentication failed")
+	} else {
+		status = "succeeded"
+		debugf("authentication succeeded for username:%v", logName(username))
+		w.Header().Set("X-Simpleauth-Username", username)
+
+		if login {
+			if loginCooldowns != nil && !throttleExempt(req) {
+				if ok, wait := loginCooldowns.allow(username); !ok {
+					debugf("login cooldown for username:%v", logName(username))
+					w.Header().Set("Retry-After", retryAfter(wait))
+					http.Error(w, "Logged in too recently, try again later", http.StatusTooManyRequests)
+					logAccess(req, username, login, "cooldown", http.StatusTooManyRequests)
+					return
+				}
+			}
+			t := issueToken(w, req, username, req.Header.Get("X-Simpleauth-Remember") == "true", authenticatedAt)
+
+			if format := tokenBodyFormat(req); format != "" && !form {
+				w.Header().Set("Cache-Control", "no-store")
+				logAuthDecision(w, req, "token body ("+format+")", loginSuccessCode)
+				writeTokenBody(w, t, format, loginSuccessCode)
+				logAccess(req, username, login, status, loginSuccessCode)
+				return
+			}
+
+			if form {
+				// Have the browser load the page again, with its new cookie
+				logAuthDecision(w, req, "form redirect", http.StatusSeeOther)
+				http.Redirect(w, req, formRedirect(req), http.StatusSeeOther)
+				logAccess(req, username, login, status, http.StatusSeeOther)
+				return
+			}
+
+			if successRedirect != "" {
+				// The login page navigates here, instead of reloading
+				w.Header().Set("X-Simpleauth-Redirect", successRedirect)
+			}
+		} else {
+			if !pathAllowed(username, forwardedURI(req)) {
+				debugf("username:%v may not visit %v", logName(username), forwardedURI(req))
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				logAccess(req, username, login, "forbidden", http.StatusForbidden)
+				return
+			}
+			if policyDenies(req, username) {
+				debugf("policy denies username:%v %s %s", logName(username), forwardedMethod(req), forwardedURI(req))
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				logAccess(req, username, login, "forbidden", http.StatusForbidden)
+				return
+			}
+			if !groupAllowed(username, req) {
+				debugf("username:%v is not in a required group", logName(username))
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				logAccess(req, username, login, "forbidden", http.StatusForbidden)
+				return
+			}
+			if mutationTokenRequired(req) {
+				if session, ok := cookieSession(req); ok && !mutationTokenValid(req, session) {
+					debugf("username:%v sent %s %s without a valid mutation token", logName(username), forwardedMethod(req), forwardedURI(req))
+					http.Error(w, "Missing or invalid mutation token", http.StatusForbidden)
+					logAccess(req, username, login, "mutation-rejected", http.StatusForbidden)
+					return
+				}
+			}
+
+			// This is the only time simpleauth returns 2xx
+			// That will cause Caddy to proceed with the original request
+			slideSession(w, req)
+			setIdentityHeaders(w, username)
+			w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+			if successCode == http.StatusNoContent || isSubrequest(req) {
+				w.WriteHeader(successCode)
+			} else {
+				http.Error(w, "Success", successCode)
+			}
+			logAccess(req, username, login, status, successCode)
+			return
+		}
+		// Fall through to the 401 response, though,
+		// so that Caddy will send our response back to the client,
+		// which needs these headers to set the cookie and try again.
+	}
+
+	// Extract client IP for logging
+	clientIP := clientAddress(req)
+	forwardedFor := req.Header.Get("X-Forwarded-For")
+
+	// Log authentication attempt in verbose mode
+	if verbose {
+		debugf("auth attempt - client:%s forwarded:%s method:%s path:%s login:%v status:%s",
+			clientIP, forwardedFor, req.Method, req.URL.Path, login, status)
+	}
+
+	var body []byte
+	response := "login page"
+	nonce, err := newNonce()
+	success := currentSuccessTemplate()
+	switch {
+	case err != nil:
+		// Reported below
+	case isSubrequest(req) && !login:
+		// nginx only looks at the status and headers, so don't bother rendering a page
+		response = "no body"
+	case req.Method == http.MethodHead:
+		response = "no body"
+	case username != "" && login && success != nil:
+		response = "success page"
+		body, err = renderPage(success, req, nonce, "")
+	default:
+		var csrfToken string
+		if csrfToken, err = pageCSRFToken(w, req); err == nil {
+			body, err = renderLogin(req, nonce, csrfToken)
+		}
+	}
+	if err != nil {
+		log.Printf("Rendering login page: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if body != nil {
+		setCSP(w, nonce)
+	}
+	w.Header().Set("X-Simpleauth-Authentication", status)
+	// Prevent search engine indexing
+	w.Header().Set("X-Robots-Tag", "noindex")
+	// Prevent caching of authentication responses
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+
+	// Make anonymous clients wait for the login page, to slow down scrapers.
+	// nginx subrequests get the wait when nginx fetches the login page.
+	if username == "" && loginDelay > 0 && !isSubrequest(req) {
+		select {
+		case <-time.After(loginDelay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	// Return appropriate status code
+	code := http.StatusUnauthorized
+	if username != "" && login {
+		// Authentication succeeded in login mode - return 418 (or as configured) with Set-Cookie
+		code = loginSuccessCode
+	}
+	// Otherwise authentication failed - return 401
+	logAuthDecision(w, req, response, code)
+	logAccess(req, username, login, status, code)
+	w.WriteHeader(code)
+
+	w.Write(body)
+}
+
+// healthRetryAfter is how long monitors should wait before checking an unhealthy instance again
+const healthRetryAfter = "30"
+
+// healthFailures returns the list of prerequisites that are not satisfied
+func healthFailures() []string {
+	failures := []string{}
+	secret, _ := currentSecrets()
+	if len(currentUsers()) == 0 {
+		failures = append(failures, "users")
+	}
+	if len(secret) < secretLength {
+		failures = append(failures, "secret")
+	}
+	if currentLoginTemplate() == nil {
+		failures = append(failures, "html")
+	}
+	return failures
+}
+
+// healthFailureMessages describes each prerequisite reported by healthFailures
+var healthFailureMessages = map[string]string{
+	"users":  "no users configured",
+	"secret": "secret not properly configured",
+	"html":   "login page not loaded",
+}
+
+// healthHandler returns health status for monitoring
+func healthHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "error",
+			"error":  "method not allowed",
+		})
+		return
+	}
+
+	// Check if we have users and secret configured
+	secret, _ := currentSecrets()
+	status := map[string]interface{}{
+		"status":     "healthy",
+		"users":      len(currentUsers()),
+		"secret_set": len(secret) >= secretLength,
+		"uptime":     time.Since(startTime).String(), // Actual uptime
+		"lifespan": map[string]interface{}{
+			"duration": lifespan.String(),
+			"seconds":  int(lifespan.Seconds()),
+		},
+	}
+
+	// If any prerequisite is missing, mark as unhealthy and say which
+	if failures := healthFailures(); len(failures) > 0 {
+		errors := make([]string, 0, len(failures))
+		for _, failure := range failures {
+			errors = append(errors, healthFailureMessages[failure])
+		}
+		status["status"] = "unhealthy"
+		status["failed"] = failures
+		status["errors"] = errors
+		status["error"] = strings.Join(errors, "; ")
+		w.Header().Set("Retry-After", healthRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
 	json.NewEncoder(w).Encode(status)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:], os.Stdin, os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-users" {
+		os.Exit(runMigrateUsers(os.Stdout))
+	}
+
 	// Support both flags and environment variables
 	listen := flag.String(
 		"listen",
@@ -323,20 +1294,571 @@ func main() {
 		getEnvWithFallback("SIMPLEAUTH_LIFESPAN", "2400h"),
 		"How long an issued token is valid (e.g., 100h, 30d)",
 	)
+	maxLifespanStr := flag.String(
+		"max-lifespan",
+		getEnvWithFallback("SIMPLEAUTH_MAX_LIFESPAN", ""),
+		"Hard cap on token lifespan, also enforced on existing tokens (empty for no cap)",
+	)
 	passwordPath := flag.String(
 		"passwd",
 		getEnvWithFallback("SIMPLEAUTH_PASSWORD_FILE", "/run/secrets/passwd"),
 		"Path to a file containing passwords",
 	)
+	passwdSeparatorStr := flag.String(
+		"passwd-separator",
+		getEnvWithFallback("SIMPLEAUTH_PASSWORD_SEPARATOR", ":"),
+		"Separator between username and hash in the password file (\"tab\" for tab)",
+	)
+	flag.DurationVar(
+		&backendTimeout,
+		"backend-timeout",
+		durationEnv("SIMPLEAUTH_BACKEND_TIMEOUT", 10*time.Second),
+		"Give up on a credential backend that takes longer than this (0 to wait forever)",
+	)
+	flag.IntVar(
+		&maxTokenCookies,
+		"max-token-cookies",
+		intEnv("SIMPLEAUTH_MAX_TOKEN_COOKIES", 10),
+		"Most token cookies to check in one request (0 for no limit)",
+	)
+	flag.IntVar(
+		&maxHeaderBytes,
+		"max-header-bytes",
+		intEnv("SIMPLEAUTH_MAX_HEADER_BYTES", maxHeaderBytes),
+		"Largest request headers to accept, in bytes; larger requests get 431",
+	)
+	flag.DurationVar(
+		&slowAuthThreshold,
+		"slow-auth",
+		durationEnv("SIMPLEAUTH_SLOW_AUTH", 0),
+		"Log a warning when a credential backend takes longer than this (0 for never)",
+	)
+	flag.StringVar(
+		&usersPolicy,
+		"users-policy",
+		getEnvWithFallback("SIMPLEAUTH_USERS_POLICY", usersPolicy),
+		"When users in the environment and the password file are both present: override (use the environment) or merge",
+	)
+	flag.BoolVar(
+		&hashUsernames,
+		"hash-usernames",
+		os.Getenv("SIMPLEAUTH_HASH_USERNAMES") == "true",
+		"Store usernames as keyed hashes, so the user list isn't kept in memory",
+	)
+	flag.BoolVar(
+		&strictUsers,
+		"strict-users",
+		os.Getenv("SIMPLEAUTH_STRICT_USERS") == "true",
+		"Refuse to start if any user entry is malformed, instead of skipping it",
+	)
 	secretPath := flag.String(
 		"secret",
 		getEnvWithFallback("SIMPLEAUTH_SECRET_FILE", "/run/secrets/simpleauth.key"),
 		"Path to a file containing some sort of secret, for signing requests",
 	)
+	secretProviderName := flag.String(
+		"secret-provider",
+		getEnvWithFallback("SIMPLEAUTH_SECRET_PROVIDER", ""),
+		"Fetch the secret from a secret manager instead of a file: vault or aws",
+	)
+	secretName := flag.String(
+		"secret-name",
+		getEnvWithFallback("SIMPLEAUTH_SECRET_NAME", ""),
+		"Name of the secret in the secret provider (base64, like SIMPLEAUTH_SECRET)",
+	)
+	usersSecretName := flag.String(
+		"users-secret-name",
+		getEnvWithFallback("SIMPLEAUTH_USERS_SECRET_NAME", ""),
+		"Name of a secret in the secret provider holding users, in password file format, to use instead of the password file",
+	)
 	htmlPath := flag.String(
 		"html",
 		getEnvWithFallback("SIMPLEAUTH_HTML_PATH", "web"),
-		"Path to HTML files",
+		"Path to HTML files, or http(s) URL of a login page",
+	)
+	htmlRefreshStr := flag.String(
+		"html-refresh",
+		getEnvWithFallback("SIMPLEAUTH_HTML_REFRESH", ""),
+		"How often to re-fetch the login page when -html is a URL (empty to never refresh)",
+	)
+	flag.DurationVar(
+		&loginDelay,
+		"login-delay",
+		durationEnv("SIMPLEAUTH_LOGIN_DELAY", 0),
+		"How long to wait before serving the login page to anonymous clients",
+	)
+	optionalBackendsStr := flag.String(
+		"optional-backends",
+		os.Getenv("SIMPLEAUTH_OPTIONAL_BACKENDS"),
+		"Comma-separated backends whose failure only degrades readiness",
+	)
+	flag.BoolVar(
+		&cookiePartitioned,
+		"cookie-partitioned",
+		os.Getenv("SIMPLEAUTH_COOKIE_PARTITIONED") == "true",
+		"Add the Partitioned (CHIPS) attribute to the auth cookie, for embedded iframes",
+	)
+	trustedHeadersStr := flag.String(
+		"trusted-headers",
+		os.Getenv("SIMPLEAUTH_TRUSTED_HEADERS"),
+		"Comma-separated inbound X-Simpleauth-* headers to accept from the proxy; replaces the whole default list (default "+trustedHeaderList()+")",
+	)
+	loginRate := flag.Float64(
+		"login-rate",
+		floatEnv("SIMPLEAUTH_LOGIN_RATE", 0),
+		"Password attempts allowed per username per minute, across all clients (0 for no limit)",
+	)
+	loginBurst := flag.Int(
+		"login-burst",
+		intEnv("SIMPLEAUTH_LOGIN_BURST", 10),
+		"Password attempts allowed per username in a burst, when -login-rate is set",
+	)
+	throttleExemptStr := flag.String(
+		"throttle-exempt",
+		os.Getenv("SIMPLEAUTH_THROTTLE_EXEMPT"),
+		"Client IPs and CIDR networks, separated by commas, exempt from -login-rate and -login-cooldown",
+	)
+	trustedProxiesStr := flag.String(
+		"trusted-proxies",
+		os.Getenv("SIMPLEAUTH_TRUSTED_PROXIES"),
+		"Proxy IPs and CIDR networks, separated by commas, whose X-Real-IP and X-Forwarded-For are believed for -service-accounts and -throttle-exempt",
+	)
+	flag.BoolVar(
+		&sessionCookie,
+		"session-cookie",
+		os.Getenv("SIMPLEAUTH_SESSION_COOKIE") == "true",
+		"Issue session cookies, cleared when the browser closes, instead of setting Max-Age",
+	)
+	flag.BoolVar(
+		&csrfProtection,
+		"csrf",
+		os.Getenv("SIMPLEAUTH_CSRF") == "true",
+		"Require a CSRF token (from /csrf) on login requests",
+	)
+	successPath := flag.String(
+		"success-html",
+		os.Getenv("SIMPLEAUTH_SUCCESS_HTML"),
+		"Path to a page shown after a successful login, instead of the login page",
+	)
+	flag.StringVar(
+		&successRedirect,
+		"success-redirect",
+		os.Getenv("SIMPLEAUTH_SUCCESS_REDIRECT"),
+		"URL the login page goes to after a successful login, instead of reloading",
+	)
+	flag.StringVar(
+		&brandTitle,
+		"brand-title",
+		getEnvWithFallback("SIMPLEAUTH_BRAND_TITLE", brandTitle),
+		"Title and heading of the built-in login page",
+	)
+	flag.StringVar(
+		&brandLogoURL,
+		"brand-logo-url",
+		os.Getenv("SIMPLEAUTH_BRAND_LOGO_URL"),
+		"URL of a logo shown on the built-in login page",
+	)
+	flag.StringVar(
+		&brandColor,
+		"brand-color",
+		getEnvWithFallback("SIMPLEAUTH_BRAND_COLOR", brandColor),
+		"Background color of the built-in login page, as a CSS color",
+	)
+	flag.StringVar(
+		&audience,
+		"audience",
+		os.Getenv("SIMPLEAUTH_AUDIENCE"),
+		"Service this instance authenticates for: it only accepts tokens issued for it",
+	)
+	additionalAudiencesStr := flag.String(
+		"additional-audiences",
+		os.Getenv("SIMPLEAUTH_ADDITIONAL_AUDIENCES"),
+		"Other services, separated by commas, that tokens issued here also work for (needs -audience)",
+	)
+	headRequestsStr := flag.String(
+		"head-requests",
+		getEnvWithFallback("SIMPLEAUTH_HEAD_REQUESTS", headRequests),
+		"How to answer HEAD requests: get (as for GET, without the body) or reject (405)",
+	)
+	bannerText := flag.String(
+		"banner",
+		os.Getenv("SIMPLEAUTH_BANNER"),
+		"Notice shown on the login page",
+	)
+	bannerPath := flag.String(
+		"banner-file",
+		os.Getenv("SIMPLEAUTH_BANNER_FILE"),
+		"File containing a notice shown on the login page (overrides -banner)",
+	)
+	flag.StringVar(
+		&loginPath,
+		"login-path",
+		os.Getenv("SIMPLEAUTH_LOGIN_PATH"),
+		"Path the login form sends credentials to, if not the page being accessed",
+	)
+	flag.StringVar(
+		&logoutRedirect,
+		"logout-redirect",
+		os.Getenv("SIMPLEAUTH_LOGOUT_REDIRECT"),
+		"Where /logout sends people, like a landing page (default is a plain \"Logged out\")",
+	)
+	logoutRedirectHostsStr := flag.String(
+		"logout-redirect-hosts",
+		os.Getenv("SIMPLEAUTH_LOGOUT_REDIRECT_HOSTS"),
+		"Hosts, separated by commas, that /logout?redirect=URL may send people to, besides paths on this site",
+	)
+	authPathsStr := flag.String(
+		"auth-paths",
+		os.Getenv("SIMPLEAUTH_AUTH_PATHS"),
+		"Request paths to answer with forward auth and the login page, separated by commas (a trailing / matches everything under it); others get 404. Default is every path",
+	)
+	flag.StringVar(
+		&smtpAddr,
+		"smtp-addr",
+		os.Getenv("SIMPLEAUTH_SMTP_ADDR"),
+		"SMTP server (host:port) for new device login notifications (empty to disable)",
+	)
+	flag.StringVar(
+		&smtpFrom,
+		"smtp-from",
+		getEnvWithFallback("SIMPLEAUTH_SMTP_FROM", "simpleauth@localhost"),
+		"From address for login notifications",
+	)
+	flag.StringVar(
+		&smtpDomain,
+		"smtp-domain",
+		os.Getenv("SIMPLEAUTH_SMTP_DOMAIN"),
+		"Domain appended to usernames that aren't email addresses, for login notifications",
+	)
+	flag.DurationVar(
+		&newDeviceWindow,
+		"new-device-window",
+		durationEnv("SIMPLEAUTH_NEW_DEVICE_WINDOW", newDeviceWindow),
+		"How long a device stays known after logging in from it",
+	)
+	accessLogEnabled := flag.Bool(
+		"access-log",
+		os.Getenv("SIMPLEAUTH_ACCESS_LOG") == "true",
+		"Log each forward-auth decision",
+	)
+	flag.StringVar(
+		&accessLogFormat,
+		"access-log-format",
+		getEnvWithFallback("SIMPLEAUTH_ACCESS_LOG_FORMAT", accessLogFormat),
+		"Access log format: text, json, common, or combined",
+	)
+	tlsCert := flag.String(
+		"tls-cert",
+		os.Getenv("SIMPLEAUTH_TLS_CERT"),
+		"Serve TLS directly, with this certificate file",
+	)
+	tlsKey := flag.String(
+		"tls-key",
+		os.Getenv("SIMPLEAUTH_TLS_KEY"),
+		"Private key file for -tls-cert",
+	)
+	clientCA := flag.String(
+		"client-ca",
+		os.Getenv("SIMPLEAUTH_CLIENT_CA"),
+		"CA certificate file for verifying client certificates (requires -tls-cert)",
+	)
+	clientCertUsersStr := flag.String(
+		"client-cert-users",
+		os.Getenv("SIMPLEAUTH_CLIENT_CERT_USERS"),
+		"Map client certificate CN or SAN to username, as identity=username,...",
+	)
+	flag.StringVar(
+		&adminToken,
+		"admin-token",
+		os.Getenv("SIMPLEAUTH_ADMIN_TOKEN"),
+		"Bearer token for the admin endpoints (which are off without one)",
+	)
+	cookieOmit := flag.String(
+		"cookie-omit",
+		os.Getenv("SIMPLEAUTH_COOKIE_OMIT"),
+		"Cookie attributes to leave off, for broken proxies: HttpOnly, SameSite (weakens security)",
+	)
+	flag.IntVar(
+		&successCode,
+		"success-code",
+		intEnv("SIMPLEAUTH_SUCCESS_CODE", successCode),
+		"Status code for successful forward-auth requests: 200 or 204",
+	)
+	flag.StringVar(
+		&proxyMode,
+		"mode",
+		getEnvWithFallback("SIMPLEAUTH_MODE", proxyMode),
+		"Reverse proxy in front of simpleauth, for suitable defaults: caddy, traefik, or nginx",
+	)
+	forwardedPreset := flag.String(
+		"forwarded-preset",
+		os.Getenv("SIMPLEAUTH_FORWARDED_PRESET"),
+		"Names of the headers describing the original request: caddy, traefik, or nginx (default: same as -mode)",
+	)
+	identityHeadersStr := flag.String(
+		"response-headers",
+		os.Getenv("SIMPLEAUTH_RESPONSE_HEADERS"),
+		"Headers to set on forward-auth success, as Header-Name=username or Header-Name=groups,... (default depends on -mode)",
+	)
+	forwardedOverrides := flag.String(
+		"forwarded-headers",
+		os.Getenv("SIMPLEAUTH_FORWARDED_HEADERS"),
+		"Override forwarded header names, as field=Header-Name,... (fields: proto, host, port, uri, method)",
+	)
+	flag.BoolVar(
+		&logAuthDecisions,
+		"log-auth-decisions",
+		os.Getenv("SIMPLEAUTH_LOG_AUTH_DECISIONS") == "true",
+		"Log how each login page, token, or challenge response was chosen, with the request's Accept header (always on with -verbose)",
+	)
+	flag.BoolVar(
+		&rawForwardedHeaders,
+		"raw-forwarded-headers",
+		os.Getenv("SIMPLEAUTH_RAW_FORWARDED_HEADERS") == "true",
+		"Read forwarded and X-Simpleauth-* headers as sent, without trimming them or dropping repeats",
+	)
+	tokenNotBeforeStr := flag.String(
+		"token-not-before",
+		os.Getenv("SIMPLEAUTH_TOKEN_NOT_BEFORE"),
+		"Tokens issued before this date or RFC 3339 time don't work until then",
+	)
+	revokeTokensBeforeStr := flag.String(
+		"revoke-tokens-before",
+		os.Getenv("SIMPLEAUTH_REVOKE_TOKENS_BEFORE"),
+		"Reject every token issued before this date or RFC 3339 time, logging everybody out",
+	)
+	flag.BoolVar(
+		&devMode,
+		"dev",
+		false,
+		"Development mode: if no secret is configured, use a random one (logins won't survive a restart)",
+	)
+	flag.IntVar(
+		&secretLength,
+		"secret-length",
+		intEnv("SIMPLEAUTH_SECRET_LENGTH", secretLength),
+		fmt.Sprintf("Bytes of secret to use; shorter secrets are rejected (at least %d)", minSecretLength),
+	)
+	statsdAddr := flag.String(
+		"statsd-addr",
+		os.Getenv("SIMPLEAUTH_STATSD_ADDR"),
+		"Send authentication metrics to this StatsD server (host:port, over UDP)",
+	)
+	statsdPrefix := flag.String(
+		"statsd-prefix",
+		getEnvWithFallback("SIMPLEAUTH_STATSD_PREFIX", "simpleauth."),
+		"Prefix for StatsD metric names",
+	)
+	flag.DurationVar(
+		&rememberLifespan,
+		"remember-lifespan",
+		durationEnv("SIMPLEAUTH_REMEMBER_LIFESPAN", 0),
+		"Offer \"keep me logged in\", with tokens lasting this long; others get session cookies (0 to disable)",
+	)
+	flag.BoolVar(
+		&slidingSessions,
+		"sliding-sessions",
+		os.Getenv("SIMPLEAUTH_SLIDING_SESSIONS") == "true",
+		"Reissue the token cookie on every authenticated request, extending it, up to -max-session-age after login",
+	)
+	flag.DurationVar(
+		&maxSessionAge,
+		"max-session-age",
+		durationEnv("SIMPLEAUTH_MAX_SESSION_AGE", maxSessionAge),
+		"How long after logging in a sliding session ends, however active it is",
+	)
+	flag.DurationVar(
+		&refreshWindow,
+		"refresh-window",
+		durationEnv("SIMPLEAUTH_REFRESH_WINDOW", refreshWindow),
+		"With -sliding-sessions, how long requests still carrying a replaced token get the same replacement, instead of another new token (0 to always issue a new one)",
+	)
+	flag.StringVar(
+		&breachMode,
+		"breached-passwords",
+		getEnvWithFallback("SIMPLEAUTH_BREACHED_PASSWORDS", breachMode),
+		"Check logins against HaveIBeenPwned: off, warn (log it), or deny",
+	)
+	flag.StringVar(
+		&breachChecker.URL,
+		"breach-url",
+		getEnvWithFallback("SIMPLEAUTH_BREACH_URL", password.DefaultBreachURL),
+		"HaveIBeenPwned-compatible range API, for -breached-passwords",
+	)
+	maxVerifications := flag.Int(
+		"max-verifications",
+		intEnv("SIMPLEAUTH_MAX_VERIFICATIONS", 0),
+		"Most password verifications to run at once; more wait, and are shed with 503 (0 for no limit)",
+	)
+	flag.DurationVar(
+		&verifyQueueTimeout,
+		"verification-queue-timeout",
+		durationEnv("SIMPLEAUTH_VERIFICATION_QUEUE_TIMEOUT", verifyQueueTimeout),
+		"How long a password verification waits for a slot, with -max-verifications",
+	)
+	passwdKeyPath := flag.String(
+		"passwd-key-file",
+		os.Getenv("SIMPLEAUTH_PASSWD_KEY_FILE"),
+		"age identity file, to decrypt an encrypted password file",
+	)
+	useSyslog := flag.Bool(
+		"syslog",
+		os.Getenv("SIMPLEAUTH_SYSLOG") == "true",
+		"Send logs to syslog instead of stderr",
+	)
+	syslogAddr := flag.String(
+		"syslog-addr",
+		os.Getenv("SIMPLEAUTH_SYSLOG_ADDR"),
+		"Syslog server, as network://host:port (default: the local syslog daemon)",
+	)
+	syslogFacility := flag.String(
+		"syslog-facility",
+		getEnvWithFallback("SIMPLEAUTH_SYSLOG_FACILITY", "daemon"),
+		"Syslog facility",
+	)
+	syslogTag := flag.String(
+		"syslog-tag",
+		getEnvWithFallback("SIMPLEAUTH_SYSLOG_TAG", "simpleauth"),
+		"Syslog tag",
+	)
+	hostThemesStr := flag.String(
+		"host-themes",
+		os.Getenv("SIMPLEAUTH_HOST_THEMES"),
+		"Login pages for particular forwarded hosts, as host=file pairs separated by commas",
+	)
+	flag.StringVar(
+		&tokenBody,
+		"token-body",
+		getEnvWithFallback("SIMPLEAUTH_TOKEN_BODY", tokenBody),
+		"Also send the token in the login response body: off, json, text, or accept (by the Accept header)",
+	)
+	loginCooldownInterval := flag.Duration(
+		"login-cooldown",
+		durationEnv("SIMPLEAUTH_LOGIN_COOLDOWN", 0),
+		"Minimum time between successful logins for each username (0 for no limit)",
+	)
+	flag.BoolVar(
+		&trimPasswords,
+		"trim-passwords",
+		os.Getenv("SIMPLEAUTH_TRIM_PASSWORDS") == "true",
+		"Remove leading and trailing whitespace from submitted passwords",
+	)
+	flag.StringVar(
+		&uaBinding,
+		"ua-binding",
+		getEnvWithFallback("SIMPLEAUTH_UA_BINDING", uaBinding),
+		"Tie tokens to the User-Agent they were issued to: off, exact, or family (ignoring version numbers)",
+	)
+	policyPath := flag.String(
+		"policy",
+		os.Getenv("SIMPLEAUTH_POLICY"),
+		"YAML access policy, making some URLs and methods public, and denying others",
+	)
+	requiredGroupsStr := flag.String(
+		"required-groups",
+		os.Getenv("SIMPLEAUTH_REQUIRED_GROUPS"),
+		"Users must be in one of these groups, separated by commas, to get through",
+	)
+	serviceAccountsStr := flag.String(
+		"service-accounts",
+		os.Getenv("SIMPLEAUTH_SERVICE_ACCOUNTS"),
+		"Log in requests from these exact client addresses as service accounts, without credentials, like 10.0.0.5=backup",
+	)
+	factorLifespansStr := flag.String(
+		"factor-lifespans",
+		os.Getenv("SIMPLEAUTH_FACTOR_LIFESPANS"),
+		"Token lifespan by the factors a login satisfied, like password=1h,password+totp=720h,cert=720h",
+	)
+	stepUpPathsStr := flag.String(
+		"step-up-paths",
+		os.Getenv("SIMPLEAUTH_STEP_UP_PATHS"),
+		"Paths needing a recent login even with a valid token, separated by commas (a trailing / matches everything under it)",
+	)
+	flag.DurationVar(
+		&stepUpFreshness,
+		"step-up-freshness",
+		durationEnv("SIMPLEAUTH_STEP_UP_FRESHNESS", 15*time.Minute),
+		"How recent a login must be for -step-up-paths",
+	)
+	mutationPathsStr := flag.String(
+		"mutation-paths",
+		os.Getenv("SIMPLEAUTH_MUTATION_PATHS"),
+		"Paths where requests that change things need a mutation token from /mutation-token, separated by commas (a trailing / matches everything under it)",
+	)
+	mutationMethodsStr := flag.String(
+		"mutation-methods",
+		getEnvWithFallback("SIMPLEAUTH_MUTATION_METHODS", strings.Join(mutationMethods, ",")),
+		"Methods that need a mutation token on -mutation-paths, separated by commas",
+	)
+	flag.DurationVar(
+		&mutationTokenLifespan,
+		"mutation-token-lifespan",
+		durationEnv("SIMPLEAUTH_MUTATION_TOKEN_LIFESPAN", mutationTokenLifespan),
+		"How long a mutation token is good for",
+	)
+	allowedUsersStr := flag.String(
+		"allowed-users",
+		os.Getenv("SIMPLEAUTH_ALLOWED_USERS"),
+		"Only these usernames may authenticate, separated by commas",
+	)
+	allowedUsersPath := flag.String(
+		"allowed-users-file",
+		os.Getenv("SIMPLEAUTH_ALLOWED_USERS_FILE"),
+		"Only usernames in this file, one per line, may authenticate",
+	)
+	flag.IntVar(
+		&loginSuccessCode,
+		"login-success-code",
+		intEnv("SIMPLEAUTH_LOGIN_SUCCESS_CODE", loginSuccessCode),
+		"Status code for a successful login, carrying the new cookie",
+	)
+	flag.StringVar(
+		&cspTemplate,
+		"csp",
+		os.Getenv("SIMPLEAUTH_CSP"),
+		"Content-Security-Policy for the login page, with {nonce} for the per-response nonce (\"suggested\" for a strict policy)",
+	)
+	flag.DurationVar(
+		&secretGrace,
+		"secret-grace",
+		durationEnv("SIMPLEAUTH_SECRET_GRACE", secretGrace),
+		"How long tokens signed with a secret replaced on reload keep working (0 to stop them right away)",
+	)
+	flag.StringVar(
+		&expiredAccountMessage,
+		"expired-account-message",
+		getEnvWithFallback("SIMPLEAUTH_EXPIRED_ACCOUNT_MESSAGE", expiredAccountMessage),
+		"What to tell someone who logs in correctly to an expired account (empty for the usual failure message)",
+	)
+	flag.BoolVar(
+		&revealLoginFailures,
+		"reveal-login-failures",
+		os.Getenv("SIMPLEAUTH_REVEAL_LOGIN_FAILURES") == "true",
+		"Tell clients whether a failed login had an unknown username or a wrong password (reveals which users exist)",
+	)
+	flag.StringVar(
+		&cookieSameSite,
+		"cookie-samesite",
+		getEnvWithFallback("SIMPLEAUTH_COOKIE_SAMESITE", "Strict"),
+		"SameSite attribute of the auth cookie: Strict, Lax, or None (for embedding in other sites)",
+	)
+	flag.BoolVar(
+		&sameSiteCompat,
+		"samesite-compat",
+		os.Getenv("SIMPLEAUTH_SAMESITE_COMPAT") == "true",
+		"Leave SameSite=None off the auth cookie for browsers that mishandle it (older Safari and Chrome)",
+	)
+	flag.StringVar(
+		&totpPath,
+		"totp-file",
+		getEnvWithFallback("SIMPLEAUTH_TOTP_FILE", ""),
+		"File of enrolled TOTP secrets, written by /totp/enroll (empty to turn enrollment off)",
+	)
+	flag.StringVar(
+		&totpIssuer,
+		"totp-issuer",
+		getEnvWithFallback("SIMPLEAUTH_TOTP_ISSUER", "simpleauth"),
+		"Service name shown in authenticator apps",
 	)
 	flag.BoolVar(
 		&verbose,
@@ -346,8 +1868,21 @@ func main() {
 	)
 	flag.Parse()
 
+	if *useSyslog {
+		setupSyslog(*syslogAddr, *syslogFacility, *syslogTag)
+	}
+
+	// SMTP credentials only come from the environment, to keep them out of ps
+	smtpUsername = os.Getenv("SIMPLEAUTH_SMTP_USERNAME")
+	smtpPassword = os.Getenv("SIMPLEAUTH_SMTP_PASSWORD")
+
 	// Set cookie name from environment variable or use default
 	cookieName = getEnvWithFallback("SIMPLEAUTH_COOKIE_NAME", DefaultCookieName)
+	for _, name := range strings.Split(os.Getenv("SIMPLEAUTH_OLD_COOKIE_NAMES"), ",") {
+		if name = strings.TrimSpace(name); name != "" && name != cookieName {
+			oldCookieNames = append(oldCookieNames, name)
+		}
+	}
 
 	// Parse lifespan duration
 	var err error
@@ -355,43 +1890,381 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid lifespan duration: %v", err)
 	}
+	if *maxLifespanStr != "" {
+		maxLifespan, err = time.ParseDuration(*maxLifespanStr)
+		if err != nil {
+			log.Fatalf("Invalid max lifespan duration: %v", err)
+		}
+		if lifespan > maxLifespan {
+			log.Printf("Warning: lifespan %v exceeds max lifespan %v; tokens will be issued for %v", lifespan, maxLifespan, maxLifespan)
+		}
+	}
 
 	// Load passwords from file or environment
-	usersEnv := os.Getenv("SIMPLEAUTH_USERS")
-	cryptedPasswords, err = getPasswords(*passwordPath, usersEnv)
+	passwdSeparator = parseSeparator(*passwdSeparatorStr)
+	// The key only comes from the environment or a file, to keep it out of ps
+	passwordIdentities, err = loadPasswordIdentities(*passwdKeyPath, os.Getenv("SIMPLEAUTH_PASSWD_KEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	provider, err := newSecretProvider(*secretProviderName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if provider != nil && *secretName == "" {
+		log.Fatal("-secret-name is required with -secret-provider")
+	}
+	if provider == nil && *usersSecretName != "" {
+		log.Fatal("-users-secret-name requires -secret-provider")
+	}
+	if !devMode && provider == nil && isFirstRun(*passwordPath, *secretPath) {
+		firstRunInstructions(os.Stderr, *passwordPath, *secretPath)
+		os.Exit(exitFirstRun)
+	}
+	usersEnv := usersEnvVar()
+	if *usersSecretName != "" {
+		cryptedPasswords, err = providerPasswords(provider, *usersSecretName)
+	} else {
+		cryptedPasswords, err = getPasswords(*passwordPath, usersEnv)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	totpSecrets, err = loadTOTPSecrets(totpPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if successCode != http.StatusOK && successCode != http.StatusNoContent {
+		log.Fatalf("Invalid success code %d: must be 200 or 204", successCode)
+	}
+	// A 2xx would have the proxy pass the request on, and the cookie would never reach the browser
+	if loginSuccessCode < 400 || loginSuccessCode > 599 || loginFailureCodes[loginSuccessCode] {
+		log.Fatalf("Invalid login success code %d: must be 400-599, and not one used for failures", loginSuccessCode)
+	}
+
+	defaultIdentityHeaders, ok := proxyModes[proxyMode]
+	if !ok {
+		log.Fatalf("Unknown mode %q, expected caddy, traefik, or nginx", proxyMode)
+	}
+	if *forwardedPreset == "" {
+		*forwardedPreset = proxyMode
+	}
+	if *identityHeadersStr == "" {
+		*identityHeadersStr = defaultIdentityHeaders
+	}
+	identityHeaders, err = parseIdentityHeaders(*identityHeadersStr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	forwardedHeaders, err = parseForwardedHeaders(*forwardedPreset, *forwardedOverrides)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *statsdAddr != "" {
+		statsd, err = newStatsdClient(*statsdAddr, *statsdPrefix)
+		if err != nil {
+			log.Fatalf("StatsD: %v", err)
+		}
+	}
+	if telemetryEnabled() {
+		if err := setupTelemetry(context.Background()); err != nil {
+			log.Fatalf("OpenTelemetry: %v", err)
+		}
+	}
+
+	switch breachMode {
+	case "off", "warn", "deny":
+	default:
+		log.Fatalf("Invalid breached passwords mode %q: must be off, warn, or deny", breachMode)
+	}
+
+	verifySlots = newVerifySlots(*maxVerifications)
+
+	if *tokenNotBeforeStr != "" {
+		tokenNotBefore, err = parseExpires(*tokenNotBeforeStr)
+		if err != nil {
+			log.Fatalf("Invalid token not-before time: %v", err)
+		}
+	}
+	if *revokeTokensBeforeStr != "" {
+		tokensRevokedBefore, err = parseExpires(*revokeTokensBeforeStr)
+		if err != nil {
+			log.Fatalf("Invalid token revocation time: %v", err)
+		}
+		if tokensRevokedBefore.After(time.Now()) {
+			log.Fatalf("Token revocation time %s is in the future: tokens issued until then would be rejected as soon as they're issued",
+				tokensRevokedBefore.Format(time.RFC3339))
+		}
+	}
+
+	if cspTemplate == "suggested" {
+		cspTemplate = suggestedCSP
+	}
+
+	requiredGroups = splitGroups(*requiredGroupsStr)
+	serviceAccounts, err = parseServiceAccounts(*serviceAccountsStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for addr, username := range serviceAccounts {
+		log.Printf("Service account username:%v for requests from %v", logName(username), addr)
+	}
+	factorLifespans, err = parseFactorLifespans(*factorLifespansStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *stepUpPathsStr != "" {
+		stepUpPaths = strings.Split(*stepUpPathsStr, ",")
+	}
+	if *mutationPathsStr != "" {
+		mutationPaths = strings.Split(*mutationPathsStr, ",")
+	}
+	mutationMethods = strings.Split(strings.ToUpper(strings.ReplaceAll(*mutationMethodsStr, " ", "")), ",")
+	if mutationTokenLifespan <= 0 {
+		log.Fatalf("Invalid mutation token lifespan %v: must be positive", mutationTokenLifespan)
+	}
+	if maxHeaderBytes <= 0 {
+		log.Fatalf("Invalid maximum header size %d: must be positive", maxHeaderBytes)
+	}
+	if *authPathsStr != "" {
+		authPaths = strings.Split(*authPathsStr, ",")
+	}
+	for _, host := range strings.Split(*logoutRedirectHostsStr, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			logoutRedirectHosts = append(logoutRedirectHosts, host)
+		}
+	}
+	if *policyPath != "" {
+		accessPolicy, err = loadAccessPolicy(*policyPath)
+		if err != nil {
+			log.Fatalf("Loading access policy: %v", err)
+		}
+	}
+
+	switch {
+	case *allowedUsersPath != "":
+		allowedUsers, err = loadAllowedUsers(*allowedUsersPath)
+		if err != nil {
+			log.Fatalf("Loading allowed users: %v", err)
+		}
+		log.Printf("Allowing %d users from %s", len(allowedUsers), *allowedUsersPath)
+	case *allowedUsersStr != "":
+		allowedUsers = parseAllowedUsers(*allowedUsersStr)
+	}
+
+	omitCookieAttributes, err = parseCookieOmit(*cookieOmit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := checkCookiePrefix(cookieName, omitCookieAttributes); err != nil {
+		log.Fatal(err)
+	}
+
+	if *trustedHeadersStr != "" {
+		trustedHeaders = make(map[string]bool)
+		for _, name := range strings.Split(*trustedHeadersStr, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				trustedHeaders[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+
+	if *loginRate > 0 {
+		loginThrottle = newUsernameThrottle(*loginRate, *loginBurst)
+	}
+	throttleExemptNets, err = parseNetworks(*throttleExemptStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustedProxies, err = parseNetworks(*trustedProxiesStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if (len(serviceAccounts) > 0 || len(throttleExemptNets) > 0) && len(trustedProxies) == 0 {
+		log.Println("No trusted proxies: service accounts and throttle exemptions go by the address connecting to simpleauth, not X-Real-IP")
+	}
+	if revealLoginFailures {
+		log.Printf("Warning: failed logins say whether the username exists; anyone can use that to find valid usernames")
+	}
+	if !slices.Contains(cookieSameSites, cookieSameSite) {
+		log.Fatalf("Unknown cookie SameSite %q, expected one of %s", cookieSameSite, strings.Join(cookieSameSites, ", "))
+	}
+	if !slices.Contains(uaBindings, uaBinding) {
+		log.Fatalf("Unknown User-Agent binding %q, expected one of %s", uaBinding, strings.Join(uaBindings, ", "))
+	}
+	if !slices.Contains(tokenBodyFormats, tokenBody) {
+		log.Fatalf("Unknown token body format %q, expected one of %s", tokenBody, strings.Join(tokenBodyFormats, ", "))
+	}
+	if *loginCooldownInterval > 0 {
+		loginCooldowns = newLoginCooldown(*loginCooldownInterval)
+	}
+
+	if *accessLogEnabled {
+		accessLog, err = newAccessLog(accessLogFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if loginPath != "" && !strings.HasPrefix(loginPath, "/") {
+		log.Fatalf("Login path must start with /: %q", loginPath)
+	}
+
+	backends = []backend{passwordBackend{}}
+	optionalBackends = make(map[string]bool)
+	for _, name := range strings.Split(*optionalBackendsStr, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			optionalBackends[name] = true
+		}
+	}
 
 	// Load HTML
-	loginHtml, err = ioutil.ReadFile(path.Join(*htmlPath, "login.html"))
+	html, err := loadLoginHtml(*htmlPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := setLoginHtml(html); err != nil {
+		log.Fatalf("Parsing login page: %v", err)
+	}
+	hostThemePaths, err := parseHostThemes(*hostThemesStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	themes, err := loadHostThemes(hostThemePaths)
+	if err != nil {
+		log.Fatalf("Loading host themes: %v", err)
+	}
+	setHostThemes(themes)
+	if err := checkBranding(); err != nil {
+		log.Fatal(err)
+	}
+	if *additionalAudiencesStr != "" {
+		if audience == "" {
+			log.Fatal("-additional-audiences needs -audience")
+		}
+		for _, aud := range strings.Split(*additionalAudiencesStr, ",") {
+			if aud = strings.TrimSpace(aud); aud != "" {
+				additionalAudiences = append(additionalAudiences, aud)
+			}
+		}
+	}
+	headRequests, err = parseHeadRequests(*headRequestsStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bannerNow, err := loadBanner(*bannerPath, *bannerText)
+	if err != nil {
+		log.Fatalf("Loading banner: %v", err)
+	}
+	setBanner(bannerNow)
+	if *successPath != "" {
+		successTemplate, err = loadSuccessHtml(*successPath)
+		if err != nil {
+			log.Fatalf("Loading success page: %v", err)
+		}
+	}
+	if *htmlRefreshStr != "" && isHtmlURL(*htmlPath) {
+		htmlRefresh, err := time.ParseDuration(*htmlRefreshStr)
+		if err != nil {
+			log.Fatalf("Invalid html refresh duration: %v", err)
+		}
+		go refreshLoginHtml(*htmlPath, htmlRefresh)
+	}
 
 	// Load secret from environment variable or file
-	secret, err = getSecret(*secretPath)
+	if secretLength < minSecretLength {
+		log.Fatalf("Secret length %d is too short: must be at least %d", secretLength, minSecretLength)
+	}
+	if provider != nil {
+		// No dev mode fallback: if the provider is set up, it should work
+		secret, err = providerSecret(provider, *secretName)
+	} else {
+		secret, verifySecrets, err = loadSecrets(*secretPath)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	if verbose {
 		log.Printf("Loaded %d users", len(cryptedPasswords))
-		if usersEnv != "" {
-			log.Println("Using environment variable for users")
+		if *usersSecretName != "" {
+			log.Printf("Using users from %s secret: %s", *secretProviderName, *usersSecretName)
+		} else if usersEnv != "" {
+			log.Printf("Using %s environment variable for users", usersEnv)
 		} else {
 			log.Printf("Using password file: %s", *passwordPath)
 		}
-		if os.Getenv("SIMPLEAUTH_SECRET") != "" {
+		if provider != nil {
+			log.Printf("Using %s secret: %s", *secretProviderName, *secretName)
+		} else if os.Getenv("SIMPLEAUTH_SECRET") != "" {
 			log.Println("Using SIMPLEAUTH_SECRET environment variable")
 		} else {
 			log.Printf("Using secret file: %s", *secretPath)
+			if len(verifySecrets) > 0 {
+				log.Printf("Accepting %d older secrets for verification", len(verifySecrets))
+			}
 		}
 	}
 
-	http.HandleFunc("/", rootHandler)
+	reloadOnSignal(configSources{
+		passwordPath: *passwordPath,
+		secretPath:   *secretPath,
+		htmlPath:     *htmlPath,
+		hostThemes:   hostThemePaths,
+		totpPath:     totpPath,
+
+		bannerPath:  *bannerPath,
+		bannerText:  *bannerText,
+		successPath: *successPath,
+
+		allowedUsersPath: *allowedUsersPath,
+
+		provider:        provider,
+		secretName:      *secretName,
+		usersSecretName: *usersSecretName,
+	})
+
+	http.HandleFunc("/", traced("auth", rootHandler))
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/favicon.ico", faviconHandler)
+	http.HandleFunc("/robots.txt", robotsHandler)
+	http.HandleFunc("/.well-known/simpleauth", discoveryHandler)
+	http.HandleFunc("/csrf", csrfHandler)
+	http.HandleFunc("/api/login", traced("login", apiLoginHandler))
+	http.HandleFunc("/validate", validateHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	if len(mutationPaths) > 0 {
+		http.HandleFunc("/mutation-token", mutationTokenHandler)
+	}
+	if totpPath != "" {
+		http.HandleFunc("/totp/enroll", totpEnrollHandler)
+	}
+	if adminToken != "" {
+		http.HandleFunc("/admin/users", requireAdmin(adminUsersHandler))
+	}
+
+	server := newServer(*listen, nil)
+
+	if *clientCA != "" {
+		if *tlsCert == "" {
+			log.Fatal("Client certificates need -tls-cert and -tls-key")
+		}
+		server.TLSConfig, err = clientCertTLSConfig(*clientCA)
+		if err != nil {
+			log.Fatalf("Loading client CA: %v", err)
+		}
+		clientCertUsers, err = parseClientCertUsers(*clientCertUsersStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	fmt.Println("listening on", *listen)
-	log.Fatal(http.ListenAndServe(*listen, nil))
+	if *tlsCert != "" {
+		log.Fatal(server.ListenAndServeTLS(*tlsCert, *tlsKey))
+	}
+	log.Fatal(server.ListenAndServe())
 }
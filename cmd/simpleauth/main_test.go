@@ -0,0 +1,1034 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+	"git.woozle.org/neale/simpleauth/web"
+	"github.com/GehirnInc/crypt"
+)
+
+const alicePassword = "wonderland"
+
+// hashPassword returns a crypt hash of password
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := crypt.SHA256.New().Generate([]byte(password), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// basicRequest returns a request with HTTP Basic credentials
+func basicRequest(username, password string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(username, password)
+	return req
+}
+
+// override sets *p to v for the duration of the test
+func override[V any](t *testing.T, p *V, v V) {
+	t.Helper()
+	old := *p
+	t.Cleanup(func() { *p = old })
+	*p = v
+}
+
+// testConfig sets up a minimal working configuration
+func testConfig(t *testing.T) {
+	t.Helper()
+	override(t, &secret, make([]byte, 64))
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hashPassword(t, alicePassword),
+	})
+	override(t, &loginTemplate, template.Must(parseLoginHtml([]byte("<html>login</html>"))))
+	override(t, &cookieName, DefaultCookieName)
+	override(t, &lifespan, time.Hour)
+	override(t, &verifySecrets, nil)
+	override(t, &backends, []backend{passwordBackend{}})
+	override(t, &retiredSecrets, nil)
+	override(t, &hostThemes, nil)
+	override(t, &totpSecrets, map[string]string{})
+	override(t, &pendingTOTP, map[string]pendingSecret{})
+	override(t, &refreshes.replaced, map[string]refreshed{})
+}
+
+// loginRequest returns a login-mode request with valid credentials for alice
+func loginRequest() *http.Request {
+	req := basicRequest("alice", alicePassword)
+	req.Header.Set("X-Simpleauth-Login", "true")
+	return req
+}
+
+// cookieToken returns the token in a Set-Cookie header
+func cookieToken(t *testing.T, cookie string) token.T {
+	t.Helper()
+	if !strings.HasPrefix(cookie, cookieName+"=") {
+		t.Fatalf("No auth cookie: %q", cookie)
+	}
+	value := strings.SplitN(strings.SplitN(cookie, ";", 2)[0], "=", 2)[1]
+	tok, err := token.ParseString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+// serve runs req through rootHandler
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	rootHandler(w, req)
+	return w
+}
+
+// requestWithToken returns a request carrying tok in the auth cookie
+func requestWithToken(tok token.T) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: tok.String()})
+	return req
+}
+
+func getHealth(t *testing.T) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var body map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return w, body
+}
+
+func failedList(body map[string]any) []string {
+	var out []string
+	if failed, ok := body["failed"].([]any); ok {
+		for _, f := range failed {
+			out = append(out, f.(string))
+		}
+	}
+	return out
+}
+
+func TestHealthHealthy(t *testing.T) {
+	testConfig(t)
+
+	w, body := getHealth(t)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "" {
+		t.Error("Retry-After set on healthy response")
+	}
+	if body["status"] != "healthy" {
+		t.Errorf("Wrong status in body: %v", body["status"])
+	}
+}
+
+func TestHealthMethodNotAllowed(t *testing.T) {
+	testConfig(t)
+
+	w := httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest(http.MethodPost, "/health", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET" {
+		t.Errorf("Wrong Allow header: %q", allow)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Wrong Content-Type: %q", ct)
+	}
+	var body map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["error"] != "method not allowed" {
+		t.Errorf("Wrong error: %v", body["error"])
+	}
+}
+
+func TestHealthLifespan(t *testing.T) {
+	testConfig(t)
+	lifespan = 36 * time.Hour
+
+	_, body := getHealth(t)
+	ls, ok := body["lifespan"].(map[string]any)
+	if !ok {
+		t.Fatalf("No lifespan in body: %v", body)
+	}
+	if ls["duration"] != "36h0m0s" {
+		t.Errorf("Wrong lifespan duration: %v", ls["duration"])
+	}
+	if ls["seconds"] != float64(36*60*60) {
+		t.Errorf("Wrong lifespan seconds: %v", ls["seconds"])
+	}
+}
+
+func TestHealthMissingUsers(t *testing.T) {
+	testConfig(t)
+	cryptedPasswords = map[string]string{}
+
+	w, body := getHealth(t)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("No Retry-After header")
+	}
+	if failed := failedList(body); len(failed) != 1 || failed[0] != "users" {
+		t.Errorf("Wrong failures: %v", failed)
+	}
+}
+
+func TestHealthMissingSecret(t *testing.T) {
+	testConfig(t)
+	secret = nil
+
+	w, body := getHealth(t)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("No Retry-After header")
+	}
+	if failed := failedList(body); len(failed) != 1 || failed[0] != "secret" {
+		t.Errorf("Wrong failures: %v", failed)
+	}
+}
+
+func TestClampLifespan(t *testing.T) {
+	testConfig(t)
+
+	if got := clampLifespan(48 * time.Hour); got != 48*time.Hour {
+		t.Errorf("Lifespan clamped with no cap: %v", got)
+	}
+
+	override(t, &maxLifespan, 24*time.Hour)
+	if got := clampLifespan(48 * time.Hour); got != 24*time.Hour {
+		t.Errorf("Lifespan not clamped: %v", got)
+	}
+	if got := clampLifespan(time.Hour); got != time.Hour {
+		t.Errorf("Short lifespan changed: %v", got)
+	}
+}
+
+func TestMaxLifespanRejectsOldToken(t *testing.T) {
+	testConfig(t)
+	tok := token.New(secret, "alice", time.Now().Add(48*time.Hour))
+
+	if username := usernameIfAuthenticated(requestWithToken(tok)); username != "alice" {
+		t.Errorf("Token rejected without cap: %q", username)
+	}
+
+	override(t, &maxLifespan, 24*time.Hour)
+	if username := usernameIfAuthenticated(requestWithToken(tok)); username != "" {
+		t.Errorf("Over-cap token accepted: %q", username)
+	}
+}
+
+func TestSecretDirectory(t *testing.T) {
+	testConfig(t)
+	t.Setenv("SIMPLEAUTH_SECRET", "")
+	dir := t.TempDir()
+
+	oldSecret := bytes.Repeat([]byte("o"), 64)
+	newSecret := bytes.Repeat([]byte("n"), 64)
+	now := time.Now()
+	for i, s := range [][]byte{oldSecret, newSecret} {
+		fn := filepath.Join(dir, fmt.Sprintf("key%d", i))
+		if err := os.WriteFile(fn, s, 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-2) * time.Hour)
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	primary, older, err := getSecrets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(primary, newSecret) {
+		t.Errorf("Newest secret not primary: %q", primary)
+	}
+	if len(older) != 1 || !bytes.Equal(older[0], oldSecret) {
+		t.Errorf("Wrong older secrets: %q", older)
+	}
+
+	override(t, &secret, primary)
+	override(t, &verifySecrets, older)
+	for _, s := range [][]byte{oldSecret, newSecret} {
+		tok := token.New(s, "alice", time.Now().Add(time.Hour))
+		if username := usernameIfAuthenticated(requestWithToken(tok)); username != "alice" {
+			t.Errorf("Token signed with %q rejected", s[:1])
+		}
+	}
+
+	tok := token.New(bytes.Repeat([]byte("x"), 64), "alice", time.Now().Add(time.Hour))
+	if username := usernameIfAuthenticated(requestWithToken(tok)); username != "" {
+		t.Error("Token signed with unknown secret accepted")
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	testConfig(t)
+	override(t, &loginDelay, 50*time.Millisecond)
+
+	start := time.Now()
+	w := serve(httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed < loginDelay {
+		t.Errorf("Login page served after only %v", elapsed)
+	}
+
+	tok := token.New(secret, "alice", time.Now().Add(time.Hour))
+	start = time.Now()
+	w = serve(requestWithToken(tok))
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed >= loginDelay {
+		t.Errorf("Authenticated request delayed %v", elapsed)
+	}
+}
+
+func TestAuthCookiePartitioned(t *testing.T) {
+	testConfig(t)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if cookie := authCookie(req, "tok", time.Hour); strings.Contains(cookie, "Partitioned") {
+		t.Errorf("Partitioned set when disabled: %s", cookie)
+	}
+
+	override(t, &cookiePartitioned, true)
+	cookie := authCookie(req, "tok", time.Hour)
+	if !strings.HasSuffix(cookie, "; Partitioned") {
+		t.Errorf("Partitioned missing: %s", cookie)
+	}
+	if !strings.Contains(cookie, "; Secure;") {
+		t.Errorf("Partitioned cookie not Secure: %s", cookie)
+	}
+}
+
+func TestAuthCookieOmit(t *testing.T) {
+	testConfig(t)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if cookie := authCookie(req, "tok", 0); cookie != DefaultCookieName+"=tok; Path=/; HttpOnly; Secure; SameSite=Strict" {
+		t.Errorf("Wrong default cookie: %s", cookie)
+	}
+
+	logged := new(bytes.Buffer)
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	omit, err := parseCookieOmit("httponly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &omitCookieAttributes, omit)
+	if cookie := authCookie(req, "tok", 0); cookie != DefaultCookieName+"=tok; Path=/; Secure; SameSite=Strict" {
+		t.Errorf("Wrong cookie without HttpOnly: %s", cookie)
+	}
+	if !strings.Contains(logged.String(), "Warning: omitting HttpOnly") {
+		t.Errorf("No warning logged: %q", logged)
+	}
+
+	if _, err := parseCookieOmit("Secure"); err == nil {
+		t.Error("Omitting Secure was accepted")
+	}
+}
+
+// parseSetCookie parses a Set-Cookie header value
+func parseSetCookie(t *testing.T, header string) *http.Cookie {
+	t.Helper()
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": {header}}}).Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Can't parse cookie: %q", header)
+	}
+	return cookies[0]
+}
+
+func TestAuthCookieAttributes(t *testing.T) {
+	testConfig(t)
+	override(t, &cookieSameSite, "Lax")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Simpleauth-Domain", "example.com")
+
+	w := httptest.NewRecorder()
+	setAuthCookie(w, req, "v2.tok", time.Hour)
+	c := parseSetCookie(t, w.Header().Get("Set-Cookie"))
+	want := http.Cookie{
+		Name:     DefaultCookieName,
+		Value:    "v2.tok",
+		Path:     "/",
+		Domain:   "example.com",
+		MaxAge:   3600,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if c.Name != want.Name || c.Value != want.Value || c.Path != want.Path || c.Domain != want.Domain ||
+		c.MaxAge != want.MaxAge || c.Secure != want.Secure || c.HttpOnly != want.HttpOnly || c.SameSite != want.SameSite {
+		t.Errorf("Wrong cookie: %q", w.Header().Get("Set-Cookie"))
+	}
+
+	// A bad domain from the proxy is left off, rather than sent
+	req.Header.Set("X-Simpleauth-Domain", "example.com; Secure=no")
+	if cookie := authCookie(req, "tok", 0); strings.Contains(cookie, "Domain") {
+		t.Errorf("Invalid domain sent: %q", cookie)
+	}
+
+	override(t, &cookiePartitioned, true)
+	w = httptest.NewRecorder()
+	setAuthCookie(w, req, "tok", 0)
+	if cookie := w.Header().Get("Set-Cookie"); !strings.HasSuffix(cookie, "; Partitioned") {
+		t.Errorf("Partitioned missing: %q", cookie)
+	}
+}
+
+func TestUntrustedHeadersStripped(t *testing.T) {
+	testConfig(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Simpleauth-Username", "admin")
+	req.Header.Set("X-Simpleauth-Domain", "example.com")
+	w := serve(req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status: %d", w.Code)
+	}
+	if username := w.Header().Get("X-Simpleauth-Username"); username != "" {
+		t.Errorf("Client-supplied username reflected: %q", username)
+	}
+	if req.Header.Get("X-Simpleauth-Username") != "" {
+		t.Error("Untrusted header not stripped")
+	}
+	if req.Header.Get("X-Simpleauth-Domain") != "example.com" {
+		t.Error("Trusted header stripped")
+	}
+}
+
+func TestTrustedHeaderList(t *testing.T) {
+	override(t, &trustedHeaders, map[string]bool{"X-Simpleauth-Totp": true, "X-Simpleauth-Domain": true})
+	if got, want := trustedHeaderList(), "X-Simpleauth-Domain,X-Simpleauth-Totp"; got != want {
+		t.Errorf("trustedHeaderList() = %q, want %q", got, want)
+	}
+}
+
+func TestPersistentCookie(t *testing.T) {
+	testConfig(t)
+
+	w := serve(loginRequest())
+	cookie := w.Header().Get("Set-Cookie")
+	if !strings.Contains(cookie, "; Max-Age=3600") {
+		t.Errorf("Persistent cookie missing Max-Age: %s", cookie)
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	testConfig(t)
+	override(t, &sessionCookie, true)
+
+	w := serve(loginRequest())
+	cookie := w.Header().Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, cookieName+"=") {
+		t.Fatalf("No auth cookie: %q", cookie)
+	}
+	if strings.Contains(cookie, "Max-Age") || strings.Contains(cookie, "Expires") {
+		t.Errorf("Session cookie has an expiry: %s", cookie)
+	}
+
+	// The token inside still expires
+	tok := cookieToken(t, cookie)
+	if !tok.ExpiresWithin(lifespan) || !tok.Valid(secret) {
+		t.Errorf("Token has wrong expiration: %v", tok.Expiration)
+	}
+}
+
+func TestParseUserLine(t *testing.T) {
+	cases := []struct {
+		line, sep      string
+		username, hash string
+		ok             bool
+	}{
+		{"alice:$5$salt$hash", ":", "alice", "$5$salt$hash", true},
+		{"Bob\t$5$salt$hash", "\t", "bob", "$5$salt$hash", true},
+		{"carol:$pbkdf2:with:colons", ":", "carol", "$pbkdf2:with:colons", true},
+		{"dave|$2y$10$hash", "|", "dave", "$2y$10$hash", true},
+		{"nohash", ":", "", "", false},
+		{"empty:", ":", "", "", false},
+		{"", ":", "", "", false},
+	}
+	for _, c := range cases {
+		username, hash, ok := parseUserLine(c.line, c.sep)
+		if username != c.username || hash != c.hash || ok != c.ok {
+			t.Errorf("parseUserLine(%q, %q) = %q, %q, %v", c.line, c.sep, username, hash, ok)
+		}
+	}
+}
+
+func TestPasswordFileSeparator(t *testing.T) {
+	override(t, &passwdSeparator, parseSeparator("tab"))
+	fn := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(fn, []byte("alice\t$5$a:b$c\nbob\t$5$d$e\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	passwords, err := getPasswords(fn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passwords["alice"] != "$5$a:b$c" || passwords["bob"] != "$5$d$e" {
+		t.Errorf("Wrong passwords: %v", passwords)
+	}
+}
+
+func TestStrictUsers(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(fn, []byte("# users\nalice:$5$a$b\n\nbogus line\nbob:$5$c$d\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	override(t, &strictUsers, true)
+	if _, err := getPasswords(fn, ""); err == nil {
+		t.Error("Strict mode accepted a malformed line")
+	} else if !strings.Contains(err.Error(), fn+":4") {
+		t.Errorf("Error doesn't say where: %v", err)
+	}
+
+	t.Setenv("SIMPLEAUTH_USERS", "alice:$5$a$b,bogus")
+	if _, err := getPasswords(fn, "SIMPLEAUTH_USERS"); err == nil {
+		t.Error("Strict mode accepted a malformed SIMPLEAUTH_USERS entry")
+	}
+}
+
+func TestMalformedUserLogging(t *testing.T) {
+	override(t, &passwdSeparator, parseSeparator("tab"))
+	override(t, &strictUsers, false)
+	buf := captureLog(t)
+
+	if _, err := readPasswords("passwd", strings.NewReader("alice:hunter2\ncarol\t\n")); err != nil {
+		t.Fatal(err)
+	}
+	logged := buf.String()
+	if strings.Contains(logged, "alice") || strings.Contains(logged, "hunter2") {
+		t.Errorf("Entry without a separator logged: %q", logged)
+	}
+	if !strings.Contains(logged, "passwd:1: invalid user format,") {
+		t.Errorf("Entry without a separator not reported: %q", logged)
+	}
+	if !strings.Contains(logged, `passwd:2: invalid user format for "carol"`) {
+		t.Errorf("Username not reported: %q", logged)
+	}
+}
+
+func TestLenientUsers(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(fn, []byte("alice:$5$a$b\nbogus line\nbob:$5$c$d\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	override(t, &strictUsers, false)
+	passwords, err := getPasswords(fn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 2 {
+		t.Errorf("Wrong users loaded: %v", passwords)
+	}
+	if !strings.Contains(buf.String(), "Warning: "+fn+":2") {
+		t.Errorf("No warning logged: %q", buf.String())
+	}
+}
+
+func TestDuplicateUsers(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(fn, []byte("alice:$5$a$b\nbob:$5$c$d\nAlice:$5$e$f\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	override(t, &strictUsers, false)
+	passwords, err := getPasswords(fn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passwords["alice"] != "$5$e$f" {
+		t.Errorf("Last entry didn't win: %v", passwords)
+	}
+	if !strings.Contains(buf.String(), `lines 1 and 3: duplicate username "alice"`) {
+		t.Errorf("Duplicate not reported: %q", buf.String())
+	}
+
+	strictUsers = true
+	if _, err := getPasswords(fn, ""); err == nil {
+		t.Error("Strict mode accepted a duplicate")
+	} else if !strings.Contains(err.Error(), `duplicate username "alice"`) {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestUsersPolicy(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(fn, []byte("alice:$5$file$alice\ncarol:$5$file$carol\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SIMPLEAUTH_USERS", "alice:$5$env$alice,bob:$5$env$bob")
+	t.Setenv("SIMPLEAUTH_USERS_JSON", "")
+	usersEnv := usersEnvVar()
+
+	passwords, err := getPasswords(fn, usersEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 2 || passwords["alice"] != "$5$env$alice" || passwords["bob"] != "$5$env$bob" {
+		t.Errorf("Override used the wrong users: %v", passwords)
+	}
+
+	override(t, &usersPolicy, "merge")
+	passwords, err = getPasswords(fn, usersEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 3 {
+		t.Errorf("Merge has wrong number of users: %v", passwords)
+	}
+	if passwords["alice"] != "$5$env$alice" {
+		t.Errorf("Overlapping user not taken from SIMPLEAUTH_USERS: %q", passwords["alice"])
+	}
+	if passwords["carol"] != "$5$file$carol" {
+		t.Errorf("File-only user missing: %q", passwords["carol"])
+	}
+
+	override(t, &usersPolicy, "bogus")
+	if _, err := getPasswords(fn, usersEnv); err == nil {
+		t.Error("Unknown policy accepted")
+	}
+}
+
+func TestSuccessCode(t *testing.T) {
+	testConfig(t)
+
+	w := serve(basicRequest("alice", alicePassword))
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("Default success: %d %q", w.Code, w.Body)
+	}
+
+	override(t, &successCode, http.StatusNoContent)
+	w = serve(basicRequest("alice", alicePassword))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Configured 204, got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("204 response has a body: %q", w.Body)
+	}
+}
+
+func TestRememberMe(t *testing.T) {
+	testConfig(t)
+	override(t, &rememberLifespan, 30*24*time.Hour)
+
+	req := loginRequest()
+	req.Header.Set("X-Simpleauth-Remember", "true")
+	cookie := serve(req).Header().Get("Set-Cookie")
+	if !strings.Contains(cookie, fmt.Sprintf("; Max-Age=%d", int(rememberLifespan.Seconds()))) {
+		t.Errorf("Remembered login didn't get a long-lived cookie: %s", cookie)
+	}
+	tok := cookieToken(t, cookie)
+	if !tok.ExpiresWithin(rememberLifespan) || tok.ExpiresWithin(lifespan) {
+		t.Errorf("Remembered token has wrong expiration: %v", tok.Expiration)
+	}
+
+	cookie = serve(loginRequest()).Header().Get("Set-Cookie")
+	if strings.Contains(cookie, "Max-Age") {
+		t.Errorf("Default login didn't get a session cookie: %s", cookie)
+	}
+	tok = cookieToken(t, cookie)
+	if !tok.ExpiresWithin(lifespan) {
+		t.Errorf("Default token has wrong expiration: %v", tok.Expiration)
+	}
+}
+
+func TestRememberMeDisabled(t *testing.T) {
+	testConfig(t)
+
+	req := loginRequest()
+	req.Header.Set("X-Simpleauth-Remember", "true")
+	tok := cookieToken(t, serve(req).Header().Get("Set-Cookie"))
+	if !tok.ExpiresWithin(lifespan) {
+		t.Errorf("Remember honored while disabled: %v", tok.Expiration)
+	}
+}
+
+// formRequest posts the login form
+func formRequest(target string, values url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestLoginFormGet(t *testing.T) {
+	testConfig(t)
+	override(t, &loginTemplate, template.Must(parseLoginHtml(web.LoginHTML)))
+
+	w := serve(httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET returned %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `<form method="post">`) {
+		t.Errorf("GET didn't render the form: %s", w.Body)
+	}
+}
+
+func TestLoginFormPost(t *testing.T) {
+	testConfig(t)
+
+	w := serve(formRequest("/private/?page=2", url.Values{
+		"forward-auth-username": {"alice"},
+		"forward-auth-password": {alicePassword},
+	}))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Good form POST returned %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "/private/?page=2" {
+		t.Errorf("Redirected to %q", loc)
+	}
+	cookieToken(t, w.Header().Get("Set-Cookie"))
+
+	w = serve(formRequest("/", url.Values{
+		"forward-auth-username": {"alice"},
+		"forward-auth-password": {"wrong"},
+	}))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Bad form POST returned %d", w.Code)
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Error("Cookie set for a bad password")
+	}
+}
+
+func TestLoginFormPostForwardAuth(t *testing.T) {
+	testConfig(t)
+
+	// A POST that isn't our form is still a forward-auth check
+	req := basicRequest("alice", alicePassword)
+	req.Method = http.MethodPost
+	if w := serve(req); w.Code != http.StatusOK {
+		t.Errorf("Forward-auth POST returned %d", w.Code)
+	}
+}
+
+func TestLoginFormCrossSite(t *testing.T) {
+	testConfig(t)
+	creds := url.Values{
+		"forward-auth-username": {"alice"},
+		"forward-auth-password": {alicePassword},
+	}
+
+	for _, headers := range []map[string]string{
+		{"Origin": "https://evil.example"},
+		{"Origin": "null"},
+		{"Sec-Fetch-Site": "cross-site"},
+		{"Sec-Fetch-Site": "same-site", "Origin": "http://example.com"},
+	} {
+		req := formRequest("/", creds)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := serve(req)
+		if w.Code != http.StatusForbidden || w.Header().Get("Set-Cookie") != "" {
+			t.Errorf("Form posted with %v returned %d", headers, w.Code)
+		}
+	}
+
+	req := formRequest("/", creds)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "example.com")
+	if w := serve(req); w.Code != http.StatusSeeOther {
+		t.Errorf("Same-origin form POST returned %d", w.Code)
+	}
+}
+
+func TestLoginFormRedirectOffsite(t *testing.T) {
+	testConfig(t)
+
+	for _, uri := range []string{"//evil.example/", "/\\evil.example/", "https://evil.example/"} {
+		req := formRequest("/", url.Values{
+			"forward-auth-username": {"alice"},
+			"forward-auth-password": {alicePassword},
+		})
+		req.Header.Set("X-Forwarded-Uri", uri)
+		w := serve(req)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("Form POST for %q returned %d", uri, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != "/" {
+			t.Errorf("Form POST for %q redirected to %q", uri, loc)
+		}
+	}
+}
+
+func TestSecretLength(t *testing.T) {
+	testConfig(t)
+	t.Setenv("SIMPLEAUTH_SECRET", "")
+	fn := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(fn, bytes.Repeat([]byte("s"), 40), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := getSecret(fn); err == nil {
+		t.Error("40-byte secret file accepted with the default length")
+	}
+
+	override(t, &secretLength, 32)
+	s, err := getSecret(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 32 {
+		t.Errorf("Secret is %d bytes, expected 32", len(s))
+	}
+
+	t.Setenv("SIMPLEAUTH_SECRET", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("e"), 16)))
+	if _, err := getSecret(fn); err == nil {
+		t.Error("16-byte SIMPLEAUTH_SECRET accepted with a length of 32")
+	}
+	t.Setenv("SIMPLEAUTH_SECRET", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("e"), 32)))
+	if s, err := getSecret(fn); err != nil || len(s) != 32 {
+		t.Errorf("32-byte SIMPLEAUTH_SECRET: %d bytes, %v", len(s), err)
+	}
+}
+
+func TestDevModeSecret(t *testing.T) {
+	testConfig(t)
+	t.Setenv("SIMPLEAUTH_SECRET", "")
+	missing := filepath.Join(t.TempDir(), "no-such-secret")
+
+	override(t, &devMode, false)
+	if _, _, err := loadSecrets(missing); err == nil {
+		t.Error("Started without a secret outside dev mode")
+	}
+
+	override(t, &devMode, true)
+	s, _, err := loadSecrets(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != secretLength || bytes.Equal(s, make([]byte, secretLength)) {
+		t.Errorf("Bad dev secret: %x", s)
+	}
+	if again, _, _ := loadSecrets(missing); bytes.Equal(s, again) {
+		t.Error("Dev secret isn't random")
+	}
+}
+
+func TestTokenNotBefore(t *testing.T) {
+	testConfig(t)
+	override(t, &tokenNotBefore, time.Now().Add(time.Hour))
+
+	tok := cookieToken(t, serve(loginRequest()).Header().Get("Set-Cookie"))
+	if tok.NotBefore == nil || !tok.NotBefore.Equal(tokenNotBefore) {
+		t.Fatalf("Wrong not-before time: %v", tok.NotBefore)
+	}
+	if w := serve(requestWithToken(tok)); w.Code == http.StatusOK {
+		t.Error("Token accepted before its not-before time")
+	}
+
+	// Once the time has passed, new tokens don't carry it
+	override(t, &tokenNotBefore, time.Now().Add(-time.Hour))
+	tok = cookieToken(t, serve(loginRequest()).Header().Get("Set-Cookie"))
+	if tok.NotBefore != nil {
+		t.Errorf("Past not-before time issued: %v", tok.NotBefore)
+	}
+	if w := serve(requestWithToken(tok)); w.Code != http.StatusOK {
+		t.Errorf("Token after not-before time returned %d", w.Code)
+	}
+}
+
+func TestLoginSuccessCode(t *testing.T) {
+	testConfig(t)
+	override(t, &loginSuccessCode, http.StatusConflict)
+	if err := setLoginHtml(web.LoginHTML); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(loginRequest())
+	if w.Code != http.StatusConflict {
+		t.Errorf("Login returned %d, wanted %d", w.Code, http.StatusConflict)
+	}
+	if tok := cookieToken(t, w.Header().Get("Set-Cookie")); tok.Username != "alice" {
+		t.Errorf("Wrong username in cookie: %q", tok.Username)
+	}
+	if !regexp.MustCompile(`let successCode = +409\b`).MatchString(w.Body.String()) {
+		t.Error("Login page not told about the success code")
+	}
+}
+
+func TestTrimPasswords(t *testing.T) {
+	testConfig(t)
+
+	if w := serve(basicRequest("alice", alicePassword+" ")); w.Code == http.StatusOK {
+		t.Error("Password with trailing space accepted without trimming")
+	}
+
+	override(t, &trimPasswords, true)
+	for _, password := range []string{alicePassword + " ", alicePassword + "\t\n", " " + alicePassword} {
+		if w := serve(basicRequest("alice", password)); w.Code != http.StatusOK {
+			t.Errorf("Password %q returned %d with trimming", password, w.Code)
+		}
+	}
+	if w := serve(basicRequest("alice", "wonder land")); w.Code == http.StatusOK {
+		t.Error("Inner whitespace trimmed")
+	}
+}
+
+func TestOldCookieNames(t *testing.T) {
+	testConfig(t)
+	override(t, &cookieName, "new-token")
+	override(t, &oldCookieNames, []string{"__Http-simpleauth-token"})
+
+	tok := token.New(secret, "alice", time.Now().Add(time.Hour))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "__Http-simpleauth-token", Value: tok.String()})
+	if w := serve(req); w.Code != http.StatusOK {
+		t.Errorf("Token in old-named cookie returned %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "some-other-token", Value: tok.String()})
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token in unlisted cookie returned %d", w.Code)
+	}
+
+	w := serve(loginRequest())
+	if cookie := w.Header().Get("Set-Cookie"); !strings.HasPrefix(cookie, "new-token=") {
+		t.Errorf("New cookie not set with the new name: %q", cookie)
+	}
+}
+
+func TestMaxTokenCookies(t *testing.T) {
+	testConfig(t)
+	override(t, &maxTokenCookies, 3)
+	override(t, &verbose, true)
+	logged := new(strings.Builder)
+	log.SetOutput(logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	good := token.New(secret, "alice", time.Now().Add(time.Hour))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 1000; i++ {
+		req.AddCookie(&http.Cookie{Name: cookieName, Value: "garbage"})
+	}
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: good.String()})
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token after the cap returned %d", w.Code)
+	}
+	if !strings.Contains(logged.String(), "more than 3 token cookies") {
+		t.Errorf("Cap not logged: %q", logged)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: "garbage"})
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: good.String()})
+	if w := serve(req); w.Code != http.StatusOK {
+		t.Errorf("Token within the cap returned %d", w.Code)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	testConfig(t)
+	override(t, &maxHeaderBytes, 8<<10)
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newServer("", http.HandlerFunc(rootHandler))
+	ts.Start()
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-Uri", "/"+strings.Repeat("a", 64<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Oversized header returned %d", resp.StatusCode)
+	}
+
+	req.Header.Set("X-Forwarded-Uri", "/private/")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Ordinary request returned %d", resp.StatusCode)
+	}
+}
+
+func TestEmptyUsernameToken(t *testing.T) {
+	testConfig(t)
+
+	tok := token.New(secret, "", time.Now().Add(time.Hour))
+	if username := usernameIfAuthenticated(requestWithToken(tok)); username != "" {
+		t.Errorf("Token with no username authenticated as %q", username)
+	}
+	if w := serve(requestWithToken(tok)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token with no username returned %d", w.Code)
+	}
+}
+
+func TestAuthPaths(t *testing.T) {
+	testConfig(t)
+	override(t, &authPaths, []string{"/auth/", "/verify"})
+	override(t, &loginPath, "/login")
+
+	for _, p := range []string{"/wp-admin/", "/healthz", "/verify/extra"} {
+		req := basicRequest("alice", alicePassword)
+		req.URL.Path = p
+		if w := serve(req); w.Code != http.StatusNotFound {
+			t.Errorf("%s returned %d", p, w.Code)
+		}
+	}
+	for _, p := range []string{"/auth/", "/auth/check", "/verify"} {
+		req := basicRequest("alice", alicePassword)
+		req.URL.Path = p
+		if w := serve(req); w.Code != http.StatusOK {
+			t.Errorf("%s returned %d", p, w.Code)
+		}
+	}
+
+	req := loginRequest()
+	req.URL.Path = "/login"
+	if w := serve(req); w.Code != loginSuccessCode {
+		t.Errorf("Login path returned %d", w.Code)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// Mutation tokens are short-lived tokens an app fetches from /mutation-token
+// and sends with requests that change things, in mutationTokenHeader.
+// They're bound to the session, so one can't be replayed with anybody else's cookie,
+// and a cross-site attacker, who can make the browser send the cookie, can't read one.
+const mutationTokenHeader = "X-Mutation-Token"
+
+// mutationPaths are paths where mutations need a mutation token, as path patterns.
+// No paths turns mutation tokens off.
+var mutationPaths []string
+
+// mutationMethods are the methods that count as mutations on mutationPaths
+var mutationMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// mutationTokenLifespan is how long a mutation token is good for
+var mutationTokenLifespan = 5 * time.Minute
+
+// mutationTokenRequired returns true if the original request described by req is a mutation on a mutation path.
+// Only requests authenticated by cookie need a token: see cookieSession.
+func mutationTokenRequired(req *http.Request) bool {
+	if len(mutationPaths) == 0 || !pathRequires(mutationPaths, forwardedURI(req)) {
+		return false
+	}
+	return slices.Contains(mutationMethods, strings.ToUpper(forwardedMethod(req)))
+}
+
+// cookieSession returns the session token req was authenticated with,
+// or false if it was authenticated some other way, which a cross-site attacker can't ride on.
+func cookieSession(req *http.Request) (token.T, bool) {
+	if _, _, ok := req.BasicAuth(); ok || clientCertUsername(req) != "" {
+		return token.T{}, false
+	}
+	t, ok := tokenFromCookies(req)
+	if !ok || !userAllowed(t.Username) {
+		return token.T{}, false
+	}
+	return t, true
+}
+
+// sessionStart returns when session began, or the zero time if it didn't record when.
+// Sliding sessions keep it, so mutation tokens survive the cookie being replaced.
+func sessionStart(session token.T) time.Time {
+	if session.IssuedAt == nil {
+		return time.Time{}
+	}
+	return *session.IssuedAt
+}
+
+// mutationMac returns the MAC binding a mutation token expiring at expires to a session
+func mutationMac(secret []byte, username string, issuedAt time.Time, expires int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("simpleauth-mutation\x00"))
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.FormatInt(issuedAt.UnixNano(), 10)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)
+}
+
+// newMutationToken returns a mutation token for session, and when it expires
+func newMutationToken(session token.T) (string, time.Time) {
+	secret, _ := currentSecrets()
+	expires := time.Now().Add(mutationTokenLifespan).Truncate(time.Second)
+	mac := mutationMac(secret, session.Username, sessionStart(session), expires.Unix())
+	return strconv.FormatInt(expires.Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(mac), expires
+}
+
+// mutationTokenValid returns true if req carries an unexpired mutation token for session
+func mutationTokenValid(req *http.Request, session token.T) bool {
+	presented := req.Header.Get(mutationTokenHeader)
+	if presented == "" {
+		debugf("mutation: no %s header", mutationTokenHeader)
+		return false
+	}
+	expiresStr, macStr, _ := strings.Cut(presented, ".")
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		debugf("mutation: malformed token")
+		return false
+	}
+	if time.Now().Unix() >= expires {
+		debugf("mutation: token expired")
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(macStr)
+	if err != nil {
+		debugf("mutation: malformed token")
+		return false
+	}
+	secret, verifySecrets := currentSecrets()
+	secrets := append([][]byte{secret}, verifySecrets...)
+	secrets = append(secrets, graceSecrets()...)
+	for _, s := range secrets {
+		if hmac.Equal(mac, mutationMac(s, session.Username, sessionStart(session), expires)) {
+			return true
+		}
+	}
+	debugf("mutation: token is for another session")
+	return false
+}
+
+// mutationTokenHandler issues a mutation token for the session making the request
+func mutationTokenHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	// Other ways of authenticating don't need mutation tokens,
+	// and answering Basic credentials here would sidestep login throttling
+	session, ok := cookieSession(req)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "not logged in")
+		return
+	}
+
+	mutationToken, expires := newMutationToken(session)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":   mutationToken,
+		"header":  mutationTokenHeader,
+		"expires": expires,
+	})
+}
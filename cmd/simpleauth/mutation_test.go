@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// fetchMutationToken gets a mutation token for the session carried by tok
+func fetchMutationToken(t *testing.T, tok token.T) string {
+	t.Helper()
+	req := requestWithToken(tok)
+	req.URL.Path = "/mutation-token"
+	w := httptest.NewRecorder()
+	mutationTokenHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Mutation token request returned %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Token  string `json:"token"`
+		Header string `json:"header"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header != mutationTokenHeader {
+		t.Errorf("Wrong header: %q", resp.Header)
+	}
+	return resp.Token
+}
+
+// mutationRequest returns a forward-auth request for method on uri, carrying tok and mutationToken
+func mutationRequest(tok token.T, method, uri, mutationToken string) *http.Request {
+	req := requestWithToken(tok)
+	req.Header.Set("X-Forwarded-Method", method)
+	req.Header.Set("X-Forwarded-Uri", uri)
+	if mutationToken != "" {
+		req.Header.Set(mutationTokenHeader, mutationToken)
+	}
+	return req
+}
+
+func TestMutationToken(t *testing.T) {
+	testConfig(t)
+	override(t, &mutationPaths, []string{"/api/"})
+	tok := issuedToken(time.Now().Add(-time.Minute))
+	mutationToken := fetchMutationToken(t, tok)
+
+	if w := serve(mutationRequest(tok, http.MethodPost, "/api/orders", mutationToken)); w.Code != http.StatusOK {
+		t.Errorf("Mutation with a mutation token returned %d", w.Code)
+	}
+	w := serve(mutationRequest(tok, http.MethodPost, "/api/orders", ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Mutation without a mutation token returned %d", w.Code)
+	}
+	if w := serve(mutationRequest(tok, http.MethodDelete, "/api/orders/1", "1.bogus")); w.Code != http.StatusForbidden {
+		t.Errorf("Mutation with a bogus mutation token returned %d", w.Code)
+	}
+	if w := serve(mutationRequest(tok, http.MethodGet, "/api/orders", "")); w.Code != http.StatusOK {
+		t.Errorf("Read without a mutation token returned %d", w.Code)
+	}
+	if w := serve(mutationRequest(tok, http.MethodPost, "/form", "")); w.Code != http.StatusOK {
+		t.Errorf("Mutation outside the mutation paths returned %d", w.Code)
+	}
+}
+
+func TestMutationTokenBoundToSession(t *testing.T) {
+	testConfig(t)
+	override(t, &mutationPaths, []string{"/api/"})
+	tok := issuedToken(time.Now().Add(-time.Minute))
+	mutationToken := fetchMutationToken(t, tok)
+
+	// Another login, even by the same user, is another session
+	other := issuedToken(time.Now().Add(-2 * time.Minute))
+	if w := serve(mutationRequest(other, http.MethodPost, "/api/orders", mutationToken)); w.Code != http.StatusForbidden {
+		t.Errorf("Mutation token for another session returned %d", w.Code)
+	}
+
+	// Sliding sessions replace the cookie, but keep the session
+	refreshed := tok
+	refreshed.Expiration = time.Now().Add(2 * time.Hour)
+	refreshed = refreshed.Sign(secret)
+	if w := serve(mutationRequest(refreshed, http.MethodPost, "/api/orders", mutationToken)); w.Code != http.StatusOK {
+		t.Errorf("Mutation token after the cookie was refreshed returned %d", w.Code)
+	}
+}
+
+func TestMutationTokenExpired(t *testing.T) {
+	testConfig(t)
+	override(t, &mutationPaths, []string{"/api/"})
+	tok := issuedToken(time.Now().Add(-time.Minute))
+
+	expires := time.Now().Add(-time.Second).Unix()
+	mac := mutationMac(secret, "alice", *tok.IssuedAt, expires)
+	expired := strconv.FormatInt(expires, 10) + "." + base64.RawURLEncoding.EncodeToString(mac)
+	if w := serve(mutationRequest(tok, http.MethodPost, "/api/orders", expired)); w.Code != http.StatusForbidden {
+		t.Errorf("Expired mutation token returned %d", w.Code)
+	}
+}
+
+func TestMutationTokenBasicAuth(t *testing.T) {
+	testConfig(t)
+	override(t, &mutationPaths, []string{"/api/"})
+
+	// Basic credentials aren't a session to fetch a token for, or need one
+	req := basicRequest("alice", alicePassword)
+	req.Header.Set("X-Forwarded-Method", http.MethodPost)
+	req.Header.Set("X-Forwarded-Uri", "/api/orders")
+	if w := serve(req); w.Code != http.StatusOK {
+		t.Errorf("Basic auth mutation returned %d", w.Code)
+	}
+
+	req = basicRequest("alice", alicePassword)
+	w := httptest.NewRecorder()
+	mutationTokenHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Mutation token for Basic credentials returned %d", w.Code)
+	}
+}
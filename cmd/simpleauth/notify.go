@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTP settings for new-device login notifications.
+// Notifications are off unless smtpAddr is set.
+var (
+	smtpAddr     string
+	smtpFrom     string
+	smtpDomain   string
+	smtpUsername string
+	smtpPassword string
+)
+
+// newDeviceWindow is how long a device stays known after a login from it
+var newDeviceWindow = 30 * 24 * time.Hour
+
+// deviceTracker remembers which devices each user has recently logged in from.
+// It's kept in memory, so every device is new again after a restart.
+type deviceTracker struct {
+	mu      sync.Mutex
+	devices map[string]map[string]time.Time
+}
+
+var knownDevices = &deviceTracker{devices: make(map[string]map[string]time.Time)}
+
+// deviceFingerprint identifies a client device by its address and user agent
+func deviceFingerprint(clientIP, userAgent string) string {
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	sum := sha256.Sum256([]byte(clientIP + "\n" + userAgent))
+	return hex.EncodeToString(sum[:16])
+}
+
+// seen records a login by username from fingerprint,
+// and returns true if that device had logged in within window.
+func (dt *deviceTracker) seen(username, fingerprint string, window time.Duration) bool {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	now := time.Now()
+	userDevices, ok := dt.devices[username]
+	if !ok {
+		userDevices = make(map[string]time.Time)
+		dt.devices[username] = userDevices
+	}
+	for fp, last := range userDevices {
+		if now.Sub(last) > window {
+			delete(userDevices, fp)
+		}
+	}
+	_, known := userDevices[fingerprint]
+	userDevices[fingerprint] = now
+	return known
+}
+
+// notificationAddress returns the email address for username, or "" if there isn't one
+func notificationAddress(username string) string {
+	if strings.Contains(username, "@") {
+		return username
+	}
+	if smtpDomain != "" {
+		return username + "@" + smtpDomain
+	}
+	return ""
+}
+
+// notifyLogin emails username if this login came from a device we haven't seen recently.
+// Mail is sent in the background; failures are only logged.
+func notifyLogin(username, clientIP, userAgent string) {
+	if smtpAddr == "" {
+		return
+	}
+	fingerprint := deviceFingerprint(clientIP, userAgent)
+	if knownDevices.seen(username, fingerprint, newDeviceWindow) {
+		debugf("login for username:%v from known device", logName(username))
+		return
+	}
+	to := notificationAddress(username)
+	if to == "" {
+		debugf("no email address for username:%v, not sending new device notification", logName(username))
+		return
+	}
+
+	go func() {
+		if err := sendLoginNotification(to, username, clientIP, userAgent, time.Now()); err != nil {
+			log.Printf("Sending new device notification for username:%v: %v", logName(username), err)
+		} else {
+			debugf("sent new device notification for username:%v", logName(username))
+		}
+	}()
+}
+
+// sendLoginNotification sends the new device email
+func sendLoginNotification(to, username, clientIP, userAgent string, when time.Time) error {
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		host, _, _ := net.SplitHostPort(smtpAddr)
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + smtpFrom,
+		"To: " + to,
+		"Subject: New sign-in for " + username,
+		"Date: " + when.Format(time.RFC1123Z),
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		fmt.Sprintf("There was a new sign-in to your account (%s).", username),
+		"",
+		"Time: " + when.Format(time.RFC1123),
+		"Address: " + clientIP,
+		"Browser: " + userAgent,
+		"",
+		"If this wasn't you, contact your administrator.",
+		"",
+	}, "\r\n")
+	return smtp.SendMail(smtpAddr, auth, smtpFrom, []string{to}, []byte(msg))
+}
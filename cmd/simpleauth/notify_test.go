@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockSMTP is just enough of an SMTP server to receive messages
+func mockSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+				reply("220 mock ESMTP")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(strings.TrimSpace(line))
+					switch {
+					case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+						reply("250 mock")
+					case strings.HasPrefix(cmd, "DATA"):
+						reply("354 go ahead")
+						var msg strings.Builder
+						for {
+							line, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if line == ".\r\n" {
+								break
+							}
+							msg.WriteString(line)
+						}
+						messages <- msg.String()
+						reply("250 queued")
+					case strings.HasPrefix(cmd, "QUIT"):
+						reply("221 bye")
+						return
+					default:
+						reply("250 ok")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func TestNewDeviceNotification(t *testing.T) {
+	testConfig(t)
+	addr, messages := mockSMTP(t)
+	override(t, &smtpAddr, addr)
+	override(t, &smtpFrom, "simpleauth@example.com")
+	override(t, &smtpDomain, "example.com")
+	override(t, &knownDevices, &deviceTracker{devices: make(map[string]map[string]time.Time)})
+
+	req := loginRequest()
+	req.Header.Set("User-Agent", "TestBrowser/1.0")
+	serve(req)
+
+	select {
+	case msg := <-messages:
+		if !strings.Contains(msg, "To: alice@example.com") {
+			t.Errorf("Wrong recipient: %s", msg)
+		}
+		if !strings.Contains(msg, "TestBrowser/1.0") {
+			t.Errorf("User agent not in message: %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No notification sent for new device")
+	}
+
+	// Same device again
+	req = loginRequest()
+	req.Header.Set("User-Agent", "TestBrowser/1.0")
+	serve(req)
+
+	select {
+	case msg := <-messages:
+		t.Errorf("Notification sent for known device: %s", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNewDeviceNotificationSpoofedAddress(t *testing.T) {
+	testConfig(t)
+	addr, messages := mockSMTP(t)
+	override(t, &smtpAddr, addr)
+	override(t, &smtpFrom, "simpleauth@example.com")
+	override(t, &smtpDomain, "example.com")
+	override(t, &knownDevices, &deviceTracker{devices: make(map[string]map[string]time.Time)})
+	override(t, &trustedProxies, nil)
+
+	req := loginRequest()
+	req.Header.Set("User-Agent", "TestBrowser/1.0")
+	req.Header.Set("X-Real-IP", "203.0.113.7")
+	serve(req)
+
+	select {
+	case msg := <-messages:
+		if strings.Contains(msg, "203.0.113.7") {
+			t.Errorf("Untrusted X-Real-IP in message: %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No notification sent for new device")
+	}
+
+	// Same device, claiming to be somewhere else
+	req = loginRequest()
+	req.Header.Set("User-Agent", "TestBrowser/1.0")
+	req.Header.Set("X-Real-IP", "198.51.100.9")
+	serve(req)
+
+	select {
+	case msg := <-messages:
+		t.Errorf("Notification sent for known device with a different X-Real-IP: %s", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
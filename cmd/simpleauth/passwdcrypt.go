@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// passwordIdentities decrypt an age-encrypted password file, or is empty if none were given
+var passwordIdentities []age.Identity
+
+// ageHeader starts every binary age file
+const ageHeader = "age-encryption.org/"
+
+// loadPasswordIdentities parses age identities from keyPath, or failing that from key.
+// It returns nil if neither is set.
+func loadPasswordIdentities(keyPath, key string) ([]age.Identity, error) {
+	if keyPath != "" {
+		f, err := os.Open(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		ids, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyPath, err)
+		}
+		return ids, nil
+	}
+	if key == "" {
+		return nil, nil
+	}
+	ids, err := age.ParseIdentities(strings.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("SIMPLEAUTH_PASSWD_KEY: %w", err)
+	}
+	return ids, nil
+}
+
+// passwordFileReader returns the contents of a password file, decrypting it if it's age-encrypted.
+// A plaintext file is read as-is, so turning on encryption doesn't have to happen all at once.
+func passwordFileReader(passwordPath string, f io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(f)
+	peek, _ := br.Peek(len(armor.Header))
+
+	var src io.Reader
+	switch {
+	case bytes.HasPrefix(peek, []byte(armor.Header)):
+		src = armor.NewReader(br)
+	case bytes.HasPrefix(peek, []byte(ageHeader)):
+		src = br
+	default:
+		return br, nil
+	}
+
+	if len(passwordIdentities) == 0 {
+		return nil, fmt.Errorf("%s is encrypted, but no key was given (SIMPLEAUTH_PASSWD_KEY or -passwd-key-file)", passwordPath)
+	}
+	r, err := age.Decrypt(src, passwordIdentities...)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", passwordPath, err)
+	}
+	return r, nil
+}
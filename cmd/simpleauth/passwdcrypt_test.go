@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// writeEncrypted writes plaintext to a new file, encrypted to recipient
+func writeEncrypted(t *testing.T, recipient age.Recipient, plaintext string, armored bool) string {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	var dst io.Writer = buf
+	var aw io.WriteCloser
+	if armored {
+		aw = armor.NewWriter(buf)
+		dst = aw
+	}
+	w, err := age.Encrypt(dst, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if aw != nil {
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "passwd.age")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptedPasswordFile(t *testing.T) {
+	testConfig(t)
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := loadPasswordIdentities("", id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &passwordIdentities, ids)
+
+	plaintext := "bob:" + hashPassword(t, "builder") + "\n"
+	for _, armored := range []bool{false, true} {
+		passwords, err := loadPasswordsFromFile(writeEncrypted(t, id.Recipient(), plaintext, armored))
+		if err != nil {
+			t.Fatalf("armored=%v: %v", armored, err)
+		}
+		override(t, &cryptedPasswords, passwords)
+		if err := checkPassword("bob", "builder"); err != nil {
+			t.Errorf("armored=%v: user from encrypted file rejected: %v", armored, err)
+		}
+	}
+}
+
+func TestEncryptedPasswordFileKeyFile(t *testing.T) {
+	testConfig(t)
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(keyPath, []byte("# test key\n"+id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := loadPasswordIdentities(keyPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &passwordIdentities, ids)
+
+	passwords, err := loadPasswordsFromFile(writeEncrypted(t, id.Recipient(), "bob:"+hashPassword(t, "builder")+"\n", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 1 {
+		t.Errorf("Wrong number of users: %d", len(passwords))
+	}
+}
+
+func TestEncryptedPasswordFileFailures(t *testing.T) {
+	testConfig(t)
+	id, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+	path := writeEncrypted(t, id.Recipient(), "bob:hash\n", false)
+
+	override(t, &passwordIdentities, nil)
+	if _, err := loadPasswordsFromFile(path); err == nil {
+		t.Error("Encrypted file loaded without a key")
+	}
+
+	override(t, &passwordIdentities, []age.Identity{other})
+	if _, err := loadPasswordsFromFile(path); err == nil {
+		t.Error("Encrypted file loaded with the wrong key")
+	}
+
+	if _, err := loadPasswordIdentities("", "not a key"); err == nil {
+		t.Error("Bad key accepted")
+	}
+}
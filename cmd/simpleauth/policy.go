@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"git.woozle.org/neale/simpleauth/pkg/acl"
+)
+
+// accessPolicy decides, by URL, method, and user, which requests are public,
+// which need authentication, and which are denied. It's nil if there's no policy.
+var accessPolicy *acl.ACL
+
+// loadAccessPolicy reads a policy file
+func loadAccessPolicy(policyPath string) (*acl.ACL, error) {
+	f, err := os.Open(policyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return acl.Read(f)
+}
+
+// policyAction returns what the access policy says about the original request, made by username.
+// An empty username is an anonymous request.
+// The policy sees the path decoded and cleaned, as pathMatches does,
+// so /docs/../admin/ is checked as /admin/; a path that can't be decoded that way is denied.
+func policyAction(req *http.Request, username string) acl.Action {
+	uri := forwardedURI(req)
+	p, ok := requestPath(uri)
+	if !ok {
+		debugf("policy: can't check forwarded URI %q", uri)
+		return acl.Deny
+	}
+	// Cleaning drops the trailing slash that rules like ^/docs/ look for
+	rawPath, query, _ := strings.Cut(uri, "?")
+	if strings.HasSuffix(rawPath, "/") && p != "/" {
+		p += "/"
+	}
+	u := &url.URL{
+		Scheme:   forwardedProto(req),
+		Host:     forwardedHost(req),
+		Path:     p,
+		RawQuery: query,
+	}
+	if username != "" {
+		u.User = url.User(username)
+	}
+	method := forwardedMethod(req)
+	if method == "" {
+		method = req.Method
+	}
+	return accessPolicy.Match(&http.Request{Method: method, URL: u})
+}
+
+// policyPublic returns true if the access policy lets anyone make the original request
+func policyPublic(req *http.Request) bool {
+	return accessPolicy != nil && policyAction(req, "") == acl.Public
+}
+
+// policyDenies returns true if the access policy doesn't let username make the original request
+func policyDenies(req *http.Request, username string) bool {
+	return accessPolicy != nil && policyAction(req, username) == acl.Deny
+}
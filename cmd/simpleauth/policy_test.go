@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `
+rules:
+  - url: ^https://app.example.com/docs/
+    methods: [GET, HEAD]
+    action: public
+  - url: ^https://app.example.com/admin/
+    users: [alice]
+    action: auth
+  - url: ^https://app.example.com/admin/
+    action: deny
+  - url: .
+    action: auth
+`
+
+// anonymous returns a request without credentials
+func anonymous() *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/", nil)
+}
+
+// policyRequest returns a request for the original method and URI
+func policyRequest(req *http.Request, method, uri string) *http.Request {
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set("X-Forwarded-Method", method)
+	req.Header.Set("X-Forwarded-Uri", uri)
+	return req
+}
+
+func TestAccessPolicy(t *testing.T) {
+	testConfig(t)
+	hash := hashPassword(t, alicePassword)
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hash,
+		"bob":   hash,
+	})
+	fn := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(fn, []byte(testPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadAccessPolicy(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &accessPolicy, policy)
+
+	cases := []struct {
+		name   string
+		req    *http.Request
+		method string
+		uri    string
+		code   int
+	}{
+		{"anonymous GET", anonymous(), http.MethodGet, "/docs/intro?page=2", http.StatusOK},
+		{"anonymous POST", anonymous(), http.MethodPost, "/docs/intro", http.StatusUnauthorized},
+		{"authenticated POST", basicRequest("bob", alicePassword), http.MethodPost, "/docs/intro", http.StatusOK},
+		{"anonymous elsewhere", anonymous(), http.MethodGet, "/", http.StatusUnauthorized},
+		{"alice in admin", basicRequest("alice", alicePassword), http.MethodGet, "/admin/", http.StatusOK},
+		{"bob in admin", basicRequest("bob", alicePassword), http.MethodGet, "/admin/", http.StatusForbidden},
+		{"anonymous traversal", anonymous(), http.MethodGet, "/docs/../admin/x", http.StatusUnauthorized},
+		{"anonymous encoded traversal", anonymous(), http.MethodGet, "/docs/%2e%2e/admin/x", http.StatusUnauthorized},
+		{"anonymous encoded slash", anonymous(), http.MethodGet, "/docs/%2E%2E%2Fadmin/x", http.StatusUnauthorized},
+		{"anonymous bad escape", anonymous(), http.MethodGet, "/docs/%zz", http.StatusUnauthorized},
+		{"bob traversal", basicRequest("bob", alicePassword), http.MethodGet, "/docs/../admin/x", http.StatusForbidden},
+		{"bob encoded slash", basicRequest("bob", alicePassword), http.MethodGet, "/docs/%2E%2E%2Fadmin/x", http.StatusForbidden},
+		{"anonymous encoded docs", anonymous(), http.MethodGet, "/%64ocs/intro", http.StatusOK},
+	}
+	for _, c := range cases {
+		if w := serve(policyRequest(c.req, c.method, c.uri)); w.Code != c.code {
+			t.Errorf("%s: got %d, wanted %d", c.name, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// proxyMode is the reverse proxy in front of simpleauth: caddy, traefik, or nginx.
+// It picks defaults suited to that proxy's forward-auth conventions.
+var proxyMode = "caddy"
+
+// proxyModes are the supported proxies, with their default identity headers
+var proxyModes = map[string]string{
+	"caddy": "",
+	// Traefik copies these to the upstream request, if they're listed in authResponseHeaders
+	"traefik": "X-Simpleauth-Username=username,X-Simpleauth-Groups=groups",
+	"nginx":   "",
+}
+
+// identityHeaders are set on a successful forward-auth response, for the proxy to pass upstream.
+// Each maps a header name to what it carries: "username" or "groups".
+var identityHeaders = map[string]string{}
+
+// parseIdentityHeaders parses "Header-Name=field,..."
+func parseIdentityHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, field, _ := strings.Cut(pair, "=")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		field = strings.ToLower(strings.TrimSpace(field))
+		if name == "" || (field != "username" && field != "groups") {
+			return nil, fmt.Errorf("invalid response header %q, expected Header-Name=username or Header-Name=groups", pair)
+		}
+		headers[name] = field
+	}
+	return headers, nil
+}
+
+// setIdentityHeaders describes username in the configured identity headers
+func setIdentityHeaders(w http.ResponseWriter, username string) {
+	for name, field := range identityHeaders {
+		switch field {
+		case "username":
+			w.Header().Set(name, username)
+		case "groups":
+			if groups := userGroups(username); len(groups) > 0 {
+				w.Header().Set(name, strings.Join(groups, ","))
+			}
+		}
+	}
+}
+
+// isSubrequest returns true if req is an nginx auth_request subrequest.
+// nginx discards the body of these, so there's no point rendering the login page.
+// The location doing auth_request must set the forwarded URI header, which nginx doesn't send on its own.
+func isSubrequest(req *http.Request) bool {
+	return proxyMode == "nginx" && forwardedURI(req) != ""
+}
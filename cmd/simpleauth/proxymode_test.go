@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// traefikRequest is a forwardAuth subrequest, as Traefik sends it
+func traefikRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Method", "GET")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "private.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/reports/")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	return req
+}
+
+func traefikConfig(t *testing.T) {
+	testConfig(t)
+	headers, err := parseIdentityHeaders(proxyModes["traefik"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &proxyMode, "traefik")
+	override(t, &identityHeaders, headers)
+	override(t, &forwardedHeaders, forwardedPresets["traefik"])
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hashPassword(t, alicePassword) + " groups=admin,dev",
+	})
+}
+
+func TestTraefikAllow(t *testing.T) {
+	traefikConfig(t)
+
+	secret, _ := currentSecrets()
+	req := traefikRequest()
+	req.AddCookie(&http.Cookie{
+		Name:  cookieName,
+		Value: token.New(secret, "alice", time.Now().Add(time.Hour)).String(),
+	})
+	w := serve(req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Allowed request returned %d", w.Code)
+	}
+	if got := w.Header().Get("X-Simpleauth-Username"); got != "alice" {
+		t.Errorf("Wrong username header: %q", got)
+	}
+	if got := w.Header().Get("X-Simpleauth-Groups"); got != "admin,dev" {
+		t.Errorf("Wrong groups header: %q", got)
+	}
+}
+
+func TestTraefikDeny(t *testing.T) {
+	traefikConfig(t)
+
+	w := serve(traefikRequest())
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Denied request returned %d", w.Code)
+	}
+	if w.Body.Len() == 0 {
+		t.Error("No login page for Traefik to show the client")
+	}
+	if got := w.Header().Get("X-Simpleauth-Groups"); got != "" {
+		t.Errorf("Groups header on a denied request: %q", got)
+	}
+}
+
+func TestParseIdentityHeaders(t *testing.T) {
+	headers, err := parseIdentityHeaders("remote-user=username, Remote-Groups=groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers["Remote-User"] != "username" || headers["Remote-Groups"] != "groups" {
+		t.Errorf("Wrong headers: %v", headers)
+	}
+	if _, err := parseIdentityHeaders("Remote-Email=email"); err == nil {
+		t.Error("Unknown field accepted")
+	}
+}
+
+// nginxRequest is an auth_request subrequest, from a location that sets X-Original-URI
+func nginxRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Original-URI", "/reports/")
+	req.Header.Set("X-Original-Method", "GET")
+	return req
+}
+
+func nginxConfig(t *testing.T) {
+	testConfig(t)
+	override(t, &proxyMode, "nginx")
+	override(t, &forwardedHeaders, forwardedPresets["nginx"])
+}
+
+func TestNginxSubrequestLean(t *testing.T) {
+	nginxConfig(t)
+
+	w := serve(nginxRequest())
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Denied subrequest returned %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Denied subrequest has a body: %q", w.Body)
+	}
+
+	req := nginxRequest()
+	req.SetBasicAuth("alice", alicePassword)
+	w = serve(req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Allowed subrequest returned %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Allowed subrequest has a body: %q", w.Body)
+	}
+	if got := w.Header().Get("X-Simpleauth-Username"); got != "alice" {
+		t.Errorf("Wrong username header: %q", got)
+	}
+}
+
+func TestNginxLoginPage(t *testing.T) {
+	nginxConfig(t)
+
+	// error_page fetches the login page without the subrequest headers
+	w := serve(httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Login page returned %d", w.Code)
+	}
+	if w.Body.Len() == 0 {
+		t.Error("Login page has no body")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/secrets"
+)
+
+// configLock guards secret, verifySecrets, retiredSecrets, cryptedPasswords, totpSecrets,
+// allowedUsers, and successTemplate, which may be reloaded on SIGHUP
+var configLock sync.RWMutex
+
+// secretGrace is how long a secret replaced by a reload is still accepted for verification,
+// so that requests in flight during a rotation still verify.
+// It is short by default, since a secret is often rotated because it leaked;
+// a longer grace, to keep people logged in across a rotation, is opt-in.
+var secretGrace = 5 * time.Minute
+
+// retiredSecret is a secret replaced by a reload, accepted for verification until a deadline
+type retiredSecret struct {
+	secret []byte
+	until  time.Time
+}
+
+// retiredSecrets are secrets replaced by reloads, still in their grace period
+var retiredSecrets []retiredSecret
+
+// currentUsers returns the loaded password entries
+func currentUsers() map[string]string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return cryptedPasswords
+}
+
+// currentSecrets returns the signing secret, and older secrets accepted for verification
+func currentSecrets() ([]byte, [][]byte) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return secret, verifySecrets
+}
+
+// graceSecrets returns secrets replaced by a reload which are still in their grace period
+func graceSecrets() [][]byte {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	now := time.Now()
+	secrets := [][]byte{}
+	for _, r := range retiredSecrets {
+		if now.Before(r.until) {
+			secrets = append(secrets, r.secret)
+		}
+	}
+	return secrets
+}
+
+// retireSecret keeps old around for the grace period if replacement differs,
+// and forgets secrets whose grace has run out.
+// The caller must hold configLock.
+func retireSecret(old, replacement []byte) {
+	now := time.Now()
+	kept := []retiredSecret{}
+	for _, r := range retiredSecrets {
+		if now.Before(r.until) {
+			kept = append(kept, r)
+		}
+	}
+	if len(old) > 0 && !bytes.Equal(old, replacement) && secretGrace > 0 {
+		kept = append(kept, retiredSecret{old, now.Add(secretGrace)})
+	}
+	retiredSecrets = kept
+}
+
+// configSources says where to load configuration from
+type configSources struct {
+	passwordPath string
+	secretPath   string
+	htmlPath     string
+	hostThemes   map[string]string
+	totpPath     string
+
+	// bannerPath and successPath are the -banner-file and -success-html files, if any,
+	// and bannerText is the -banner to fall back on
+	bannerPath  string
+	bannerText  string
+	successPath string
+
+	// allowedUsersPath is the -allowed-users-file, if any
+	allowedUsersPath string
+
+	// provider, if set, is where secretName and usersSecretName are fetched from,
+	// instead of secretPath and passwordPath
+	provider        secrets.Provider
+	secretName      string
+	usersSecretName string
+}
+
+// reloadConfig loads users, secret, login pages, banner, and allowed users from src.
+// Nothing is replaced unless everything loads.
+func reloadConfig(src configSources) error {
+	var passwords map[string]string
+	var err error
+	if src.usersSecretName != "" {
+		passwords, err = providerPasswords(src.provider, src.usersSecretName)
+	} else {
+		passwords, err = getPasswords(src.passwordPath, usersEnvVar())
+	}
+	if err != nil {
+		return err
+	}
+	var newSecret []byte
+	var newVerifySecrets [][]byte
+	if src.provider != nil {
+		newSecret, err = providerSecret(src.provider, src.secretName)
+	} else {
+		newSecret, newVerifySecrets, err = getSecrets(src.secretPath)
+	}
+	if err != nil && devMode {
+		// Keep the made-up secret, so nobody gets logged out
+		newSecret, newVerifySecrets = currentSecrets()
+	} else if err != nil {
+		return err
+	}
+	html, err := loadLoginHtml(src.htmlPath)
+	if err != nil {
+		return err
+	}
+	if _, err := parseLoginHtml(html); err != nil {
+		return err
+	}
+	themes, err := loadHostThemes(src.hostThemes)
+	if err != nil {
+		return err
+	}
+	enrolled, err := loadTOTPSecrets(src.totpPath)
+	if err != nil {
+		return err
+	}
+	bannerNow, err := loadBanner(src.bannerPath, src.bannerText)
+	if err != nil {
+		return err
+	}
+	var success *template.Template
+	if src.successPath != "" {
+		if success, err = loadSuccessHtml(src.successPath); err != nil {
+			return err
+		}
+	}
+	var allowed map[string]bool
+	if src.allowedUsersPath != "" {
+		if allowed, err = loadAllowedUsers(src.allowedUsersPath); err != nil {
+			return err
+		}
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	cryptedPasswords = passwords
+	totpSecrets = enrolled
+	retireSecret(secret, newSecret)
+	secret, verifySecrets = newSecret, newVerifySecrets
+	if src.successPath != "" {
+		successTemplate = success
+	}
+	if src.allowedUsersPath != "" {
+		allowedUsers = allowed
+	}
+	setBanner(bannerNow)
+	setHostThemes(themes)
+	return setLoginHtml(html)
+}
+
+// reloadOnSignal reloads the configuration from src whenever we get SIGHUP.
+// If reloading fails, the old configuration stays in effect.
+// The returned function stops listening for the signal.
+func reloadOnSignal(src configSources) (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := reloadConfig(src); err != nil {
+				log.Printf("Reload failed, keeping the old configuration: %v", err)
+				continue
+			}
+			log.Printf("Reloaded configuration: %d users", len(currentUsers()))
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(c)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// reloadSources returns configSources in a temporary directory,
+// with users as the password file and a login page.
+// The secret file is secretByte repeated, or is left out if secretByte is 0.
+func reloadSources(t *testing.T, users string, secretByte byte) configSources {
+	t.Helper()
+	testConfig(t)
+	override(t, &usersPolicy, "override")
+	t.Setenv("SIMPLEAUTH_USERS", "")
+	t.Setenv("SIMPLEAUTH_SECRET", "")
+
+	dir := t.TempDir()
+	src := configSources{
+		passwordPath: filepath.Join(dir, "passwd"),
+		secretPath:   filepath.Join(dir, "secret"),
+		htmlPath:     dir,
+	}
+	if err := os.WriteFile(src.passwordPath, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "login.html"), []byte("<html>login</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if secretByte != 0 {
+		if err := os.WriteFile(src.secretPath, bytes.Repeat([]byte{secretByte}, 64), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	src := reloadSources(t, "bob:"+hashPassword(t, "builder")+"\n", 's')
+
+	stop := reloadOnSignal(src)
+	defer stop()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for serve(basicRequest("bob", "builder")).Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("Reloaded user never took effect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w := serve(basicRequest("alice", alicePassword)); w.Code == http.StatusOK {
+		t.Error("Old user still accepted after reload")
+	}
+	if s, _ := currentSecrets(); !bytes.Equal(s, bytes.Repeat([]byte{'s'}, 64)) {
+		t.Error("Secret not reloaded")
+	}
+}
+
+func TestReloadKeepsOldOnError(t *testing.T) {
+	src := reloadSources(t, "bob:"+hashPassword(t, "builder")+"\n", 0)
+
+	if err := reloadConfig(src); err == nil {
+		t.Fatal("Reload with a missing secret succeeded")
+	}
+	if w := serve(basicRequest("alice", alicePassword)); w.Code != http.StatusOK {
+		t.Errorf("Old user rejected after failed reload: %d", w.Code)
+	}
+	if w := serve(basicRequest("bob", "builder")); w.Code == http.StatusOK {
+		t.Error("New user accepted after failed reload")
+	}
+}
+
+func TestReloadSecretGrace(t *testing.T) {
+	src := reloadSources(t, "alice:"+hashPassword(t, alicePassword)+"\n", 'n')
+
+	oldToken := token.New(secret, "alice", time.Now().Add(time.Hour))
+	if err := reloadConfig(src); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(requestWithToken(oldToken)); w.Code != http.StatusOK {
+		t.Errorf("Token from before the reload rejected during grace period: %d", w.Code)
+	}
+
+	// Once the grace period is over, the old secret stops working
+	retiredSecrets[0].until = time.Now().Add(-time.Second)
+	if w := serve(requestWithToken(oldToken)); w.Code == http.StatusOK {
+		t.Error("Token from before the reload accepted after grace period")
+	}
+	// Reloading again forgets it entirely
+	if err := reloadConfig(src); err != nil {
+		t.Fatal(err)
+	}
+	if len(retiredSecrets) != 0 {
+		t.Errorf("Expired secrets kept: %d", len(retiredSecrets))
+	}
+}
+
+func TestReloadSecretNoGrace(t *testing.T) {
+	src := reloadSources(t, "alice:"+hashPassword(t, alicePassword)+"\n", 'n')
+	override(t, &secretGrace, 0)
+
+	oldToken := token.New(secret, "alice", time.Now().Add(time.Hour))
+	if err := reloadConfig(src); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(requestWithToken(oldToken)); w.Code == http.StatusOK {
+		t.Error("Token from before the reload accepted with no grace period")
+	}
+}
+
+func TestReloadBanner(t *testing.T) {
+	src := reloadSources(t, "alice:"+hashPassword(t, alicePassword)+"\n", 'n')
+	override(t, &banner, "")
+	src.bannerPath = filepath.Join(t.TempDir(), "banner")
+	if err := os.WriteFile(src.bannerPath, []byte("Down for maintenance\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloadConfig(src); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentBanner(); got != "Down for maintenance" {
+		t.Errorf("Banner not reloaded: %q", got)
+	}
+
+	// A banner that can't be read keeps the old configuration
+	os.Remove(src.bannerPath)
+	if err := reloadConfig(src); err == nil {
+		t.Error("Reload with a missing banner file succeeded")
+	}
+	if got := currentBanner(); got != "Down for maintenance" {
+		t.Errorf("Banner changed by a failed reload: %q", got)
+	}
+}
+
+func TestReloadSuccessPage(t *testing.T) {
+	src := reloadSources(t, "alice:"+hashPassword(t, alicePassword)+"\n", 'n')
+	override(t, &successTemplate, nil)
+	src.successPath = filepath.Join(t.TempDir(), "success.html")
+	if err := os.WriteFile(src.successPath, []byte("<html>welcome back</html>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloadConfig(src); err != nil {
+		t.Fatal(err)
+	}
+	if body := serve(loginRequest()).Body.String(); body != "<html>welcome back</html>" {
+		t.Errorf("Success page not reloaded: %q", body)
+	}
+}
+
+func TestReloadAllowedUsers(t *testing.T) {
+	src := reloadSources(t, "alice:"+hashPassword(t, alicePassword)+"\nbob:"+hashPassword(t, "builder")+"\n", 'n')
+	override(t, &allowedUsers, parseAllowedUsers("alice"))
+	src.allowedUsersPath = filepath.Join(t.TempDir(), "allowed")
+	if err := os.WriteFile(src.allowedUsersPath, []byte("bob\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloadConfig(src); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(basicRequest("bob", "builder")); w.Code != http.StatusOK {
+		t.Errorf("User added to the allowlist returned %d", w.Code)
+	}
+	if w := serve(basicRequest("alice", alicePassword)); w.Code == http.StatusOK {
+		t.Error("User removed from the allowlist authenticated")
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// tokensRevokedBefore, if set, revokes every token issued before it,
+// logging everybody out at once without changing the secret.
+// Sliding sessions keep when the user logged in, so refreshing doesn't escape it.
+var tokensRevokedBefore time.Time
+
+// checkRevoked returns nil unless t was issued before tokensRevokedBefore.
+// Tokens that don't record when they were issued are revoked too.
+func checkRevoked(t token.T) error {
+	if tokensRevokedBefore.IsZero() || !t.IssuedBefore(tokensRevokedBefore) {
+		return nil
+	}
+	return fmt.Errorf("%w: issued before %s", token.ErrRevoked, tokensRevokedBefore.Format(time.RFC3339))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+func TestRevokeTokensBefore(t *testing.T) {
+	testConfig(t)
+
+	before := time.Now().Add(-time.Hour)
+	old := token.T{Username: "alice", Expiration: time.Now().Add(time.Hour), IssuedAt: &before}.Sign(secret)
+	if w := serve(requestWithToken(old)); w.Code != http.StatusOK {
+		t.Fatalf("Token returned %d before any revocation", w.Code)
+	}
+
+	override(t, &tokensRevokedBefore, time.Now().Add(-time.Minute))
+	if w := serve(requestWithToken(old)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token issued before the cutoff returned %d", w.Code)
+	}
+	undated := token.New(secret, "alice", time.Now().Add(time.Hour))
+	if w := serve(requestWithToken(undated)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token without an issue time returned %d", w.Code)
+	}
+	if err := checkToken(old); err == nil || tokenReason(err) != token.ErrRevoked.Error() {
+		t.Errorf("Revoked token reason: %v", err)
+	}
+
+	// Logging in again gets a token that works
+	w := serve(loginRequest())
+	if w.Code != loginSuccessCode {
+		t.Fatalf("Login returned %d", w.Code)
+	}
+	fresh := cookieToken(t, w.Header().Get("Set-Cookie"))
+	if w := serve(requestWithToken(fresh)); w.Code != http.StatusOK {
+		t.Errorf("Token issued after the cutoff returned %d", w.Code)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// cookieSameSite is the SameSite attribute of the auth cookie: Strict, Lax, or None.
+// None lets the cookie go along with cross-site requests, for embedding in other sites.
+var cookieSameSite = "Strict"
+
+// cookieSameSites are the allowed values for cookieSameSite
+var cookieSameSites = []string{"Strict", "Lax", "None"}
+
+// sameSiteCompat leaves SameSite off for browsers known to mishandle SameSite=None
+var sameSiteCompat bool
+
+// User-Agent patterns for browsers that can't handle SameSite=None.
+// These follow the workaround documented at https://www.chromium.org/updates/same-site/incompatible-clients
+var (
+	uaIOSRE             = regexp.MustCompile(`\(iP.+; CPU .*OS (\d+)[_\d]*.*\) AppleWebKit/`)
+	uaMacOSRE           = regexp.MustCompile(`\(Macintosh;.*Mac OS X (\d+)_(\d+)[_\d]*.*\) AppleWebKit/`)
+	uaSafariRE          = regexp.MustCompile(`Version/.* Safari/`)
+	uaMacEmbeddedRE     = regexp.MustCompile(`^Mozilla/[\.\d]+ \(Macintosh;.*Mac OS X [_\d]+\) AppleWebKit/[\.\d]+ \(KHTML, like Gecko\)$`)
+	uaChromiumRE        = regexp.MustCompile(`Chrom(e|ium)`)
+	uaChromiumVersionRE = regexp.MustCompile(`Chrom[^ /]+/(\d+)[\.\d]* `)
+	uaUCBrowserRE       = regexp.MustCompile(`UCBrowser/`)
+	uaUCVersionRE       = regexp.MustCompile(`UCBrowser/(\d+)\.(\d+)\.(\d+)[\.\d]* `)
+)
+
+// sameSiteNoneIncompatible returns true if the browser sending ua mishandles SameSite=None.
+//
+// iOS 12, and Safari on macOS 10.14, treat it as Strict.
+// Chrome 51 through 66, and older UC Browser, drop the cookie altogether.
+func sameSiteNoneIncompatible(ua string) bool {
+	return webKitSameSiteBug(ua) || dropsUnrecognizedSameSite(ua)
+}
+
+// webKitSameSiteBug returns true for WebKit versions that treat SameSite=None as Strict
+func webKitSameSiteBug(ua string) bool {
+	if m := uaIOSRE.FindStringSubmatch(ua); m != nil && m[1] == "12" {
+		return true
+	}
+	m := uaMacOSRE.FindStringSubmatch(ua)
+	if m == nil || m[1] != "10" || m[2] != "14" {
+		return false
+	}
+	safari := uaSafariRE.MatchString(ua) && !uaChromiumRE.MatchString(ua)
+	return safari || uaMacEmbeddedRE.MatchString(ua)
+}
+
+// dropsUnrecognizedSameSite returns true for browsers that reject cookies with SameSite=None
+func dropsUnrecognizedSameSite(ua string) bool {
+	if uaUCBrowserRE.MatchString(ua) {
+		return !versionAtLeast(uaUCVersionRE.FindStringSubmatch(ua), 12, 13, 2)
+	}
+	if !uaChromiumRE.MatchString(ua) {
+		return false
+	}
+	m := uaChromiumVersionRE.FindStringSubmatch(ua)
+	return versionAtLeast(m, 51) && !versionAtLeast(m, 67)
+}
+
+// versionAtLeast returns true if the version numbers captured in m are at least want.
+// A missing version is never at least anything.
+func versionAtLeast(m []string, want ...int) bool {
+	if len(m) < len(want)+1 {
+		return false
+	}
+	for i, w := range want {
+		n, _ := strconv.Atoi(m[i+1])
+		if n != w {
+			return n > w
+		}
+	}
+	return true
+}
+
+// sameSiteModes maps cookieSameSite values to what net/http calls them
+var sameSiteModes = map[string]http.SameSite{
+	"Strict": http.SameSiteStrictMode,
+	"Lax":    http.SameSiteLaxMode,
+	"None":   http.SameSiteNoneMode,
+}
+
+// sameSiteMode returns the SameSite mode for the auth cookie sent to req,
+// or 0 to leave the attribute off
+func sameSiteMode(req *http.Request) http.SameSite {
+	if omitCookieAttributes["SameSite"] {
+		return 0
+	}
+	if cookieSameSite == "None" && sameSiteCompat && sameSiteNoneIncompatible(req.UserAgent()) {
+		debugf("leaving SameSite off for User-Agent %q", req.UserAgent())
+		return 0
+	}
+	return sameSiteModes[cookieSameSite]
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	uaIOS12       = "Mozilla/5.0 (iPhone; CPU iPhone OS 12_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/12.1.2 Mobile/15E148 Safari/604.1"
+	uaSafariMojav = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/12.1.2 Safari/605.1.15"
+	uaChrome60    = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/60.0.3112.113 Safari/537.36"
+	uaUCOld       = "Mozilla/5.0 (Linux; U; Android 8.0.0; en-US; Pixel Build/OPR3.170623.007) AppleWebKit/534.30 (KHTML, like Gecko) Version/4.0 UCBrowser/12.10.8.1172 U3/0.8.0 Mobile Safari/534.30"
+	uaIOS13       = "Mozilla/5.0 (iPhone; CPU iPhone OS 13_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0.4 Mobile/15E148 Safari/604.1"
+	uaChromeMojav = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	uaChrome120   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	uaUCNew       = "Mozilla/5.0 (Linux; U; Android 9; en-US; Pixel Build/PQ3A.190801.002) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/57.0.2987.108 UCBrowser/12.13.2.1208 Mobile Safari/537.36"
+)
+
+func TestSameSiteNoneIncompatible(t *testing.T) {
+	for _, ua := range []string{uaIOS12, uaSafariMojav, uaChrome60, uaUCOld} {
+		if !sameSiteNoneIncompatible(ua) {
+			t.Errorf("Not flagged as incompatible: %s", ua)
+		}
+	}
+	for _, ua := range []string{uaIOS13, uaChromeMojav, uaChrome120, uaUCNew, "curl/8.0.1", ""} {
+		if sameSiteNoneIncompatible(ua) {
+			t.Errorf("Flagged as incompatible: %s", ua)
+		}
+	}
+}
+
+// sameSiteCookie returns the auth cookie sent to a browser identifying as ua
+func sameSiteCookie(ua string) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", ua)
+	return authCookie(req, "token", 0)
+}
+
+func TestSameSiteCompat(t *testing.T) {
+	testConfig(t)
+	override(t, &cookieSameSite, "None")
+	override(t, &sameSiteCompat, true)
+
+	if cookie := sameSiteCookie(uaIOS12); strings.Contains(cookie, "SameSite") {
+		t.Errorf("Broken browser got SameSite: %q", cookie)
+	}
+	if cookie := sameSiteCookie(uaChrome120); !strings.Contains(cookie, "; SameSite=None") {
+		t.Errorf("Modern browser didn't get SameSite=None: %q", cookie)
+	}
+
+	override(t, &sameSiteCompat, false)
+	if cookie := sameSiteCookie(uaIOS12); !strings.Contains(cookie, "; SameSite=None") {
+		t.Errorf("SameSite adjusted without compat: %q", cookie)
+	}
+}
+
+func TestSameSiteCompatOnlyNone(t *testing.T) {
+	testConfig(t)
+	override(t, &sameSiteCompat, true)
+
+	for _, sameSite := range []string{"Strict", "Lax"} {
+		override(t, &cookieSameSite, sameSite)
+		if cookie := sameSiteCookie(uaIOS12); !strings.Contains(cookie, "; SameSite="+sameSite) {
+			t.Errorf("SameSite=%s adjusted: %q", sameSite, cookie)
+		}
+	}
+}
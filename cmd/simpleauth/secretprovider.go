@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/secrets"
+)
+
+// secretProviders makes a provider for each -secret-provider name.
+// Each is configured by its own standard environment variables.
+var secretProviders = map[string]func() (secrets.Provider, error){
+	"vault": func() (secrets.Provider, error) { return secrets.NewVaultFromEnv() },
+	"aws":   func() (secrets.Provider, error) { return secrets.NewAWSFromEnv() },
+}
+
+// secretProviderTimeout limits how long fetching from a secret provider can take
+var secretProviderTimeout = 10 * time.Second
+
+// newSecretProvider returns the secret provider called name, or nil if name is empty
+func newSecretProvider(name string) (secrets.Provider, error) {
+	if name == "" {
+		return nil, nil
+	}
+	newProvider, ok := secretProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown secret provider %q", name)
+	}
+	p, err := newProvider()
+	if err != nil {
+		return nil, fmt.Errorf("secret provider %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// fetchSecret fetches the secret called name from p
+func fetchSecret(p secrets.Provider, name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretProviderTimeout)
+	defer cancel()
+	return p.Fetch(ctx, name)
+}
+
+// providerSecret fetches the signing secret from p.
+// It's base64, like SIMPLEAUTH_SECRET.
+func providerSecret(p secrets.Provider, name string) ([]byte, error) {
+	value, err := fetchSecret(p, name)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(value)))
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %w", name, err)
+	}
+	if len(decoded) < secretLength {
+		return nil, fmt.Errorf("secret %s must be at least %d bytes (got %d)", name, secretLength, len(decoded))
+	}
+	return decoded[:secretLength], nil
+}
+
+// providerPasswords fetches users from p, in the same format as the password file
+func providerPasswords(p secrets.Provider, name string) (map[string]string, error) {
+	value, err := fetchSecret(p, name)
+	if err != nil {
+		return nil, err
+	}
+	return readPasswords(name, bytes.NewReader(value))
+}
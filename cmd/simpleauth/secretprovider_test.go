@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.woozle.org/neale/simpleauth/pkg/secrets"
+)
+
+// mockProvider serves secrets from a map
+type mockProvider map[string]string
+
+func (m mockProvider) Fetch(ctx context.Context, name string) ([]byte, error) {
+	value, ok := m[name]
+	if !ok {
+		return nil, fmt.Errorf("no secret %s", name)
+	}
+	return []byte(value), nil
+}
+
+// providerTestSecret is a valid 64-byte secret
+var providerTestSecret = bytes.Repeat([]byte{'p'}, 64)
+
+func TestProviderSecret(t *testing.T) {
+	testConfig(t)
+	p := mockProvider{
+		"simpleauth": base64.StdEncoding.EncodeToString(providerTestSecret) + "\n",
+		"short":      base64.StdEncoding.EncodeToString([]byte("too short")),
+		"garbage":    "not base64!",
+	}
+
+	got, err := providerSecret(p, "simpleauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, providerTestSecret) {
+		t.Errorf("Wrong secret: %q", got)
+	}
+
+	for _, name := range []string{"short", "garbage", "missing"} {
+		if _, err := providerSecret(p, name); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestProviderPasswords(t *testing.T) {
+	testConfig(t)
+	p := mockProvider{"users": "# from the provider\nbob:" + hashPassword(t, "builder") + "\n"}
+
+	passwords, err := providerPasswords(p, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &cryptedPasswords, passwords)
+	if w := serve(basicRequest("bob", "builder")); w.Code != http.StatusOK {
+		t.Errorf("Provider user login returned %d", w.Code)
+	}
+}
+
+func TestNewSecretProvider(t *testing.T) {
+	override(t, &secretProviders, map[string]func() (secrets.Provider, error){
+		"mock":   func() (secrets.Provider, error) { return mockProvider{}, nil },
+		"broken": func() (secrets.Provider, error) { return nil, fmt.Errorf("not configured") },
+	})
+
+	if p, err := newSecretProvider(""); p != nil || err != nil {
+		t.Errorf("No provider returned %v, %v", p, err)
+	}
+	if p, err := newSecretProvider("mock"); p == nil || err != nil {
+		t.Errorf("Mock provider returned %v, %v", p, err)
+	}
+	for _, name := range []string{"broken", "nope"} {
+		if _, err := newSecretProvider(name); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestReloadFromProvider(t *testing.T) {
+	testConfig(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "login.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := configSources{
+		passwordPath: filepath.Join(dir, "missing"),
+		secretPath:   filepath.Join(dir, "missing"),
+		htmlPath:     dir,
+		provider: mockProvider{
+			"simpleauth": base64.StdEncoding.EncodeToString(providerTestSecret),
+			"users":      "bob:" + hashPassword(t, "builder"),
+		},
+		secretName:      "simpleauth",
+		usersSecretName: "users",
+	}
+
+	if err := reloadConfig(src); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := currentSecrets(); !bytes.Equal(s, providerTestSecret) {
+		t.Error("Secret not fetched from provider")
+	}
+	if w := serve(basicRequest("bob", "builder")); w.Code != http.StatusOK {
+		t.Errorf("Provider user login returned %d", w.Code)
+	}
+
+	src.secretName = "missing"
+	if err := reloadConfig(src); err == nil {
+		t.Error("No error when the provider fails")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// serviceAccounts maps trusted source addresses to service-account usernames.
+// Requests from these addresses are authenticated as the service account, without credentials.
+// It's empty unless configured.
+var serviceAccounts map[netip.Addr]string
+
+// parseServiceAccounts parses "address=username,address=username".
+// Addresses must be single IPs: ranges would be too easy to get wrong.
+func parseServiceAccounts(s string) (map[netip.Addr]string, error) {
+	accounts := make(map[netip.Addr]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		addr, username, ok := strings.Cut(pair, "=")
+		username = strings.ToLower(strings.TrimSpace(username))
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid service account %q, expected 'address=username'", pair)
+		}
+		ip, err := netip.ParseAddr(strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid service account %q: %w", pair, err)
+		}
+		accounts[ip.Unmap()] = username
+	}
+	return accounts, nil
+}
+
+// serviceAccount returns the service account for the client address of req, or "" if there isn't one.
+// The address must match exactly, and only comes from the proxy's headers if it's a trusted proxy.
+func serviceAccount(req *http.Request) string {
+	if len(serviceAccounts) == 0 {
+		return ""
+	}
+	ip, ok := trustedClientIP(req)
+	if !ok {
+		return ""
+	}
+	return serviceAccounts[ip]
+}
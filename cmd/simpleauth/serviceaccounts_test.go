@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// requestFrom returns a login request, with no credentials, that the proxy says came from addr.
+// The request itself comes from 192.0.2.1, which tests trust as a proxy.
+func requestFrom(addr string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Simpleauth-Login", "true")
+	req.Header.Set("X-Real-IP", addr)
+	return req
+}
+
+func TestParseServiceAccounts(t *testing.T) {
+	accounts, err := parseServiceAccounts("10.0.0.5=Backup, ::ffff:10.0.0.6=ci,2001:db8::1=mon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 3 {
+		t.Errorf("Wrong number of accounts: %v", accounts)
+	}
+	for _, bad := range []string{"10.0.0.0/8=everyone", "10.0.0.5", "10.0.0.5=", "host.example.com=bot"} {
+		if _, err := parseServiceAccounts(bad); err == nil {
+			t.Errorf("Accepted %q", bad)
+		}
+	}
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	testConfig(t)
+	accounts, _ := parseServiceAccounts("10.0.0.5=backup,10.0.0.6=ci")
+	override(t, &serviceAccounts, accounts)
+	override(t, &trustedProxies, []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")})
+
+	w := serve(requestFrom("10.0.0.5"))
+	if w.Code != loginSuccessCode {
+		t.Fatalf("Mapped address returned %d", w.Code)
+	}
+	if tok := cookieToken(t, w.Header().Get("Set-Cookie")); tok.Username != "backup" {
+		t.Errorf("Token for the wrong user: %q", tok.Username)
+	}
+
+	for _, addr := range []string{"10.0.0.7", "10.0.0.50", "10.0.0.5x", ""} {
+		w := serve(requestFrom(addr))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Unmapped address %q returned %d", addr, w.Code)
+		}
+		if cookie := w.Header().Get("Set-Cookie"); cookie != "" {
+			t.Errorf("Unmapped address %q got a cookie: %q", addr, cookie)
+		}
+	}
+}
+
+func TestServiceAccountSpoofed(t *testing.T) {
+	testConfig(t)
+	accounts, _ := parseServiceAccounts("10.0.0.5=backup")
+	override(t, &serviceAccounts, accounts)
+
+	// Without trusted proxies, anyone could claim to be 10.0.0.5
+	for _, proxies := range [][]netip.Prefix{nil, {netip.MustParsePrefix("198.51.100.0/24")}} {
+		override(t, &trustedProxies, proxies)
+		req := requestFrom("10.0.0.5")
+		req.Header.Set("X-Forwarded-For", "10.0.0.5")
+		w := serve(req)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("Set-Cookie") != "" {
+			t.Errorf("Spoofed address with trusted proxies %v returned %d", proxies, w.Code)
+		}
+	}
+
+	// A request really from the address works without any proxy
+	req := requestFrom("")
+	req.RemoteAddr = "10.0.0.5:4321"
+	if w := serve(req); w.Code != loginSuccessCode {
+		t.Errorf("Direct request from the address returned %d", w.Code)
+	}
+}
+
+func TestServiceAccountOff(t *testing.T) {
+	testConfig(t)
+
+	if w := serve(requestFrom("10.0.0.5")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Request without credentials returned %d", w.Code)
+	}
+}
+
+func TestServiceAccountCredentialsFirst(t *testing.T) {
+	testConfig(t)
+	accounts, _ := parseServiceAccounts("192.0.2.1=backup")
+	override(t, &serviceAccounts, accounts)
+
+	// httptest requests come from 192.0.2.1
+	w := serve(loginRequest())
+	if tok := cookieToken(t, w.Header().Get("Set-Cookie")); tok.Username != "alice" {
+		t.Errorf("Credentials ignored for service account address: %q", tok.Username)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// slidingSessions reissues the token cookie on every authenticated request,
+// so people stay logged in for as long as they keep using it, up to maxSessionAge
+var slidingSessions bool
+
+// maxSessionAge is how long after logging in a sliding session ends, however active it is
+var maxSessionAge = 30 * 24 * time.Hour
+
+// refreshWindow is how long a reissued token is handed out again to requests still carrying the one it replaced.
+// Browsers send several requests at once, and without this each would get a different new token.
+var refreshWindow = 10 * time.Second
+
+// refreshed is a token issued to replace another
+type refreshed struct {
+	token       token.T
+	refreshedAt time.Time
+	persistent  bool
+}
+
+// refreshes remembers recently reissued tokens, keyed by the MAC of the token they replaced
+var refreshes = struct {
+	sync.Mutex
+	replaced map[string]refreshed
+}{replaced: map[string]refreshed{}}
+
+// sessionLimit returns when a sliding session that logged in at authenticatedAt ends,
+// or the zero time if it doesn't: sliding sessions are off, or the login time isn't known.
+func sessionLimit(authenticatedAt time.Time) time.Time {
+	if !slidingSessions || authenticatedAt.IsZero() {
+		return time.Time{}
+	}
+	return authenticatedAt.Add(maxSessionAge)
+}
+
+// sessionExpired returns true if a sliding session that logged in at authenticatedAt is over,
+// whatever its token says
+func sessionExpired(authenticatedAt time.Time) bool {
+	limit := sessionLimit(authenticatedAt)
+	return !limit.IsZero() && !time.Now().Before(limit)
+}
+
+// slideSession reissues the token cookie in req, pushing its expiration out
+// by as long as it lasted at login, but no further than maxSessionAge after login.
+// Tokens from before IssuedAt was recorded aren't reissued, since their age is unknown.
+func slideSession(w http.ResponseWriter, req *http.Request) {
+	if !slidingSessions {
+		return
+	}
+	if _, _, ok := req.BasicAuth(); ok {
+		return
+	}
+	if clientCertUsername(req) != "" {
+		return
+	}
+	t, ok := tokenFromCookies(req)
+	if !ok || t.IssuedAt == nil {
+		return
+	}
+
+	r, ok := refreshSession(t)
+	if !ok {
+		return
+	}
+	cookieMaxAge := time.Until(r.token.Expiration)
+	if !r.persistent {
+		cookieMaxAge = 0
+	}
+	debugf("extending session for username:%v until %v", logName(t.Username), r.token.Expiration)
+	setAuthCookie(w, req, r.token.String(), cookieMaxAge)
+}
+
+// refreshSession returns a replacement for t, or false if t can't be extended any further.
+// Within refreshWindow, every request carrying t gets the same replacement.
+func refreshSession(t token.T) (refreshed, bool) {
+	key := hex.EncodeToString(t.Mac)
+	now := time.Now()
+
+	refreshes.Lock()
+	defer refreshes.Unlock()
+	if r, ok := refreshes.replaced[key]; ok && now.Sub(r.refreshedAt) < refreshWindow {
+		return r, true
+	}
+
+	// Reissued tokens keep the login time, so the lifespan can't be worked out from it
+	span := t.Lifespan
+	if span <= 0 {
+		// Issued before tokens recorded their lifespan
+		span = clampLifespan(lifespan)
+	}
+	expiration := now.Add(span)
+	if limit := t.IssuedAt.Add(maxSessionAge); expiration.After(limit) {
+		expiration = limit
+	}
+	if !expiration.After(t.Expiration) {
+		debugf("session for username:%v has reached its maximum age", logName(t.Username))
+		return refreshed{}, false
+	}
+
+	secret, _ := currentSecrets()
+	issued := *t.IssuedAt
+	r := refreshed{
+		token: token.T{
+			Username:   t.Username,
+			Groups:     userGroups(t.Username),
+			Expiration: expiration,
+			IssuedAt:   &issued,
+			Lifespan:   span,
+			UserAgent:  t.UserAgent,
+			Audience:   t.Audience,
+		}.Sign(secret),
+		refreshedAt: now,
+		// Only logins that asked to be remembered get a persistent cookie
+		persistent: !sessionCookie,
+	}
+	if rememberLifespan > 0 {
+		r.persistent = span >= clampLifespan(rememberLifespan)
+	}
+
+	if refreshWindow > 0 {
+		for k, old := range refreshes.replaced {
+			if now.Sub(old.refreshedAt) >= refreshWindow {
+				delete(refreshes.replaced, k)
+			}
+		}
+		refreshes.replaced[key] = r
+	}
+	return r, true
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// sessionToken returns a token for alice, issued at issued, expiring at expiration
+func sessionToken(issued, expiration time.Time) token.T {
+	return token.T{
+		Username:   "alice",
+		Expiration: expiration,
+		IssuedAt:   &issued,
+		Lifespan:   expiration.Sub(issued),
+	}.Sign(secret)
+}
+
+// slide makes an authenticated request with tok, and returns the reissued token, if any
+func slide(t *testing.T, tok token.T) (token.T, bool) {
+	t.Helper()
+	w := serve(requestWithToken(tok))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Request returned %d", w.Code)
+	}
+	cookie := w.Header().Get("Set-Cookie")
+	if cookie == "" {
+		return token.T{}, false
+	}
+	return cookieToken(t, cookie), true
+}
+
+func TestSlidingSession(t *testing.T) {
+	testConfig(t)
+	override(t, &slidingSessions, true)
+
+	issued := time.Now().Add(-30 * time.Minute)
+	reissued, ok := slide(t, sessionToken(issued, issued.Add(time.Hour)))
+	if !ok {
+		t.Fatal("Token not reissued")
+	}
+	if d := time.Until(reissued.Expiration); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("Expiration not extended by the lifespan: expires in %v", d)
+	}
+	if reissued.IssuedAt == nil || !reissued.IssuedAt.Equal(issued) {
+		t.Errorf("Login time changed: %v, wanted %v", reissued.IssuedAt, issued)
+	}
+	if reissued.Username != "alice" {
+		t.Errorf("Wrong username: %q", reissued.Username)
+	}
+}
+
+func TestSlidingSessionRepeated(t *testing.T) {
+	testConfig(t)
+	override(t, &slidingSessions, true)
+	override(t, &refreshWindow, 0)
+	override(t, &rememberLifespan, 30*24*time.Hour)
+
+	// An active session stays an hour from expiring, and a session cookie, however often it slides
+	issued := time.Now().Add(-3 * time.Hour)
+	tok := sessionToken(issued, time.Now().Add(10*time.Minute))
+	tok.Lifespan = time.Hour
+	tok = tok.Sign(secret)
+	for i := 0; i < 5; i++ {
+		w := serve(requestWithToken(tok))
+		cookie := w.Header().Get("Set-Cookie")
+		if cookie == "" {
+			t.Fatalf("Slide %d: token not reissued", i)
+		}
+		if strings.Contains(cookie, "Max-Age") || strings.Contains(cookie, "Expires") {
+			t.Errorf("Slide %d: session cookie became persistent: %s", i, cookie)
+		}
+		tok = cookieToken(t, cookie)
+		if d := time.Until(tok.Expiration); d > time.Hour {
+			t.Fatalf("Slide %d: expires in %v, more than the lifespan", i, d)
+		}
+		if tok.Lifespan != time.Hour {
+			t.Errorf("Slide %d: lifespan changed to %v", i, tok.Lifespan)
+		}
+	}
+}
+
+func TestSlidingSessionLegacyToken(t *testing.T) {
+	testConfig(t)
+	override(t, &slidingSessions, true)
+
+	// Without a recorded lifespan, the configured one is used, not the session's age
+	issued := time.Now().Add(-20 * time.Hour)
+	legacy := token.T{Username: "alice", Expiration: time.Now().Add(time.Minute), IssuedAt: &issued}.Sign(secret)
+	reissued, ok := slide(t, legacy)
+	if !ok {
+		t.Fatal("Token not reissued")
+	}
+	if d := time.Until(reissued.Expiration); d > lifespan {
+		t.Errorf("Legacy token extended by %v, more than the lifespan", d)
+	}
+}
+
+func TestSlidingSessionMaxAge(t *testing.T) {
+	testConfig(t)
+	override(t, &slidingSessions, true)
+	override(t, &maxSessionAge, 2*time.Hour)
+
+	issued := time.Now().Add(-100 * time.Minute)
+	reissued, ok := slide(t, sessionToken(issued, time.Now().Add(10*time.Minute)))
+	if !ok {
+		t.Fatal("Token not reissued")
+	}
+	if d := reissued.Expiration.Sub(*reissued.IssuedAt); d > 2*time.Hour {
+		t.Errorf("Session extended past the maximum age: %v", d)
+	}
+	if d := time.Until(reissued.Expiration); d < 19*time.Minute {
+		t.Errorf("Session not extended to the maximum age: expires in %v", d)
+	}
+
+	if _, ok := slide(t, reissued); ok {
+		t.Error("Token reissued at the maximum age")
+	}
+}
+
+func TestSlidingSessionMaxAgeLogin(t *testing.T) {
+	testConfig(t)
+	override(t, &slidingSessions, true)
+	override(t, &maxSessionAge, time.Hour)
+
+	// A login with only a cookie can't start the session over
+	req := requestWithToken(sessionToken(time.Now().Add(-2*time.Hour), time.Now().Add(time.Hour)))
+	req.Header.Set("X-Simpleauth-Login", "true")
+	w := serve(req)
+	if w.Code == loginSuccessCode || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Login with a cookie past the maximum age returned %d, %q", w.Code, w.Header().Get("Set-Cookie"))
+	}
+
+	// Nor can it go past the end of the session
+	issued := time.Now().Add(-50 * time.Minute)
+	req = requestWithToken(sessionToken(issued, time.Now().Add(5*time.Minute)))
+	req.Header.Set("X-Simpleauth-Login", "true")
+	w = serve(req)
+	if w.Code != loginSuccessCode {
+		t.Fatalf("Login with a cookie returned %d", w.Code)
+	}
+	tok := cookieToken(t, w.Header().Get("Set-Cookie"))
+	if limit := issued.Add(time.Hour); tok.Expiration.After(limit) {
+		t.Errorf("Reissued token expires at %v, after the session ends at %v", tok.Expiration, limit)
+	}
+}
+
+func TestSlidingSessionOff(t *testing.T) {
+	testConfig(t)
+
+	issued := time.Now().Add(-30 * time.Minute)
+	if _, ok := slide(t, sessionToken(issued, issued.Add(time.Hour))); ok {
+		t.Error("Token reissued without sliding sessions")
+	}
+}
+
+func TestSlidingSessionBasicAuth(t *testing.T) {
+	testConfig(t)
+	override(t, &slidingSessions, true)
+
+	if w := serve(basicRequest("alice", alicePassword)); w.Header().Get("Set-Cookie") != "" {
+		t.Error("Cookie set for a Basic auth request")
+	}
+}
+
+func TestSlidingSessionConcurrent(t *testing.T) {
+	testConfig(t)
+	override(t, &slidingSessions, true)
+
+	issued := time.Now().Add(-55 * time.Minute)
+	tok := sessionToken(issued, issued.Add(time.Hour))
+
+	cookies := make(chan string, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(cookies); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cookies <- serve(requestWithToken(tok)).Header().Get("Set-Cookie")
+		}()
+	}
+	wg.Wait()
+	close(cookies)
+
+	issuedTokens := map[string]bool{}
+	for cookie := range cookies {
+		issuedTokens[cookieToken(t, cookie).String()] = true
+	}
+	if len(issuedTokens) != 1 {
+		t.Errorf("Issued %d different tokens", len(issuedTokens))
+	}
+}
+
+func TestSlidingSessionNoRefreshWindow(t *testing.T) {
+	testConfig(t)
+	override(t, &slidingSessions, true)
+	override(t, &refreshWindow, 0)
+
+	issued := time.Now().Add(-55 * time.Minute)
+	tok := sessionToken(issued, issued.Add(time.Hour))
+	first, _ := slide(t, tok)
+	time.Sleep(time.Millisecond)
+	second, _ := slide(t, tok)
+	if first.String() == second.String() {
+		t.Error("Same token reissued without a refresh window")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	"git.woozle.org/neale/simpleauth/web"
+)
+
+// staticHandler serves an embedded file, outside the authentication flow
+func staticHandler(name, contentType string, content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		// Embedded files only change with the binary, so startup will do for their modification time
+		http.ServeContent(w, req, name, startTime, bytes.NewReader(content))
+	}
+}
+
+// faviconHandler serves the built-in favicon
+var faviconHandler = staticHandler("favicon.ico", "image/x-icon", web.FaviconICO)
+
+// robotsHandler serves a robots.txt disallowing everything
+var robotsHandler = staticHandler("robots.txt", "text/plain; charset=utf-8", web.RobotsTXT)
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.woozle.org/neale/simpleauth/web"
+)
+
+func TestStaticFiles(t *testing.T) {
+	testConfig(t)
+	cases := []struct {
+		path        string
+		handler     http.HandlerFunc
+		contentType string
+		body        []byte
+	}{
+		{"/favicon.ico", faviconHandler, "image/x-icon", web.FaviconICO},
+		{"/robots.txt", robotsHandler, "text/plain; charset=utf-8", []byte("User-agent: *\nDisallow: /\n")},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		c.handler(w, httptest.NewRequest(http.MethodGet, c.path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s returned %d", c.path, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != c.contentType {
+			t.Errorf("%s has content type %q", c.path, ct)
+		}
+		if w.Header().Get("WWW-Authenticate") != "" || w.Header().Get("Set-Cookie") != "" {
+			t.Errorf("%s took part in authentication", c.path)
+		}
+		if !bytes.Equal(w.Body.Bytes(), c.body) {
+			t.Errorf("%s has the wrong body", c.path)
+		}
+	}
+	if !bytes.HasPrefix(web.FaviconICO, []byte{0, 0, 1, 0}) {
+		t.Error("Favicon isn't an ICO file")
+	}
+}
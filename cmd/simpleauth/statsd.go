@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// statsd sends metrics to a StatsD server, or is nil if that's off
+var statsd *statsdClient
+
+// statsdClient sends StatsD metrics over UDP.
+// UDP doesn't wait for the server, so a missing server never slows down authentication.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+}
+
+// newStatsdClient returns a client sending to addr, with metric names starting with prefix
+func newStatsdClient(addr, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdClient{conn, prefix}, nil
+}
+
+// send writes one metric line, ignoring errors
+func (c *statsdClient) send(format string, v ...any) {
+	if c == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(c.conn, c.prefix+format, v...); err != nil {
+		debugf("statsd: %v", err)
+	}
+}
+
+// incr increments a counter
+func (c *statsdClient) incr(name string) {
+	c.send("%s:1|c", name)
+}
+
+// timing records a duration, in milliseconds
+func (c *statsdClient) timing(name string, d time.Duration) {
+	c.send("%s:%d|ms", name, d.Milliseconds())
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdListener collects metric lines sent to a UDP listener
+func statsdListener(t *testing.T) (addr string, lines func(n int) []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.LocalAddr().String(), func(n int) []string {
+		var got []string
+		buf := make([]byte, 1024)
+		for len(got) < n {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			size, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("Reading metrics after %v: %v", got, err)
+			}
+			got = append(got, string(buf[:size]))
+		}
+		return got
+	}
+}
+
+func TestStatsd(t *testing.T) {
+	testConfig(t)
+	addr, lines := statsdListener(t)
+	client, err := newStatsdClient(addr, "simpleauth.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &statsd, client)
+
+	serve(basicRequest("alice", alicePassword))
+	got := lines(2)
+	if !strings.HasPrefix(got[0], "simpleauth.auth.latency:") || !strings.HasSuffix(got[0], "|ms") {
+		t.Errorf("Wrong timing: %q", got[0])
+	}
+	if got[1] != "simpleauth.auth.success:1|c" {
+		t.Errorf("Wrong success counter: %q", got[1])
+	}
+
+	serve(basicRequest("alice", "wrong"))
+	got = lines(2)
+	if got[1] != "simpleauth.auth.failure:1|c" {
+		t.Errorf("Wrong failure counter: %q", got[1])
+	}
+}
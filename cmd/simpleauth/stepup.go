@@ -0,0 +1,20 @@
+package main
+
+import "time"
+
+// stepUpPaths are paths that need a recent login, even with a valid token.
+// Patterns are as for pathMatches; see pathRequires.
+var stepUpPaths []string
+
+// stepUpFreshness is how recent a login must be for stepUpPaths
+var stepUpFreshness = 15 * time.Minute
+
+// stepUpRequired returns true if uri is a step-up path,
+// and credentials were last presented longer ago than stepUpFreshness.
+// The zero time is never recent enough.
+func stepUpRequired(uri string, authenticatedAt time.Time) bool {
+	if len(stepUpPaths) == 0 || !pathRequires(stepUpPaths, uri) {
+		return false
+	}
+	return time.Since(authenticatedAt) > stepUpFreshness
+}
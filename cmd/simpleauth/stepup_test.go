@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// issuedToken returns a token for alice, issued at issued
+func issuedToken(issued time.Time) token.T {
+	t := token.T{
+		Username:   "alice",
+		Expiration: time.Now().Add(time.Hour),
+		IssuedAt:   &issued,
+	}
+	return t.Sign(secret)
+}
+
+// stepUpRequest returns a request for uri, carrying tok
+func stepUpRequest(tok token.T, uri string) *http.Request {
+	req := requestWithToken(tok)
+	req.Header.Set("X-Forwarded-Uri", uri)
+	return req
+}
+
+func TestStepUp(t *testing.T) {
+	testConfig(t)
+	override(t, &stepUpPaths, []string{"/admin/"})
+	override(t, &stepUpFreshness, 10*time.Minute)
+
+	fresh := issuedToken(time.Now().Add(-time.Minute))
+	stale := issuedToken(time.Now().Add(-time.Hour))
+
+	if w := serve(stepUpRequest(fresh, "/admin/settings")); w.Code != http.StatusOK {
+		t.Errorf("Fresh token on a step-up path returned %d", w.Code)
+	}
+	w := serve(stepUpRequest(stale, "/admin/settings"))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Stale token on a step-up path returned %d", w.Code)
+	}
+	if got := w.Header().Get("X-Simpleauth-Authentication"); got != "stale" {
+		t.Errorf("Wrong authentication header: %q", got)
+	}
+	if w := serve(stepUpRequest(stale, "/public")); w.Code != http.StatusOK {
+		t.Errorf("Stale token on an ordinary path returned %d", w.Code)
+	}
+}
+
+func TestStepUpEncodedPath(t *testing.T) {
+	testConfig(t)
+	override(t, &stepUpPaths, []string{"/admin/"})
+	stale := issuedToken(time.Now().Add(-time.Hour))
+
+	// The upstream decodes these to /admin/, or might
+	for _, uri := range []string{"/public/%2e%2e/admin/", "/%61dmin/", "/public%2f..%2fadmin/", "/%zz/admin/"} {
+		if w := serve(stepUpRequest(stale, uri)); w.Code != http.StatusUnauthorized {
+			t.Errorf("Stale token on %s returned %d", uri, w.Code)
+		}
+	}
+}
+
+func TestStepUpOldToken(t *testing.T) {
+	testConfig(t)
+	override(t, &stepUpPaths, []string{"/admin/"})
+
+	// Tokens from before issue times were recorded have to log in again
+	old := token.New(secret, "alice", time.Now().Add(time.Hour))
+	if w := serve(stepUpRequest(old, "/admin/")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token without an issue time returned %d", w.Code)
+	}
+}
+
+func TestStepUpLogin(t *testing.T) {
+	testConfig(t)
+	override(t, &stepUpPaths, []string{"/admin/"})
+
+	req := loginRequest()
+	req.Header.Set("X-Forwarded-Uri", "/admin/")
+	w := serve(req)
+	if w.Code != loginSuccessCode {
+		t.Fatalf("Login on a step-up path returned %d", w.Code)
+	}
+	tok := cookieToken(t, w.Header().Get("Set-Cookie"))
+	if w := serve(stepUpRequest(tok, "/admin/")); w.Code != http.StatusOK {
+		t.Errorf("New token on a step-up path returned %d", w.Code)
+	}
+}
+
+func TestStepUpCookieLogin(t *testing.T) {
+	testConfig(t)
+	override(t, &stepUpPaths, []string{"/admin/"})
+	override(t, &stepUpFreshness, 10*time.Minute)
+	issued := time.Now().Add(-time.Hour)
+	stale := issuedToken(issued)
+
+	// A login with nothing but the stale cookie doesn't make it fresh
+	req := stepUpRequest(stale, "/admin/x")
+	req.Header.Set("X-Simpleauth-Login", "true")
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("Stale cookie login on a step-up path returned %d", w.Code)
+	}
+
+	// Elsewhere it's reissued, but with the old login time
+	req = stepUpRequest(stale, "/")
+	req.Header.Set("X-Simpleauth-Login", "true")
+	w := serve(req)
+	if w.Code != loginSuccessCode {
+		t.Fatalf("Cookie login returned %d", w.Code)
+	}
+	tok := cookieToken(t, w.Header().Get("Set-Cookie"))
+	if tok.IssuedAt == nil || !tok.IssuedAt.Equal(issued) {
+		t.Errorf("Reissued token has issue time %v, want %v", tok.IssuedAt, issued)
+	}
+	if w := serve(stepUpRequest(tok, "/admin/x")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Reissued token on a step-up path returned %d", w.Code)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"strings"
+)
+
+// syslogFacilities maps facility names to their syslog values
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// dialSyslog connects to a syslog server.
+//
+// addr is empty for the local syslog daemon, or network://host:port,
+// like udp://logs.example.com:514.
+func dialSyslog(addr, facility, tag string) (io.Writer, error) {
+	priority, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	network, raddr := "", ""
+	if addr != "" {
+		var found bool
+		network, raddr, found = strings.Cut(addr, "://")
+		if !found {
+			return nil, fmt.Errorf("syslog address %q should look like udp://host:port", addr)
+		}
+	}
+	return syslog.Dial(network, raddr, priority|syslog.LOG_INFO, tag)
+}
+
+// setupSyslog sends logs to syslog.
+// If syslog can't be reached, logs keep going to stderr.
+func setupSyslog(addr, facility, tag string) {
+	w, err := dialSyslog(addr, facility, tag)
+	if err != nil {
+		log.Printf("Warning: syslog unavailable: %v; logging to stderr", err)
+		return
+	}
+	// syslog stamps messages itself
+	log.SetFlags(0)
+	log.SetOutput(w)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	defer log.SetOutput(log.Writer())
+	defer log.SetFlags(log.Flags())
+	setupSyslog("udp://"+conn.LocalAddr().String(), "local3", "simpleauth-test")
+	log.Print("hello from the test")
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	// local3 is facility 19; info is severity 6: 19*8+6 = 158
+	if !strings.HasPrefix(msg, "<158>") {
+		t.Errorf("Wrong priority: %q", msg)
+	}
+	if !strings.Contains(msg, "simpleauth-test") || !strings.Contains(msg, "hello from the test") {
+		t.Errorf("Wrong message: %q", msg)
+	}
+}
+
+func TestSyslogFallback(t *testing.T) {
+	out := log.Writer()
+	defer log.SetOutput(out)
+
+	setupSyslog("udp://127.0.0.1:514", "nonsense", "simpleauth")
+	if log.Writer() != out {
+		t.Error("Log output changed despite a bad facility")
+	}
+	setupSyslog("bogus", "daemon", "simpleauth")
+	if log.Writer() != out {
+		t.Error("Log output changed despite a bad address")
+	}
+}
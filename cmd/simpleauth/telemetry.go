@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes a span for each auth request.
+// Until setupTelemetry installs a provider, spans go nowhere.
+var tracer = otel.Tracer("git.woozle.org/neale/simpleauth")
+
+// telemetryEnabled returns true if the standard OTEL_* environment variables ask for traces to be exported
+func telemetryEnabled() bool {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTelemetry exports traces over OTLP/HTTP.
+// The endpoint, headers, and service name come from the standard OTEL_* environment variables.
+func setupTelemetry(ctx context.Context) error {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter)))
+	return nil
+}
+
+// propagator reads the trace context the proxy sends, in W3C traceparent and baggage headers
+var propagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// traced wraps handler in a span, continuing any trace context from the request headers
+func traced(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", forwardedMethod(req)),
+				attribute.String("url.path", forwardedURI(req)),
+			),
+		)
+		defer span.End()
+		handler(w, req.WithContext(ctx))
+	}
+}
+
+// recordDecision adds the outcome of an auth request to its span
+func recordDecision(req *http.Request, username, status string, code int) {
+	span := trace.SpanFromContext(req.Context())
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(
+		attribute.String("enduser.id", username),
+		attribute.String("simpleauth.result", status),
+		attribute.Int("http.response.status_code", code),
+	)
+	if code >= 500 {
+		span.SetStatus(codes.Error, status)
+	}
+}
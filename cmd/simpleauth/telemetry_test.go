@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans sends spans to a new in-memory exporter
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	override(t, &tracer, tp.Tracer("test"))
+	return exporter
+}
+
+// spanAttribute returns the value of a span attribute, as a string
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTelemetrySpan(t *testing.T) {
+	testConfig(t)
+	exporter := recordSpans(t)
+
+	w := httptest.NewRecorder()
+	traced("auth", rootHandler)(w, basicRequest("alice", alicePassword))
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Recorded %d spans", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "auth" {
+		t.Errorf("Wrong span name: %q", span.Name)
+	}
+	if got := spanAttribute(span, "enduser.id"); got != "alice" {
+		t.Errorf("Wrong username: %q", got)
+	}
+	if got := spanAttribute(span, "simpleauth.result"); got != "succeeded" {
+		t.Errorf("Wrong result: %q", got)
+	}
+
+	exporter.Reset()
+	traced("auth", rootHandler)(httptest.NewRecorder(), basicRequest("alice", "wrong"))
+	if got := spanAttribute(exporter.GetSpans()[0], "simpleauth.result"); got != "failed" {
+		t.Errorf("Wrong result for a bad password: %q", got)
+	}
+}
+
+func TestTelemetryTraceContext(t *testing.T) {
+	testConfig(t)
+	exporter := recordSpans(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	traced("auth", rootHandler)(httptest.NewRecorder(), req)
+
+	span := exporter.GetSpans()[0]
+	if got := span.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Trace not continued: %s", got)
+	}
+	if got := span.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("Wrong parent span: %s", got)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"os"
+	"strings"
+)
+
+// hostThemes maps forwarded hosts to their own login pages, guarded by loginTemplateLock.
+// Hosts not listed get the default login page.
+var hostThemes map[string]*template.Template
+
+// parseHostThemes parses a list of host=file pairs, separated by commas
+func parseHostThemes(spec string) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		host, path, ok := strings.Cut(pair, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		path = strings.TrimSpace(path)
+		if !ok || host == "" || path == "" {
+			return nil, fmt.Errorf("host theme %q should look like host=file", pair)
+		}
+		paths[host] = path
+	}
+	return paths, nil
+}
+
+// loadHostThemes reads and parses the login page for each host
+func loadHostThemes(paths map[string]string) (map[string]*template.Template, error) {
+	themes := make(map[string]*template.Template)
+	for host, path := range paths {
+		html, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := parseLoginHtml(html)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		themes[host] = tmpl
+	}
+	return themes, nil
+}
+
+// setHostThemes replaces the per-host login pages
+func setHostThemes(themes map[string]*template.Template) {
+	loginTemplateLock.Lock()
+	defer loginTemplateLock.Unlock()
+	hostThemes = themes
+}
+
+// hostTheme returns the login page for host, or nil if it uses the default
+func hostTheme(host string) *template.Template {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	loginTemplateLock.RLock()
+	defer loginTemplateLock.RUnlock()
+	return hostThemes[strings.ToLower(host)]
+}
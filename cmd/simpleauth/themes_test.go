@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostThemes(t *testing.T) {
+	testConfig(t)
+	dir := t.TempDir()
+	pathA := filepath.Join(dir, "a.html")
+	if err := os.WriteFile(pathA, []byte("<html>theme A</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := parseHostThemes("App-A.example.com=" + pathA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	themes, err := loadHostThemes(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setHostThemes(themes)
+
+	cases := []struct {
+		host string
+		body string
+	}{
+		{"app-a.example.com", "<html>theme A</html>"},
+		{"app-a.example.com:8443", "<html>theme A</html>"},
+		{"other.example.com", "<html>login</html>"},
+		{"", "<html>login</html>"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-Host", c.host)
+		if w := serve(req); w.Body.String() != c.body {
+			t.Errorf("Host %q got %q, wanted %q", c.host, w.Body.String(), c.body)
+		}
+	}
+}
+
+func TestHostThemesErrors(t *testing.T) {
+	if _, err := parseHostThemes("app.example.com"); err == nil {
+		t.Error("Theme without a file accepted")
+	}
+	if _, err := loadHostThemes(map[string]string{"app.example.com": "/nonexistent/login.html"}); err == nil {
+		t.Error("Missing theme file accepted")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleExemptNets are client networks never throttled or held to login cooldowns,
+// like an office where everyone shares one NAT address, so one person's typos don't lock everyone out
+var throttleExemptNets []netip.Prefix
+
+// parseNetworks parses a comma-separated list of IP addresses and CIDR networks
+func parseNetworks(s string) ([]netip.Prefix, error) {
+	var nets []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(field); err == nil {
+			ip = ip.Unmap()
+			nets = append(nets, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q, expected an IP address or CIDR", field)
+		}
+		nets = append(nets, prefix.Masked())
+	}
+	return nets, nil
+}
+
+// throttleExempt returns true if req comes from a network in throttleExemptNets.
+// The address only comes from the proxy's headers if it's a trusted proxy.
+func throttleExempt(req *http.Request) bool {
+	if len(throttleExemptNets) == 0 {
+		return false
+	}
+	ip, ok := trustedClientIP(req)
+	if !ok {
+		return false
+	}
+	for _, prefix := range throttleExemptNets {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// throttleMaxBuckets is how many usernames the throttle and login cooldowns keep track of.
+// Past that, the least recently seen are forgotten,
+// so a spray of made-up usernames can't use up memory.
+const throttleMaxBuckets = 10000
+
+// lruMap is a map of at most max entries, which forgets the least recently used to make room
+type lruMap[V any] struct {
+	max   int
+	order *list.List // of lruEntry, most recently used first
+	items map[string]*list.Element
+}
+
+// lruEntry is a key and value in an lruMap
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+// newLRUMap returns an empty lruMap holding up to max entries
+func newLRUMap[V any](max int) *lruMap[V] {
+	return &lruMap[V]{
+		max:   max,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the value for key, and marks it used
+func (m *lruMap[V]) get(key string) (V, bool) {
+	e, ok := m.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	m.order.MoveToFront(e)
+	return e.Value.(lruEntry[V]).value, true
+}
+
+// put sets the value for key, and marks it used
+func (m *lruMap[V]) put(key string, value V) {
+	if e, ok := m.items[key]; ok {
+		e.Value = lruEntry[V]{key, value}
+		m.order.MoveToFront(e)
+		return
+	}
+	if m.order.Len() >= m.max {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(lruEntry[V]).key)
+	}
+	m.items[key] = m.order.PushFront(lruEntry[V]{key, value})
+}
+
+// len returns how many entries m holds
+func (m *lruMap[V]) len() int {
+	return m.order.Len()
+}
+
+// tokenBucket holds the remaining attempts for one username
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// usernameThrottle limits login attempts per username, no matter where they come from.
+//
+// Each attempt takes a token before the password is verified;
+// successful attempts give it back, so legitimate clients aren't throttled.
+type usernameThrottle struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets *lruMap[*tokenBucket]
+}
+
+// newUsernameThrottle returns a throttle allowing perMinute attempts per minute, with bursts up to burst
+func newUsernameThrottle(perMinute float64, burst int) *usernameThrottle {
+	return &usernameThrottle{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: newLRUMap[*tokenBucket](throttleMaxBuckets),
+	}
+}
+
+// fill brings a bucket up to date, and returns it
+func (th *usernameThrottle) fill(username string, now time.Time) *tokenBucket {
+	b, ok := th.buckets.get(username)
+	if !ok {
+		b = &tokenBucket{tokens: th.burst, last: now}
+		th.buckets.put(username, b)
+	}
+	b.tokens += now.Sub(b.last).Seconds() * th.rate
+	if b.tokens > th.burst {
+		b.tokens = th.burst
+	}
+	b.last = now
+	return b
+}
+
+// take uses up one attempt for username, returning false if none are left
+func (th *usernameThrottle) take(username string) bool {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	b := th.fill(username, time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// refund gives back an attempt, after it turned out to be successful
+func (th *usernameThrottle) refund(username string) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	b := th.fill(username, time.Now())
+	b.tokens += 1
+	if b.tokens > th.burst {
+		b.tokens = th.burst
+	}
+}
+
+// loginCooldown enforces a minimum interval between successful logins for each username,
+// so a script can't mint tokens as fast as it likes with good credentials
+type loginCooldown struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     *lruMap[time.Time]
+}
+
+// loginCooldowns limits how often each username may log in, or is nil for no limit
+var loginCooldowns *loginCooldown
+
+// newLoginCooldown returns a cooldown allowing one login per interval for each username
+func newLoginCooldown(interval time.Duration) *loginCooldown {
+	return &loginCooldown{
+		interval: interval,
+		last:     newLRUMap[time.Time](throttleMaxBuckets),
+	}
+}
+
+// allow records a successful login for username.
+// If the last one was too recent, it returns false, and how long until the next is allowed.
+func (c *loginCooldown) allow(username string) (bool, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if last, ok := c.last.get(username); ok {
+		if wait := c.interval - now.Sub(last); wait > 0 {
+			return false, wait
+		}
+	}
+	c.last.put(username, now)
+	return true, 0
+}
+
+// retryAfter formats a wait for the Retry-After header, in whole seconds, rounding up
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int((wait + time.Second - 1) / time.Second))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestThrottleAcrossIPs(t *testing.T) {
+	testConfig(t)
+	override(t, &loginThrottle, newUsernameThrottle(1, 3))
+
+	for i := 0; i < 5; i++ {
+		req := basicRequest("alice", "wrong")
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+1)
+		w := serve(req)
+		want := http.StatusUnauthorized
+		if i >= 3 {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("Attempt %d: wanted %d, got %d", i, want, w.Code)
+		}
+	}
+
+	// Other usernames have their own bucket
+	if w := serve(basicRequest("bob", "wrong")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Other username throttled: %d", w.Code)
+	}
+}
+
+func TestThrottleSuccessRefunded(t *testing.T) {
+	testConfig(t)
+	override(t, &loginThrottle, newUsernameThrottle(1, 2))
+
+	for i := 0; i < 5; i++ {
+		if w := serve(basicRequest("alice", alicePassword)); w.Code != http.StatusOK {
+			t.Errorf("Successful attempt %d: got %d", i, w.Code)
+		}
+	}
+}
+
+func TestLoginCooldown(t *testing.T) {
+	testConfig(t)
+	override(t, &loginCooldowns, newLoginCooldown(time.Hour))
+
+	if w := serve(loginRequest()); w.Code != http.StatusTeapot {
+		t.Fatalf("First login returned %d", w.Code)
+	}
+	w := serve(loginRequest())
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Rapid second login returned %d", w.Code)
+	}
+	if w.Header().Get("Set-Cookie") != "" {
+		t.Error("Token issued during cooldown")
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "3600" {
+		t.Errorf("Wrong Retry-After: %q", ra)
+	}
+
+	// Forward-auth requests aren't logins, and aren't affected
+	if w := serve(basicRequest("alice", alicePassword)); w.Code != http.StatusOK {
+		t.Errorf("Forward-auth request during cooldown returned %d", w.Code)
+	}
+
+	// Once the interval has passed, logging in works again
+	loginCooldowns.last.put("alice", time.Now().Add(-2*time.Hour))
+	if w := serve(loginRequest()); w.Code != http.StatusTeapot {
+		t.Errorf("Spaced login returned %d", w.Code)
+	}
+}
+
+func TestThrottleBounded(t *testing.T) {
+	th := newUsernameThrottle(1, 2)
+	th.take("alice")
+	th.take("alice")
+	for i := 0; i < 2*throttleMaxBuckets; i++ {
+		th.take(fmt.Sprintf("spray%d", i))
+		if i%100 == 0 {
+			// alice keeps trying, so she stays among the most recent
+			th.take("alice")
+		}
+	}
+	if n := th.buckets.len(); n > throttleMaxBuckets {
+		t.Errorf("Throttle tracking %d usernames, more than %d", n, throttleMaxBuckets)
+	}
+	if th.take("alice") {
+		t.Error("Spraying other usernames reset a throttled one")
+	}
+
+	c := newLoginCooldown(time.Hour)
+	for i := 0; i < 2*throttleMaxBuckets; i++ {
+		c.allow(fmt.Sprintf("user%d", i))
+	}
+	if n := c.last.len(); n > throttleMaxBuckets {
+		t.Errorf("Cooldown tracking %d usernames, more than %d", n, throttleMaxBuckets)
+	}
+}
+
+func TestThrottleExempt(t *testing.T) {
+	testConfig(t)
+	override(t, &loginThrottle, newUsernameThrottle(1, 2))
+	nets, err := parseNetworks("203.0.113.7, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &throttleExemptNets, nets)
+	override(t, &trustedProxies, []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")})
+
+	for _, addr := range []string{"203.0.113.7", "10.1.2.3"} {
+		for i := 0; i < 5; i++ {
+			req := basicRequest("alice", "wrong")
+			req.Header.Set("X-Real-IP", addr)
+			if w := serve(req); w.Code != http.StatusUnauthorized {
+				t.Errorf("%s attempt %d: got %d", addr, i, w.Code)
+			}
+		}
+	}
+
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req := basicRequest("bob", "wrong")
+		req.Header.Set("X-Real-IP", "198.51.100.1")
+		codes = append(codes, serve(req).Code)
+	}
+	if codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Other address not throttled: %v", codes)
+	}
+}
+
+func TestThrottleExemptSpoofed(t *testing.T) {
+	testConfig(t)
+	override(t, &loginThrottle, newUsernameThrottle(1, 2))
+	override(t, &throttleExemptNets, []netip.Prefix{netip.MustParsePrefix("203.0.113.7/32")})
+
+	// The request comes from 192.0.2.1, which isn't a trusted proxy
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		req := basicRequest("alice", "wrong")
+		req.Header.Set("X-Real-IP", "203.0.113.7")
+		codes = append(codes, serve(req).Code)
+	}
+	if codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Spoofed exempt address not throttled: %v", codes)
+	}
+}
+
+func TestThrottleExemptCooldown(t *testing.T) {
+	testConfig(t)
+	override(t, &loginCooldowns, newLoginCooldown(time.Hour))
+	override(t, &throttleExemptNets, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+
+	for i := 0; i < 3; i++ {
+		req := loginRequest()
+		req.Header.Set("X-Real-IP", "192.0.2.10")
+		if w := serve(req); w.Code != http.StatusTeapot {
+			t.Errorf("Exempt login %d returned %d", i, w.Code)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := parseNetworks("192.0.2.1,2001:db8::/32,10.1.2.3/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.1/32", "2001:db8::/32", "10.0.0.0/8"}
+	if len(nets) != len(want) {
+		t.Fatalf("Wrong networks: %v", nets)
+	}
+	for i := range want {
+		if nets[i].String() != want[i] {
+			t.Errorf("Network %d: got %s, want %s", i, nets[i], want[i])
+		}
+	}
+
+	if _, err := parseNetworks("office"); err == nil {
+		t.Error("Invalid network accepted")
+	}
+}
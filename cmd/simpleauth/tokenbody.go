@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// tokenBody says whether to put the token in the body of a login response, besides the cookie:
+// "off", "json", "text", or "accept" to go by the request's Accept header
+var tokenBody = "off"
+
+// tokenBodyFormats are the allowed values for tokenBody
+var tokenBodyFormats = []string{"off", "json", "text", "accept"}
+
+// tokenBodyResponse is the JSON body describing a newly issued token
+type tokenBodyResponse struct {
+	Token string `json:"token"`
+	apiLoginResponse
+}
+
+// tokenBodyFormat returns "json" or "text" if the token should go in the response body for req,
+// or "" if the usual login response should be sent
+func tokenBodyFormat(req *http.Request) string {
+	switch tokenBody {
+	case "json", "text":
+		return tokenBody
+	case "accept":
+		for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+			mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+			switch mediaType {
+			case "application/json":
+				return "json"
+			case "text/plain":
+				return "text"
+			}
+		}
+	}
+	return ""
+}
+
+// writeTokenBody sends t as the body of a login response, in format
+func writeTokenBody(w http.ResponseWriter, t token.T, format string, code int) {
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(tokenBodyResponse{
+			Token: t.String(),
+			apiLoginResponse: apiLoginResponse{
+				Username:   t.Username,
+				Expiration: t.Expiration,
+				Groups:     t.Groups,
+			},
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, t.String())
+}
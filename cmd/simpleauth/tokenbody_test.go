@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+func TestTokenBody(t *testing.T) {
+	cases := []struct {
+		setting string
+		accept  string
+		format  string
+	}{
+		{"json", "", "json"},
+		{"text", "", "text"},
+		{"accept", "application/json", "json"},
+		{"accept", "text/html, text/plain;q=0.9", "text"},
+		{"accept", "text/html", ""},
+		{"off", "application/json", ""},
+	}
+	for _, c := range cases {
+		testConfig(t)
+		override(t, &tokenBody, c.setting)
+		req := loginRequest()
+		req.Header.Set("Accept", c.accept)
+		w := serve(req)
+
+		if w.Code != http.StatusTeapot {
+			t.Errorf("%s/%q: login returned %d", c.setting, c.accept, w.Code)
+			continue
+		}
+		cookie := cookieToken(t, w.Header().Get("Set-Cookie"))
+
+		var bodyToken string
+		switch c.format {
+		case "json":
+			var resp tokenBodyResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("%s/%q: %v", c.setting, c.accept, err)
+				continue
+			}
+			if resp.Username != "alice" {
+				t.Errorf("%s/%q: wrong username %q", c.setting, c.accept, resp.Username)
+			}
+			bodyToken = resp.Token
+		case "text":
+			bodyToken = strings.TrimSpace(w.Body.String())
+		default:
+			if w.Body.String() != "<html>login</html>" {
+				t.Errorf("%s/%q: token body sent when it shouldn't be: %q", c.setting, c.accept, w.Body)
+			}
+			continue
+		}
+
+		parsed, err := token.ParseString(bodyToken)
+		if err != nil {
+			t.Errorf("%s/%q: %v", c.setting, c.accept, err)
+			continue
+		}
+		if parsed.String() != cookie.String() {
+			t.Errorf("%s/%q: body token doesn't match the cookie", c.setting, c.accept)
+		}
+	}
+}
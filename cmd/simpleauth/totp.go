@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpPath is the file enrolled TOTP secrets are kept in, one username:secret per line.
+// With no path, users can't enroll themselves,
+// but can still have a secret in their totp attribute.
+var totpPath string
+
+// totpIssuer names this service in authenticator apps
+var totpIssuer = "simpleauth"
+
+// totpSecrets maps userKey(username) to the user's base32 TOTP secret.
+// It's guarded by configLock.
+var totpSecrets map[string]string
+
+// totpEnrollTimeout is how long a new secret waits for the user to confirm it
+const totpEnrollTimeout = 10 * time.Minute
+
+// pendingSecret is a TOTP secret the user hasn't confirmed yet
+type pendingSecret struct {
+	secret  string
+	expires time.Time
+}
+
+// pendingTOTP holds secrets from enrollment, keyed by userKey(username)
+var pendingTOTP = map[string]pendingSecret{}
+
+// pendingTOTPLock guards pendingTOTP
+var pendingTOTPLock sync.Mutex
+
+// readTOTPFile reads username:secret lines from path.
+// A missing file means nobody has enrolled yet.
+func readTOTPFile(path string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	if path == "" {
+		return secrets, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, secret, found := strings.Cut(line, ":")
+		if !found || username == "" || secret == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:secret", path, lineno)
+		}
+		secrets[strings.ToLower(username)] = secret
+	}
+	return secrets, scanner.Err()
+}
+
+// loadTOTPSecrets reads enrolled TOTP secrets from path, keyed by userKey
+func loadTOTPSecrets(path string) (map[string]string, error) {
+	plain, err := readTOTPFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]string, len(plain))
+	for username, secret := range plain {
+		secrets[userKey(username)] = secret
+	}
+	return secrets, nil
+}
+
+// validTOTPSecret returns true if secret is a base32 TOTP secret
+func validTOTPSecret(secret string) bool {
+	secret = strings.ToUpper(strings.TrimRight(secret, "="))
+	_, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	return secret != "" && err == nil
+}
+
+// totpEnabled returns true if users may be asked for a TOTP code:
+// they can enroll, or somebody has a secret in the user store
+func totpEnabled() bool {
+	if totpPath != "" {
+		return true
+	}
+	for _, entry := range currentUsers() {
+		if _, attrs := splitUserEntry(entry); attrs["totp"] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// totpSecret returns the TOTP secret for username, or "" if they haven't enrolled.
+// A secret in the user's totp attribute comes first, so it reloads with their password;
+// otherwise it's the one they enrolled in totpPath.
+func totpSecret(username string) string {
+	_, attrs := splitUserEntry(currentUsers()[userKey(username)])
+	if secret := attrs["totp"]; secret != "" {
+		return secret
+	}
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return totpSecrets[userKey(username)]
+}
+
+// totpPeriod is how many seconds each TOTP code lasts, as authenticator apps expect
+const totpPeriod = 30
+
+// totpLastStep maps userKey(username) to the time step of the last code they logged in with,
+// so that a code seen in transit can't be used again
+var totpLastStep = map[string]int64{}
+
+// totpLastStepLock guards totpLastStep
+var totpLastStepLock sync.Mutex
+
+// totpSatisfied returns true if username hasn't enrolled in TOTP,
+// or code is currently valid for their secret and newer than the last code they used.
+// Like totp.Validate, it allows one period of clock skew either way.
+func totpSatisfied(username, code string) bool {
+	secret := totpSecret(username)
+	if secret == "" {
+		return true
+	}
+	code = strings.TrimSpace(code)
+	now := time.Now()
+	for skew := -1; skew <= 1; skew++ {
+		at := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		valid, err := totp.ValidateCustom(code, secret, at, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && valid {
+			return useTOTPStep(username, at.Unix()/totpPeriod)
+		}
+	}
+	return false
+}
+
+// useTOTPStep records that username used the code for step.
+// It returns false if they've already used that step or a later one.
+func useTOTPStep(username string, step int64) bool {
+	key := userKey(username)
+	totpLastStepLock.Lock()
+	defer totpLastStepLock.Unlock()
+	if last, ok := totpLastStep[key]; ok && step <= last {
+		debugf("TOTP code for username:%v already used", logName(username))
+		return false
+	}
+	totpLastStep[key] = step
+	return true
+}
+
+// saveTOTPSecret adds secret for username to totpPath, and starts using it.
+// The file is replaced all at once, so a crash can't leave half of it behind.
+func saveTOTPSecret(username, secret string) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	plain, err := readTOTPFile(totpPath)
+	if err != nil {
+		return err
+	}
+	plain[username] = secret
+
+	usernames := make([]string, 0, len(plain))
+	for u := range plain {
+		usernames = append(usernames, u)
+	}
+	sort.Strings(usernames)
+	buf := new(bytes.Buffer)
+	for _, u := range usernames {
+		fmt.Fprintf(buf, "%s:%s\n", u, plain[u])
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(totpPath), ".totp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), totpPath); err != nil {
+		return err
+	}
+
+	secrets := make(map[string]string, len(plain))
+	for u, s := range plain {
+		secrets[userKey(u)] = s
+	}
+	totpSecrets = secrets
+	return nil
+}
+
+// totpEnrollRequest confirms an enrollment with a code from the authenticator app
+type totpEnrollRequest struct {
+	Code string `json:"code"`
+}
+
+// totpEnrollResponse describes a new, unconfirmed TOTP secret
+type totpEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	// QRCode is a PNG of URI, as a data: URL
+	QRCode string `json:"qrcode"`
+}
+
+// totpEnrollHandler enrolls the logged-in user in TOTP.
+//
+// A POST with no code makes a new secret, returning its otpauth:// URI and a QR code.
+// A POST with the current code from the authenticator app saves that secret.
+// Until then, logging in doesn't ask for a code.
+func totpEnrollHandler(w http.ResponseWriter, req *http.Request) {
+	stripUntrustedHeaders(req)
+	normalizeForwardedHeaders(req)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	username := usernameIfAuthenticated(req)
+	if username == "" {
+		apiError(w, http.StatusUnauthorized, "not logged in")
+		return
+	}
+	if csrfProtection && !csrfValid(req) {
+		debugf("TOTP enrollment rejected: missing or invalid CSRF token")
+		apiError(w, http.StatusForbidden, "missing or invalid CSRF token")
+		return
+	}
+	if totpSecret(username) != "" {
+		apiError(w, http.StatusConflict, "already enrolled")
+		return
+	}
+
+	var enroll totpEnrollRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&enroll); err != nil && !errors.Is(err, io.EOF) {
+		apiError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	if enroll.Code == "" {
+		resp, err := startTOTPEnrollment(username)
+		if err != nil {
+			log.Printf("TOTP enrollment for username:%v: %v", logName(username), err)
+			apiError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	key := userKey(username)
+	pendingTOTPLock.Lock()
+	pending, ok := pendingTOTP[key]
+	pendingTOTPLock.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		apiError(w, http.StatusBadRequest, "no enrollment in progress")
+		return
+	}
+	if !totp.Validate(strings.TrimSpace(enroll.Code), pending.secret) {
+		debugf("TOTP enrollment for username:%v: wrong code", logName(username))
+		apiError(w, http.StatusBadRequest, "wrong code")
+		return
+	}
+	if err := saveTOTPSecret(username, pending.secret); err != nil {
+		log.Printf("Saving TOTP secret for username:%v: %v", logName(username), err)
+		apiError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	pendingTOTPLock.Lock()
+	delete(pendingTOTP, key)
+	pendingTOTPLock.Unlock()
+	log.Printf("TOTP enrolled for username:%v", logName(username))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enrolled": true,
+	})
+}
+
+// startTOTPEnrollment makes a new secret for username, holding it until they confirm it
+func startTOTPEnrollment(username string) (totpEnrollResponse, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: username,
+	})
+	if err != nil {
+		return totpEnrollResponse{}, err
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return totpEnrollResponse{}, err
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return totpEnrollResponse{}, err
+	}
+
+	now := time.Now()
+	pendingTOTPLock.Lock()
+	for k, p := range pendingTOTP {
+		if now.After(p.expires) {
+			delete(pendingTOTP, k)
+		}
+	}
+	pendingTOTP[userKey(username)] = pendingSecret{key.Secret(), now.Add(totpEnrollTimeout)}
+	pendingTOTPLock.Unlock()
+
+	return totpEnrollResponse{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+	"github.com/pquerna/otp/totp"
+)
+
+// enroll posts body to totpEnrollHandler, logged in as alice
+func enroll(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/totp/enroll", strings.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: token.New(secret, "alice", time.Now().Add(time.Hour)).String()})
+	w := httptest.NewRecorder()
+	totpEnrollHandler(w, req)
+	return w
+}
+
+// totpTestConfig turns on TOTP, with secrets kept in a temporary file
+func totpTestConfig(t *testing.T) string {
+	t.Helper()
+	testConfig(t)
+	path := filepath.Join(t.TempDir(), "totp")
+	override(t, &totpPath, path)
+	return path
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	path := totpTestConfig(t)
+
+	w := enroll(t, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Enrollment returned %d: %s", w.Code, w.Body)
+	}
+	var resp totpEnrollResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Secret == "" {
+		t.Fatal("No secret generated")
+	}
+	if !strings.HasPrefix(resp.URI, "otpauth://totp/") || !strings.Contains(resp.URI, "secret="+resp.Secret) {
+		t.Errorf("Wrong URI: %q", resp.URI)
+	}
+	if !strings.HasPrefix(resp.QRCode, "data:image/png;base64,") {
+		t.Errorf("Wrong QR code: %.40q", resp.QRCode)
+	}
+
+	// Nothing is kept until the user confirms
+	if totpSecret("alice") != "" {
+		t.Error("Secret in use before confirmation")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Secret saved before confirmation")
+	}
+}
+
+func TestTOTPEnrollmentConfirm(t *testing.T) {
+	path := totpTestConfig(t)
+
+	var resp totpEnrollResponse
+	json.Unmarshal(enroll(t, "").Body.Bytes(), &resp)
+
+	if w := enroll(t, `{"code": "000000"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Wrong code returned %d", w.Code)
+	}
+	if totpSecret("alice") != "" {
+		t.Fatal("Secret saved after a wrong code")
+	}
+
+	code, err := totp.GenerateCode(resp.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := enroll(t, `{"code": "`+code+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("Confirmation returned %d: %s", w.Code, w.Body)
+	}
+	if totpSecret("alice") != resp.Secret {
+		t.Error("Secret not in use after confirmation")
+	}
+	saved, err := loadTOTPSecrets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved["alice"] != resp.Secret {
+		t.Errorf("Secret not saved: %v", saved)
+	}
+
+	if w := enroll(t, ""); w.Code != http.StatusConflict {
+		t.Errorf("Enrolling again returned %d", w.Code)
+	}
+}
+
+func TestTOTPEnrollmentNotLoggedIn(t *testing.T) {
+	totpTestConfig(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/totp/enroll", nil)
+	w := httptest.NewRecorder()
+	totpEnrollHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Anonymous enrollment returned %d", w.Code)
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	totpTestConfig(t)
+	secret := "JBSWY3DPEHPK3PXP"
+	override(t, &totpSecrets, map[string]string{"alice": secret})
+	override(t, &totpLastStep, map[string]int64{})
+
+	if w := serve(loginRequest()); w.Code != http.StatusUnauthorized {
+		t.Errorf("Login without a code returned %d", w.Code)
+	}
+
+	req := loginRequest()
+	req.Header.Set("X-Simpleauth-Totp", "000000")
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("Login with a wrong code returned %d", w.Code)
+	}
+
+	code, _ := totp.GenerateCode(secret, time.Now())
+	req = loginRequest()
+	req.Header.Set("X-Simpleauth-Totp", code)
+	if w := serve(req); w.Code != loginSuccessCode {
+		t.Errorf("Login with the right code returned %d", w.Code)
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	totpTestConfig(t)
+	secret := "JBSWY3DPEHPK3PXP"
+	override(t, &totpSecrets, map[string]string{"alice": secret, "bob": secret})
+	override(t, &totpLastStep, map[string]int64{})
+
+	now := time.Now()
+	code, _ := totp.GenerateCode(secret, now)
+	if !totpSatisfied("alice", code) {
+		t.Fatal("Fresh code rejected")
+	}
+	if totpSatisfied("alice", code) {
+		t.Error("Code accepted a second time")
+	}
+	if !totpSatisfied("bob", code) {
+		t.Error("Another user's use of a code counted against them")
+	}
+	earlier, _ := totp.GenerateCode(secret, now.Add(-totpPeriod*time.Second))
+	if earlier != code && totpSatisfied("alice", earlier) {
+		t.Error("Code older than the last one used was accepted")
+	}
+	later, _ := totp.GenerateCode(secret, now.Add(totpPeriod*time.Second))
+	if !totpSatisfied("alice", later) {
+		t.Error("Next period's code rejected")
+	}
+}
+
+func TestTOTPUserStore(t *testing.T) {
+	testConfig(t)
+	override(t, &totpLastStep, map[string]int64{})
+	secret := "JBSWY3DPEHPK3PXP"
+	passwords, err := readPasswords("passwd", strings.NewReader("alice:"+hashPassword(t, alicePassword)+" totp="+secret+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &cryptedPasswords, passwords)
+
+	if !totpEnabled() {
+		t.Error("TOTP not enabled with a secret in the user store")
+	}
+	if totpSecret("alice") != secret {
+		t.Errorf("Wrong secret %q", totpSecret("alice"))
+	}
+	if w := serve(loginRequest()); w.Code != http.StatusUnauthorized {
+		t.Errorf("Login without a code returned %d", w.Code)
+	}
+	code, _ := totp.GenerateCode(secret, time.Now())
+	req := loginRequest()
+	req.Header.Set("X-Simpleauth-Totp", code)
+	if w := serve(req); w.Code != loginSuccessCode {
+		t.Errorf("Login with the right code returned %d", w.Code)
+	}
+
+	// The user store is reloaded as a whole, secret and all
+	users, _ := json.Marshal([]jsonUser{{Username: "alice", Hash: hashPassword(t, alicePassword)}})
+	passwords, err = parseUsersJSON(string(users))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cryptedPasswords = passwords
+	if totpEnabled() || totpSecret("alice") != "" {
+		t.Error("Secret still in use after it was removed from the user store")
+	}
+	if w := serve(loginRequest()); w.Code != loginSuccessCode {
+		t.Errorf("Login without TOTP returned %d", w.Code)
+	}
+
+	if _, err := readPasswords("passwd", strings.NewReader("alice:$5$a$b totp=not-base32!\n")); err == nil {
+		t.Error("Accepted an invalid TOTP secret")
+	}
+}
+
+func TestTOTPUserStoreJSON(t *testing.T) {
+	testConfig(t)
+	override(t, &totpPath, filepath.Join(t.TempDir(), "totp"))
+	secret := "JBSWY3DPEHPK3PXP"
+	users, _ := json.Marshal([]jsonUser{{Username: "alice", Hash: hashPassword(t, alicePassword), Groups: []string{"dev"}, TOTP: secret}})
+	passwords, err := parseUsersJSON(string(users))
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &cryptedPasswords, passwords)
+
+	if totpSecret("alice") != secret {
+		t.Errorf("Wrong secret %q", totpSecret("alice"))
+	}
+	if groups := userGroups("alice"); len(groups) != 1 || groups[0] != "dev" {
+		t.Errorf("alice has groups %v", groups)
+	}
+	if err := checkPassword("alice", alicePassword); err != nil {
+		t.Errorf("alice can't log in: %v", err)
+	}
+	// A secret in the user store counts as enrolled
+	if w := enroll(t, ""); w.Code != http.StatusConflict {
+		t.Errorf("Enrolling returned %d", w.Code)
+	}
+}
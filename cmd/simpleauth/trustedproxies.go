@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the networks of proxies whose X-Real-IP and X-Forwarded-For headers
+// are believed when deciding who a request is from, for service accounts and throttle exemptions.
+// Anybody else could put any address they liked in those headers.
+// With none, decisions go by the address the request came from.
+var trustedProxies []netip.Prefix
+
+// trustedProxy returns true if ip is in trustedProxies
+func trustedProxy(ip netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses an address with an optional port
+func parseIP(addr string) (netip.Addr, bool) {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// trustedClientIP returns the address req came from, for decisions that grant access.
+// A trusted proxy's X-Real-IP is used, or failing that the nearest address in X-Forwarded-For
+// that isn't another trusted proxy. Otherwise it's the address of whoever connected.
+func trustedClientIP(req *http.Request) (netip.Addr, bool) {
+	peer, ok := parseIP(req.RemoteAddr)
+	if !ok || !trustedProxy(peer) {
+		return peer, ok
+	}
+	if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+		return parseIP(realIP)
+	}
+	// Each proxy appends the address it got the request from, so only the right end can be trusted
+	forwardedFor := req.Header.Values("X-Forwarded-For")
+	if len(forwardedFor) == 0 {
+		return peer, true
+	}
+	hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseIP(hops[i])
+		if !ok {
+			return netip.Addr{}, false
+		}
+		if !trustedProxy(ip) {
+			return ip, true
+		}
+	}
+	return peer, true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestTrustedClientIP(t *testing.T) {
+	override(t, &trustedProxies, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+
+	for _, tc := range []struct {
+		remote, realIP, forwardedFor string
+		want                         string
+	}{
+		{"192.0.2.1:1234", "203.0.113.7", "", "192.0.2.1"},
+		{"10.0.0.2:1234", "203.0.113.7", "", "203.0.113.7"},
+		{"10.0.0.2:1234", "", "203.0.113.7, 198.51.100.9", "198.51.100.9"},
+		{"10.0.0.2:1234", "", "203.0.113.7, 198.51.100.9, 10.0.0.3", "198.51.100.9"},
+		{"10.0.0.2:1234", "", "", "10.0.0.2"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		ip, ok := trustedClientIP(req)
+		if !ok || ip.String() != tc.want {
+			t.Errorf("%+v: got %v %v, want %s", tc, ip, ok, tc.want)
+		}
+	}
+}
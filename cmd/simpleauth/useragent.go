@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+// uaBinding ties tokens to the User-Agent they were issued to, so a stolen cookie is less use elsewhere:
+// "off"; "exact", for the whole User-Agent; or "family", ignoring version numbers,
+// so tokens survive browser updates
+var uaBinding = "off"
+
+// uaBindings are the allowed values for uaBinding
+var uaBindings = []string{"off", "exact", "family"}
+
+// uaVersionRE matches version numbers in a User-Agent
+var uaVersionRE = regexp.MustCompile(`[0-9]+([._][0-9]+)*`)
+
+// uaHash returns the hash of req's User-Agent recorded in tokens, according to uaBinding
+func uaHash(req *http.Request) string {
+	ua := req.UserAgent()
+	if uaBinding == "family" {
+		ua = uaVersionRE.ReplaceAllString(ua, "")
+	}
+	sum := sha256.Sum256([]byte(ua))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// uaMatches returns true if t may be used by req's User-Agent.
+// Tokens issued without a User-Agent don't match, once binding is on.
+func uaMatches(t token.T, req *http.Request) bool {
+	if uaBinding == "off" {
+		return true
+	}
+	return t.UserAgent == uaHash(req)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const (
+	firefox120 = "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	firefox121 = "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+	chrome     = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+)
+
+func TestUABinding(t *testing.T) {
+	cases := []struct {
+		binding string
+		ua      string
+		ok      bool
+	}{
+		{"off", chrome, true},
+		{"exact", firefox120, true},
+		{"exact", firefox121, false},
+		{"exact", chrome, false},
+		{"family", firefox120, true},
+		{"family", firefox121, true},
+		{"family", chrome, false},
+	}
+	for _, c := range cases {
+		testConfig(t)
+		override(t, &uaBinding, c.binding)
+
+		login := loginRequest()
+		login.Header.Set("User-Agent", firefox120)
+		tok := cookieToken(t, serve(login).Header().Get("Set-Cookie"))
+
+		req := requestWithToken(tok)
+		req.Header.Set("User-Agent", c.ua)
+		w := serve(req)
+		if ok := w.Code == http.StatusOK; ok != c.ok {
+			t.Errorf("%s binding, presented by %q: got %d", c.binding, c.ua, w.Code)
+		}
+	}
+}
+
+func TestUABindingUnboundToken(t *testing.T) {
+	testConfig(t)
+	tok := cookieToken(t, serve(loginRequest()).Header().Get("Set-Cookie"))
+
+	override(t, &uaBinding, "family")
+	if w := serve(requestWithToken(tok)); w.Code == http.StatusOK {
+		t.Error("Token without a User-Agent accepted once binding is on")
+	}
+}
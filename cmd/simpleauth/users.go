@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Reasons a user can't log in
+var (
+	errUnknownUser  = errors.New("unknown user")
+	errBadPassword  = errors.New("bad password")
+	errUserDisabled = errors.New("account disabled")
+	errUserExpired  = errors.New("account expired")
+)
+
+// revealLoginFailures tells clients whether a failed login had an unknown username or a wrong password.
+// That tells anyone which usernames exist, so it's only for trusted deployments, while debugging.
+var revealLoginFailures bool
+
+// genericLoginFailure is what clients are told about a failed login, unless there's more to say
+const genericLoginFailure = "invalid username or password"
+
+// expiredAccountMessage is what someone who logs in correctly to an expired account is told,
+// instead of the generic failure, so they know to get it renewed ("" for the generic failure)
+var expiredAccountMessage = "Your account has expired: contact your administrator"
+
+// loginFailureDetail returns what to tell a client about credentials that didn't work,
+// given why they were refused, from authenticationValid.
+// Unless revealLoginFailures is on, that's the same for every failure,
+// except the right password for an expired account.
+func loginFailureDetail(refused error) string {
+	switch {
+	case errors.Is(refused, errUserExpired) && expiredAccountMessage != "":
+		return expiredAccountMessage
+	case !revealLoginFailures:
+		return genericLoginFailure
+	case errors.Is(refused, errUnknownUser):
+		return "unknown user"
+	case errors.Is(refused, errBadPassword):
+		return "wrong password"
+	}
+	return genericLoginFailure
+}
+
+// hashUsernames stores usernames as keyed hashes, so the list of users can't be read out of memory
+var hashUsernames bool
+
+// usernameKey keys the username hashes.
+// It's made fresh at startup, so the hashes can't be looked up in a precomputed table.
+var usernameKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// userKey returns the key for username in cryptedPasswords
+func userKey(username string) string {
+	if !hashUsernames {
+		return username
+	}
+	mac := hmac.New(sha256.New, usernameKey)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// logName returns username as it goes in diagnostic logs:
+// its key when usernames are hashed, so the logs don't list the users either
+func logName(username string) string {
+	return userKey(username)
+}
+
+// splitUserEntry splits a password entry into its hash and optional attributes.
+//
+// Attributes follow the hash, separated by whitespace, as key=value:
+//
+//	alice:$5$salt$hash groups=admin,dev expires=2025-12-31
+//	bob:$5$salt$hash disabled paths=/public/,/bob/*
+//	carol:$5$salt$hash totp=JBSWY3DPEHPK3PXP
+func splitUserEntry(entry string) (hash string, attrs map[string]string) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	attrs = make(map[string]string)
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		attrs[key] = value
+	}
+	return fields[0], attrs
+}
+
+// userGroups returns the groups configured for username, if any
+func userGroups(username string) []string {
+	return entryGroups(currentUsers()[userKey(username)])
+}
+
+// entryGroups returns the groups attribute of a password entry
+func entryGroups(entry string) []string {
+	_, attrs := splitUserEntry(entry)
+	return splitGroups(attrs["groups"])
+}
+
+// pathAllowed returns true if username may visit the path of uri.
+//
+// The paths attribute lists path.Match patterns, separated by commas;
+// a pattern ending in / also matches everything under it.
+// Users without one may go anywhere.
+func pathAllowed(username, uri string) bool {
+	_, attrs := splitUserEntry(currentUsers()[userKey(username)])
+	patterns, ok := attrs["paths"]
+	if !ok {
+		return true
+	}
+	return pathMatches(strings.Split(patterns, ","), uri)
+}
+
+// requestPath returns the path of uri, decoded and cleaned up the way the upstream will see it,
+// so /public/%2e%2e/admin/ is /admin/.
+// It returns false if the path can't be decoded, or has an encoded slash,
+// which upstreams disagree about whether to take as a separator.
+func requestPath(uri string) (string, bool) {
+	p, _, _ := strings.Cut(uri, "?")
+	if strings.Contains(strings.ToLower(p), "%2f") {
+		return "", false
+	}
+	p, err := url.PathUnescape(p)
+	if err != nil {
+		return "", false
+	}
+	// Clean up /public/../admin and the like before matching
+	return path.Clean("/" + p), true
+}
+
+// pathMatches returns true if the path of uri matches one of patterns.
+// Patterns are for path.Match, except that one ending in / also matches everything under it.
+// A path requestPath can't make sense of matches nothing.
+func pathMatches(patterns []string, uri string) bool {
+	p, ok := requestPath(uri)
+	if !ok {
+		debugf("can't match patterns against path %q", uri)
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if strings.HasSuffix(pattern, "/") && (p+"/" == pattern || strings.HasPrefix(p, pattern)) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pathRequires returns true if the path of uri matches one of patterns that impose a requirement,
+// or it can't be matched against them, so the requirement can't be dodged by encoding the path
+func pathRequires(patterns []string, uri string) bool {
+	if _, ok := requestPath(uri); !ok {
+		return true
+	}
+	return pathMatches(patterns, uri)
+}
+
+// requiredGroups, if any, are the groups a user must be in one of to get through.
+// The proxy can set X-Simpleauth-Required-Groups to require groups for a route as well.
+// That can only narrow access, since a client could send the header too.
+var requiredGroups []string
+
+// splitGroups splits a comma-separated list of groups
+func splitGroups(list string) []string {
+	var groups []string
+	for _, group := range strings.Split(list, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// groupAllowed returns true if username is in one of the configured required groups,
+// and one of the groups the proxy requires for req
+func groupAllowed(username string, req *http.Request) bool {
+	groups := userGroups(username)
+	return inAnyGroup(groups, requiredGroups) &&
+		inAnyGroup(groups, splitGroups(req.Header.Get("X-Simpleauth-Required-Groups")))
+}
+
+// inAnyGroup returns true if groups includes one of required, or nothing is required
+func inAnyGroup(groups, required []string) bool {
+	if len(required) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(required, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExpires parses an expires attribute: a date (meaning the start of that day, UTC), or an RFC 3339 time
+func parseExpires(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// checkPassword returns nil if username may log in with password,
+// or an error saying why not.
+func checkPassword(username, password string) error {
+	entry, ok := currentUsers()[userKey(username)]
+	if !ok {
+		return errUnknownUser
+	}
+	crypted, attrs := splitUserEntry(entry)
+
+	debugf("verifying password for username:%v", logName(username))
+	if err := verifyHash(crypted, []byte(password)); err != nil {
+		if strings.Contains(err.Error(), "invalid salt") {
+			debugf("INVALID SALT FORMAT: This usually means dollar signs in hash were not wrapped in single quotes in the environment variable")
+		}
+		return fmt.Errorf("%w: %v", errBadPassword, err)
+	}
+
+	if _, ok := attrs["disabled"]; ok {
+		return errUserDisabled
+	}
+	if expires, ok := attrs["expires"]; ok {
+		t, err := parseExpires(expires)
+		if err != nil {
+			return fmt.Errorf("invalid expires %q: %w", expires, err)
+		}
+		if !time.Now().Before(t) {
+			return fmt.Errorf("%w on %s", errUserExpired, t.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashedUsernames(t *testing.T) {
+	testConfig(t)
+	override(t, &hashUsernames, true)
+	fn := filepath.Join(t.TempDir(), "passwd")
+	entry := "alice:" + hashPassword(t, alicePassword) + " groups=admin\n"
+	if err := os.WriteFile(fn, []byte(entry), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	passwords, err := getPasswords(fn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range passwords {
+		if strings.Contains(key, "alice") {
+			t.Errorf("Plaintext username stored: %q", key)
+		}
+	}
+	override(t, &cryptedPasswords, passwords)
+
+	if w := serve(basicRequest("alice", alicePassword)); w.Code != http.StatusOK {
+		t.Errorf("Hashed username login returned %d", w.Code)
+	}
+	if w := serve(basicRequest("alice", "wrong")); w.Code == http.StatusOK {
+		t.Error("Bad password accepted with hashed usernames")
+	}
+	if w := serve(basicRequest("mallory", alicePassword)); w.Code == http.StatusOK {
+		t.Error("Unknown user accepted with hashed usernames")
+	}
+	if groups := userGroups("alice"); len(groups) != 1 || groups[0] != "admin" {
+		t.Errorf("Wrong groups: %v", groups)
+	}
+}
+
+func TestHashedUsernamesNotLogged(t *testing.T) {
+	testConfig(t)
+	override(t, &hashUsernames, true)
+	override(t, &verbose, true)
+	buf := captureLog(t)
+
+	hash := hashPassword(t, alicePassword)
+	passwords, err := readPasswords("passwd", strings.NewReader("alice:"+hash+"\nalice:"+hash+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	override(t, &cryptedPasswords, passwords)
+	serve(basicRequest("alice", alicePassword))
+	serve(basicRequest("alice", "wrong"))
+
+	if !strings.Contains(buf.String(), userKey("alice")) {
+		t.Errorf("Username key not logged: %q", buf)
+	}
+	if strings.Contains(buf.String(), "alice") {
+		t.Errorf("Plaintext username logged: %q", buf)
+	}
+}
+
+func TestDisabledAndExpiredUsers(t *testing.T) {
+	testConfig(t)
+	hash := hashPassword(t, alicePassword)
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hash + " expires=2099-01-01",
+		"bob":   hash + " disabled",
+		"carol": hash + " expires=2001-01-01",
+	})
+
+	if w := serve(basicRequest("alice", alicePassword)); w.Code != http.StatusOK {
+		t.Errorf("Unexpired user returned %d", w.Code)
+	}
+	if w := serve(basicRequest("bob", alicePassword)); w.Code == http.StatusOK {
+		t.Error("Disabled user authenticated")
+	}
+	if w := serve(basicRequest("carol", alicePassword)); w.Code == http.StatusOK {
+		t.Error("Expired user authenticated")
+	}
+}
+
+func TestAllowedPaths(t *testing.T) {
+	testConfig(t)
+	hash := hashPassword(t, alicePassword)
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hash + " paths=/admin/,/reports/*.pdf",
+		"bob":   hash + " paths=/public/",
+		"carol": hash,
+	})
+
+	cases := []struct {
+		username string
+		uri      string
+		code     int
+	}{
+		{"alice", "/admin/", http.StatusOK},
+		{"alice", "/admin/users?page=2", http.StatusOK},
+		{"alice", "/reports/q1.pdf", http.StatusOK},
+		{"alice", "/reports/q1.csv", http.StatusForbidden},
+		{"bob", "/public/index.html", http.StatusOK},
+		{"bob", "/admin/", http.StatusForbidden},
+		{"bob", "/public/../admin/", http.StatusForbidden},
+		{"bob", "/public/%2e%2e/admin/", http.StatusForbidden},
+		{"bob", "/public/%2E%2E/admin/", http.StatusForbidden},
+		{"bob", "/public/..%2fadmin/", http.StatusForbidden},
+		{"bob", "/public/%zz", http.StatusForbidden},
+		{"bob", "/public/caf%C3%A9", http.StatusOK},
+		{"bob", "/publicity", http.StatusForbidden},
+		{"carol", "/admin/", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := basicRequest(c.username, alicePassword)
+		req.Header.Set("X-Forwarded-Uri", c.uri)
+		if w := serve(req); w.Code != c.code {
+			t.Errorf("%s visiting %s returned %d, wanted %d", c.username, c.uri, w.Code, c.code)
+		}
+	}
+}
+
+func TestRequiredGroups(t *testing.T) {
+	testConfig(t)
+	hash := hashPassword(t, alicePassword)
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hash + " groups=staff,admin",
+		"bob":   hash + " groups=staff",
+		"carol": hash,
+	})
+	override(t, &requiredGroups, splitGroups("admin, ops"))
+
+	if w := serve(basicRequest("alice", alicePassword)); w.Code != http.StatusOK {
+		t.Errorf("User in a required group returned %d", w.Code)
+	}
+	if w := serve(basicRequest("bob", alicePassword)); w.Code != http.StatusForbidden {
+		t.Errorf("User not in a required group returned %d", w.Code)
+	}
+	if w := serve(basicRequest("carol", alicePassword)); w.Code != http.StatusForbidden {
+		t.Errorf("User with no groups returned %d", w.Code)
+	}
+
+	// The proxy can require more groups for a route, but not fewer
+	req := basicRequest("bob", alicePassword)
+	req.Header.Set("X-Simpleauth-Required-Groups", "staff")
+	if w := serve(req); w.Code != http.StatusForbidden {
+		t.Errorf("Route's required group let in a user outside the configured ones: %d", w.Code)
+	}
+	req = basicRequest("alice", alicePassword)
+	req.Header.Set("X-Simpleauth-Required-Groups", "ops")
+	if w := serve(req); w.Code != http.StatusForbidden {
+		t.Errorf("User not in the route's required group returned %d", w.Code)
+	}
+
+	override(t, &requiredGroups, nil)
+	req = basicRequest("bob", alicePassword)
+	req.Header.Set("X-Simpleauth-Required-Groups", "staff")
+	if w := serve(req); w.Code != http.StatusOK {
+		t.Errorf("User in the route's required group returned %d", w.Code)
+	}
+	req = basicRequest("carol", alicePassword)
+	req.Header.Set("X-Simpleauth-Required-Groups", "staff")
+	if w := serve(req); w.Code != http.StatusForbidden {
+		t.Errorf("User not in the route's required group returned %d", w.Code)
+	}
+
+	// A group the client sends ahead of the proxy's doesn't count
+	req = basicRequest("bob", alicePassword)
+	req.Header.Add("X-Simpleauth-Required-Groups", "staff")
+	req.Header.Add("X-Simpleauth-Required-Groups", "ops")
+	if w := serve(req); w.Code != http.StatusForbidden {
+		t.Errorf("Client-supplied required group widened access: %d", w.Code)
+	}
+}
+
+func TestLoginFailureDetail(t *testing.T) {
+	testConfig(t)
+
+	// Off, unknown users and wrong passwords look the same
+	unknown := apiLogin("mallory", alicePassword)
+	wrong := apiLogin("alice", "wrong")
+	if unknown.Body.String() != wrong.Body.String() {
+		t.Errorf("Failures differ: %q and %q", unknown.Body, wrong.Body)
+	}
+	if got := serve(basicRequest("mallory", "x")).Header().Get("X-Simpleauth-Failure"); got != "" {
+		t.Errorf("Failure detail sent while off: %q", got)
+	}
+
+	override(t, &revealLoginFailures, true)
+	if body := apiLogin("mallory", alicePassword).Body.String(); !strings.Contains(body, "unknown user") {
+		t.Errorf("Unknown user not reported: %q", body)
+	}
+	if body := apiLogin("alice", "wrong").Body.String(); !strings.Contains(body, "wrong password") {
+		t.Errorf("Wrong password not reported: %q", body)
+	}
+	if got := serve(basicRequest("mallory", "x")).Header().Get("X-Simpleauth-Failure"); got != "unknown user" {
+		t.Errorf("Wrong forward-auth failure detail: %q", got)
+	}
+	if got := serve(basicRequest("alice", "wrong")).Header().Get("X-Simpleauth-Failure"); got != "wrong password" {
+		t.Errorf("Wrong forward-auth failure detail: %q", got)
+	}
+}
+
+func TestExpiredAccountMessage(t *testing.T) {
+	testConfig(t)
+	hash := hashPassword(t, alicePassword)
+	override(t, &cryptedPasswords, map[string]string{
+		"alice": hash + " expires=2099-01-01",
+		"carol": hash + " expires=2001-01-01",
+	})
+
+	if got := serve(basicRequest("carol", alicePassword)).Header().Get("X-Simpleauth-Failure"); got != expiredAccountMessage {
+		t.Errorf("Wrong forward-auth failure for an expired account: %q", got)
+	}
+	if body := apiLogin("carol", alicePassword).Body.String(); !strings.Contains(body, expiredAccountMessage) {
+		t.Errorf("Wrong API failure for an expired account: %q", body)
+	}
+
+	// Only someone with the right password finds out
+	if got := serve(basicRequest("carol", "wrong")).Header().Get("X-Simpleauth-Failure"); got != "" {
+		t.Errorf("Expiry revealed without the password: %q", got)
+	}
+	if body := apiLogin("carol", "wrong").Body.String(); strings.Contains(body, expiredAccountMessage) {
+		t.Errorf("Expiry revealed without the password: %q", body)
+	}
+	if got := serve(basicRequest("alice", "wrong")).Header().Get("X-Simpleauth-Failure"); got != "" {
+		t.Errorf("Failure detail for an unexpired account: %q", got)
+	}
+
+	override(t, &expiredAccountMessage, "Ask Bob to renew your account")
+	if got := serve(basicRequest("carol", alicePassword)).Header().Get("X-Simpleauth-Failure"); got != "Ask Bob to renew your account" {
+		t.Errorf("Custom message not used: %q", got)
+	}
+
+	override(t, &expiredAccountMessage, "")
+	if got := serve(basicRequest("carol", alicePassword)).Header().Get("X-Simpleauth-Failure"); got != "" {
+		t.Errorf("Expiry revealed with the message off: %q", got)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// jsonUser is one user in SIMPLEAUTH_USERS_JSON
+type jsonUser struct {
+	Username string   `json:"username"`
+	Hash     string   `json:"hash"`
+	Groups   []string `json:"groups,omitempty"`
+	// TOTP is the user's base32 TOTP secret, if they use one
+	TOTP string `json:"totp,omitempty"`
+}
+
+// usersEnvVar returns the environment variable users come from:
+// SIMPLEAUTH_USERS_JSON, the deprecated SIMPLEAUTH_USERS, or "" if neither is set
+func usersEnvVar() string {
+	for _, name := range []string{"SIMPLEAUTH_USERS_JSON", "SIMPLEAUTH_USERS"} {
+		if os.Getenv(name) != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// loadPasswordsFromEnv loads passwords from SIMPLEAUTH_USERS_JSON,
+// or, with a deprecation warning, SIMPLEAUTH_USERS
+func loadPasswordsFromEnv() (map[string]string, error) {
+	usersJSON := os.Getenv("SIMPLEAUTH_USERS_JSON")
+	if usersJSON == "" {
+		return loadPasswordsFromUsersEnv()
+	}
+	if os.Getenv("SIMPLEAUTH_USERS") != "" {
+		return nil, fmt.Errorf("SIMPLEAUTH_USERS and SIMPLEAUTH_USERS_JSON are both set: use only SIMPLEAUTH_USERS_JSON")
+	}
+	return parseUsersJSON(usersJSON)
+}
+
+// parseUsersJSON parses users in SIMPLEAUTH_USERS_JSON format:
+//
+//	[{"username": "alice", "hash": "$5$salt$hash", "groups": ["admin", "dev"], "totp": "JBSWY3DPEHPK3PXP"}]
+//
+// Entries become the same hash and attributes as a password file line.
+func parseUsersJSON(s string) (map[string]string, error) {
+	var users []jsonUser
+	if err := json.Unmarshal([]byte(s), &users); err != nil {
+		return nil, fmt.Errorf("SIMPLEAUTH_USERS_JSON: %w", err)
+	}
+	passwords := make(map[string]string)
+	seen := make(map[string]int)
+	for i, u := range users {
+		where := fmt.Sprintf("SIMPLEAUTH_USERS_JSON entry %d", i+1)
+		username := strings.ToLower(strings.TrimSpace(u.Username))
+		hash := strings.TrimSpace(u.Hash)
+		if username == "" || hash == "" || strings.ContainsAny(hash, " \t\n") {
+			if err := malformedUser(where, username); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, group := range u.Groups {
+			if group == "" || strings.ContainsAny(group, ", \t\n") {
+				return nil, fmt.Errorf("%s: invalid group %q for %q", where, group, logName(username))
+			}
+		}
+		if u.TOTP != "" && !validTOTPSecret(u.TOTP) {
+			return nil, fmt.Errorf("%s: invalid TOTP secret for %q, expected base32", where, logName(username))
+		}
+		key := userKey(username)
+		if first, dup := seen[key]; dup {
+			if err := duplicateUser("SIMPLEAUTH_USERS_JSON entries", username, first, i+1); err != nil {
+				return nil, err
+			}
+		} else {
+			seen[key] = i + 1
+		}
+		entry := hash
+		if len(u.Groups) > 0 {
+			entry += " groups=" + strings.Join(u.Groups, ",")
+		}
+		if u.TOTP != "" {
+			entry += " totp=" + u.TOTP
+		}
+		passwords[key] = entry
+	}
+	return passwords, nil
+}
+
+// loadPasswordsFromUsersEnv loads passwords from the deprecated SIMPLEAUTH_USERS env var
+// Format: SIMPLEAUTH_USERS="user1:password1,user2:password2"
+func loadPasswordsFromUsersEnv() (map[string]string, error) {
+	passwords := make(map[string]string)
+	users := os.Getenv("SIMPLEAUTH_USERS")
+	if users == "" {
+		return passwords, nil
+	}
+	log.Println("Warning: SIMPLEAUTH_USERS is deprecated: run 'simpleauth migrate-users' to convert it to SIMPLEAUTH_USERS_JSON")
+
+	pairs := strings.Split(users, ",")
+	seen := make(map[string]int)
+	for i, pair := range pairs {
+		username, hash, ok := parseUserLine(pair, ":")
+		if !ok {
+			if err := malformedUser(fmt.Sprintf("SIMPLEAUTH_USERS entry %d", i+1), entryUsername(pair, ":")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		key := userKey(username)
+		if first, dup := seen[key]; dup {
+			if err := duplicateUser("SIMPLEAUTH_USERS entries", username, first, i+1); err != nil {
+				return nil, err
+			}
+		} else {
+			seen[key] = i + 1
+		}
+		passwords[key] = hash
+	}
+	return passwords, nil
+}
+
+// runMigrateUsers is the "simpleauth migrate-users" subcommand.
+// It prints SIMPLEAUTH_USERS as the value to use for SIMPLEAUTH_USERS_JSON.
+// It returns the exit status.
+func runMigrateUsers(stdout io.Writer) int {
+	users := os.Getenv("SIMPLEAUTH_USERS")
+	if users == "" {
+		fmt.Fprintln(stdout, "SIMPLEAUTH_USERS is not set")
+		return 2
+	}
+	var migrated []jsonUser
+	for i, pair := range strings.Split(users, ",") {
+		username, entry, ok := parseUserLine(pair, ":")
+		if !ok {
+			username, _, _ = strings.Cut(pair, ":")
+			fmt.Fprintf(stdout, "SIMPLEAUTH_USERS entry %d: invalid user format for %q, expected 'username:hash'\n", i+1, username)
+			return 1
+		}
+		hash, attrs := splitUserEntry(entry)
+		totpKey := attrs["totp"]
+		delete(attrs, "groups")
+		delete(attrs, "totp")
+		if len(attrs) > 0 {
+			var names []string
+			for name := range attrs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Fprintf(stdout, "SIMPLEAUTH_USERS entry %d: %q has attributes SIMPLEAUTH_USERS_JSON can't hold: %s\n",
+				i+1, username, strings.Join(names, ", "))
+			return 1
+		}
+		migrated = append(migrated, jsonUser{
+			Username: username,
+			Hash:     hash,
+			Groups:   entryGroups(entry),
+			TOTP:     totpKey,
+		})
+	}
+	out, err := json.Marshal(migrated)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	fmt.Fprintln(stdout, string(out))
+	return 0
+}
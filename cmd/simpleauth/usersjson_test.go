@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUsersJSON(t *testing.T) {
+	testConfig(t)
+	users, err := json.Marshal([]jsonUser{
+		{Username: "Alice", Hash: hashPassword(t, alicePassword), Groups: []string{"admin", "dev"}},
+		{Username: "bob", Hash: "$5$salt$hash"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SIMPLEAUTH_USERS", "")
+	t.Setenv("SIMPLEAUTH_USERS_JSON", string(users))
+
+	if v := usersEnvVar(); v != "SIMPLEAUTH_USERS_JSON" {
+		t.Errorf("usersEnvVar returned %q", v)
+	}
+	passwords, err := getPasswords(filepath.Join(t.TempDir(), "passwd"), usersEnvVar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 2 || passwords["bob"] != "$5$salt$hash" {
+		t.Errorf("Wrong users: %v", passwords)
+	}
+	override(t, &cryptedPasswords, passwords)
+
+	if err := checkPassword("alice", alicePassword); err != nil {
+		t.Errorf("alice can't log in: %v", err)
+	}
+	if groups := userGroups("alice"); !slices.Equal(groups, []string{"admin", "dev"}) {
+		t.Errorf("alice has groups %v", groups)
+	}
+	if groups := userGroups("bob"); groups != nil {
+		t.Errorf("bob has groups %v", groups)
+	}
+}
+
+func TestUsersJSONInvalid(t *testing.T) {
+	testConfig(t)
+	for _, users := range []string{
+		`{"username": "alice"}`,
+		`[{"username": "alice", "hash": "$5$a$b", "groups": ["admin,dev"]}]`,
+		`[{"username": "alice", "hash": "$5$a$b", "groups": ["red team"]}]`,
+		`[{"username": "alice", "hash": "$5$a$b", "groups": [""]}]`,
+		`[{"username": "alice", "hash": "$5$a$b", "totp": "not base32!"}]`,
+	} {
+		if _, err := parseUsersJSON(users); err == nil {
+			t.Errorf("Accepted %s", users)
+		}
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	passwords, err := parseUsersJSON(`[{"username": "alice", "hash": ""}, {"username": "bob", "hash": "$5$a$b"}, {"username": "Bob", "hash": "$5$c$d"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 1 || passwords["bob"] != "$5$c$d" {
+		t.Errorf("Wrong users: %v", passwords)
+	}
+	for _, want := range []string{`entry 1: invalid user format for "alice"`, `entries 2 and 3: duplicate username "bob"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Log doesn't say %q: %q", want, buf.String())
+		}
+	}
+
+	override(t, &strictUsers, true)
+	if _, err := parseUsersJSON(`[{"username": "alice", "hash": "$5$a$b"}, {"username": "alice", "hash": "$5$a$b"}]`); err == nil {
+		t.Error("Strict mode accepted a duplicate")
+	}
+}
+
+func TestUsersJSONAndUsers(t *testing.T) {
+	t.Setenv("SIMPLEAUTH_USERS", "alice:$5$a$b")
+	t.Setenv("SIMPLEAUTH_USERS_JSON", `[{"username": "bob", "hash": "$5$c$d"}]`)
+	if _, err := loadPasswordsFromEnv(); err == nil {
+		t.Error("Accepted both SIMPLEAUTH_USERS and SIMPLEAUTH_USERS_JSON")
+	}
+}
+
+func TestUsersDeprecated(t *testing.T) {
+	testConfig(t)
+	t.Setenv("SIMPLEAUTH_USERS", "alice:$5$a$b")
+	t.Setenv("SIMPLEAUTH_USERS_JSON", "")
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	passwords, err := loadPasswordsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passwords["alice"] != "$5$a$b" {
+		t.Errorf("Wrong users: %v", passwords)
+	}
+	if !strings.Contains(buf.String(), "SIMPLEAUTH_USERS is deprecated") {
+		t.Errorf("No deprecation warning: %q", buf.String())
+	}
+}
+
+func TestMigrateUsers(t *testing.T) {
+	testConfig(t)
+	t.Setenv("SIMPLEAUTH_USERS", "Alice:$5$a$b groups=admin,bob:$5$c$d totp=JBSWY3DPEHPK3PXP")
+	var out bytes.Buffer
+	if status := runMigrateUsers(&out); status != 0 {
+		t.Fatalf("Exit status %d: %s", status, out.String())
+	}
+
+	// What it prints must load as the same users
+	t.Setenv("SIMPLEAUTH_USERS", "")
+	t.Setenv("SIMPLEAUTH_USERS_JSON", out.String())
+	passwords, err := loadPasswordsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwords) != 2 || passwords["alice"] != "$5$a$b groups=admin" || passwords["bob"] != "$5$c$d totp=JBSWY3DPEHPK3PXP" {
+		t.Errorf("Migrated to the wrong users: %v", passwords)
+	}
+
+	t.Setenv("SIMPLEAUTH_USERS", "alice:$5$a$b disabled")
+	out.Reset()
+	if status := runMigrateUsers(&out); status != 1 || !strings.Contains(out.String(), "disabled") {
+		t.Errorf("Migrated an attribute it can't hold: %d %s", status, out.String())
+	}
+}
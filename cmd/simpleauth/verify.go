@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runVerify is the "simpleauth verify" subcommand.
+// It loads the configured users and says whether the given credentials would log in, and if not, why.
+// It returns the exit status.
+func runVerify(args []string, stdin io.Reader, stdout io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	passwordPath := flags.String(
+		"passwd",
+		getEnvWithFallback("SIMPLEAUTH_PASSWORD_FILE", "/run/secrets/passwd"),
+		"Path to a file containing passwords",
+	)
+	separator := flags.String(
+		"passwd-separator",
+		getEnvWithFallback("SIMPLEAUTH_PASSWORD_SEPARATOR", ":"),
+		"Separator between username and hash in the password file",
+	)
+	passwdKeyPath := flags.String(
+		"passwd-key-file",
+		os.Getenv("SIMPLEAUTH_PASSWD_KEY_FILE"),
+		"age identity file, to decrypt an encrypted password file",
+	)
+	flags.StringVar(
+		&usersPolicy,
+		"users-policy",
+		getEnvWithFallback("SIMPLEAUTH_USERS_POLICY", usersPolicy),
+		"When users in the environment and the password file are both present: override or merge",
+	)
+	flags.Usage = func() {
+		fmt.Fprintln(stdout, "Usage: simpleauth verify [options] USERNAME [PASSWORD]")
+		fmt.Fprintln(stdout, "Without PASSWORD, it's read from standard input.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+
+	username := strings.ToLower(flags.Arg(0))
+	password := flags.Arg(1)
+	if flags.NArg() == 1 {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			fmt.Fprintf(stdout, "reading password: %v\n", err)
+			return 2
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	passwdSeparator = parseSeparator(*separator)
+	ids, err := loadPasswordIdentities(*passwdKeyPath, os.Getenv("SIMPLEAUTH_PASSWD_KEY"))
+	if err != nil {
+		fmt.Fprintf(stdout, "loading password key: %v\n", err)
+		return 2
+	}
+	passwordIdentities = ids
+	passwords, err := getPasswords(*passwordPath, usersEnvVar())
+	if err != nil {
+		fmt.Fprintf(stdout, "loading users: %v\n", err)
+		return 2
+	}
+	configLock.Lock()
+	cryptedPasswords = passwords
+	configLock.Unlock()
+
+	if err := checkPassword(username, password); err != nil {
+		fmt.Fprintf(stdout, "%s would not authenticate: %v\n", username, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s would authenticate\n", username)
+	return 0
+}
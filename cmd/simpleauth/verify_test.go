@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+func TestVerify(t *testing.T) {
+	testConfig(t)
+	t.Setenv("SIMPLEAUTH_USERS", "")
+	override(t, &passwdSeparator, passwdSeparator)
+	override(t, &usersPolicy, usersPolicy)
+
+	hash := hashPassword(t, alicePassword)
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	fn := filepath.Join(t.TempDir(), "passwd")
+	users := strings.Join([]string{
+		"alice:" + hash,
+		"bob:" + hash + " disabled",
+		"carol:" + hash + " expires=2001-01-01",
+		"dave:" + hash + " expires=" + tomorrow,
+	}, "\n")
+	if err := os.WriteFile(fn, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		args   []string
+		stdin  string
+		status int
+		output string
+	}{
+		{[]string{"alice", alicePassword}, "", 0, "alice would authenticate"},
+		{[]string{"alice"}, alicePassword + "\n", 0, "alice would authenticate"},
+		{[]string{"mallory", alicePassword}, "", 1, "unknown user"},
+		{[]string{"alice", "wrong"}, "", 1, "bad password"},
+		{[]string{"bob", alicePassword}, "", 1, "account disabled"},
+		{[]string{"carol", alicePassword}, "", 1, "account expired"},
+		{[]string{"dave", alicePassword}, "", 0, "dave would authenticate"},
+		{[]string{}, "", 2, "Usage"},
+	}
+	for _, c := range cases {
+		out := new(bytes.Buffer)
+		args := append([]string{"-passwd", fn}, c.args...)
+		status := runVerify(args, strings.NewReader(c.stdin), out)
+		if status != c.status || !strings.Contains(out.String(), c.output) {
+			t.Errorf("verify %v: status %d, output %q", c.args, status, out)
+		}
+	}
+}
+
+func TestVerifyEncrypted(t *testing.T) {
+	testConfig(t)
+	t.Setenv("SIMPLEAUTH_USERS", "")
+	override(t, &passwdSeparator, passwdSeparator)
+	override(t, &usersPolicy, usersPolicy)
+	override(t, &passwordIdentities, nil)
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := writeEncrypted(t, id.Recipient(), "alice:"+hashPassword(t, alicePassword)+"\n", false)
+
+	t.Setenv("SIMPLEAUTH_PASSWD_KEY", "")
+	out := new(bytes.Buffer)
+	if status := runVerify([]string{"-passwd", fn, "alice", alicePassword}, strings.NewReader(""), out); status != 2 {
+		t.Errorf("verify without key: status %d, output %q", status, out)
+	}
+
+	t.Setenv("SIMPLEAUTH_PASSWD_KEY", id.String())
+	out.Reset()
+	if status := runVerify([]string{"-passwd", fn, "alice", alicePassword}, strings.NewReader(""), out); status != 0 {
+		t.Errorf("verify with key: status %d, output %q", status, out)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// verifySlots limits how many password verifications run at once, or is nil for no limit.
+// Hashing is deliberately slow, so a burst of logins could otherwise eat every CPU.
+var verifySlots chan struct{}
+
+// verifyQueueTimeout is how long a verification waits for a slot before being shed
+var verifyQueueTimeout = time.Second
+
+// newVerifySlots returns a semaphore allowing n concurrent verifications, or nil if n is 0
+func newVerifySlots(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// acquireVerifySlot waits for a verification slot.
+// It returns a function to release the slot, or false if none came free in time.
+func acquireVerifySlot(ctx context.Context) (release func(), ok bool) {
+	if verifySlots == nil {
+		return func() {}, true
+	}
+	timer := time.NewTimer(verifyQueueTimeout)
+	defer timer.Stop()
+	select {
+	case verifySlots <- struct{}{}:
+		return func() { <-verifySlots }, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
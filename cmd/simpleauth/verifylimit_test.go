@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"git.woozle.org/neale/simpleauth/pkg/token"
+)
+
+func TestVerificationShed(t *testing.T) {
+	testConfig(t)
+	override(t, &verifySlots, newVerifySlots(1))
+	override(t, &verifyQueueTimeout, 20*time.Millisecond)
+
+	// Someone else is verifying
+	verifySlots <- struct{}{}
+	defer func() { <-verifySlots }()
+
+	w := serve(basicRequest("alice", alicePassword))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Verification beyond the limit returned %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("No Retry-After on shed request")
+	}
+
+	// Tokens don't need a verification slot
+	secret, _ := currentSecrets()
+	tok := token.New(secret, "alice", time.Now().Add(time.Hour))
+	if w := serve(requestWithToken(tok)); w.Code != http.StatusOK {
+		t.Errorf("Token request returned %d while verifications were busy", w.Code)
+	}
+}
+
+func TestVerificationQueued(t *testing.T) {
+	testConfig(t)
+	override(t, &verifySlots, newVerifySlots(1))
+	override(t, &verifyQueueTimeout, 5*time.Second)
+
+	verifySlots <- struct{}{}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-verifySlots
+	}()
+
+	start := time.Now()
+	w := serve(basicRequest("alice", alicePassword))
+	if w.Code != http.StatusOK {
+		t.Errorf("Queued verification returned %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Verification didn't wait for a slot (%v)", elapsed)
+	}
+	if len(verifySlots) != 0 {
+		t.Errorf("Slot not released: %d in use", len(verifySlots))
+	}
+}
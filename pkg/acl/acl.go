@@ -2,7 +2,6 @@ package acl
 
 import (
 	"io"
-	"log"
 	"net/http"
 
 	"gopkg.in/yaml.v3"
@@ -35,9 +34,9 @@ func (acl *ACL) CompileURLs() error {
 	return nil
 }
 
+// Match returns the action of the first rule matching req, or Deny if none do
 func (acl *ACL) Match(req *http.Request) Action {
 	for _, rule := range acl.Rules {
-		log.Println(rule)
 		if rule.Match(req) {
 			return rule.Action
 		}
@@ -0,0 +1,63 @@
+package password
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultBreachURL is the HaveIBeenPwned range API
+const DefaultBreachURL = "https://api.pwnedpasswords.com/range/"
+
+// BreachChecker looks passwords up in a HaveIBeenPwned-style range API.
+//
+// Only the first 5 hex digits of the password's SHA-1 are sent;
+// the API returns every suffix it knows with that prefix,
+// and the match is done here.
+type BreachChecker struct {
+	// URL is the range API, to which the hash prefix is appended
+	URL string
+	// Client makes the requests; nil means http.DefaultClient
+	Client *http.Client
+}
+
+// Breached returns true if password appears in the breach corpus
+func (b BreachChecker) Breached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding hides the number of suffixes from anyone watching the response size
+	req.Header.Set("Add-Padding", "true")
+
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("breach API returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		candidate, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// Padding entries have a count of 0
+		if strings.EqualFold(candidate, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
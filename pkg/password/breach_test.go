@@ -0,0 +1,63 @@
+package password
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+func mockBreachAPI(t *testing.T, requested *string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*requested = req.URL.Path
+		if req.URL.Path != "/range/5BAA6" {
+			w.Write([]byte("0000000000000000000000000000000000A:0\r\n"))
+			return
+		}
+		w.Write([]byte(strings.Join([]string{
+			"003D68EB55068C33ACE09247EE4C639306B:3",
+			"1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824",
+			"01330C689E5D64F660D6947A93AD634EF8F:0",
+		}, "\r\n")))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestBreached(t *testing.T) {
+	var requested string
+	ts := mockBreachAPI(t, &requested)
+	b := BreachChecker{URL: ts.URL + "/range/"}
+
+	breached, err := b.Breached(context.Background(), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !breached {
+		t.Error("Breached password not found")
+	}
+	if requested != "/range/5BAA6" {
+		t.Errorf("Requested %q; only the 5-digit prefix should be sent", requested)
+	}
+
+	breached, err = b.Breached(context.Background(), "a very unlikely password indeed 8d7f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breached {
+		t.Error("Unbreached password reported as breached")
+	}
+}
+
+func TestBreachedAPIError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	if _, err := (BreachChecker{URL: ts.URL + "/"}).Breached(context.Background(), "password"); err == nil {
+		t.Error("API error not reported")
+	}
+}
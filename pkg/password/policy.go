@@ -0,0 +1,69 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Policy describes requirements for new passwords.
+// It applies when passwords are set, not to hashes that already exist.
+type Policy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// PolicyError lists the requirements a password didn't meet
+type PolicyError struct {
+	Unmet []string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("password does not meet requirements: %s", strings.Join(e.Unmet, ", "))
+}
+
+// Check returns the requirements password doesn't meet
+func (p Policy) Check(password string) []string {
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	unmet := []string{}
+	if n := len([]rune(password)); n < p.MinLength {
+		unmet = append(unmet, fmt.Sprintf("at least %d characters (got %d)", p.MinLength, n))
+	}
+	if p.RequireUpper && !upper {
+		unmet = append(unmet, "an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		unmet = append(unmet, "a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		unmet = append(unmet, "a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		unmet = append(unmet, "a symbol")
+	}
+	return unmet
+}
+
+// Validate returns a *PolicyError if password doesn't meet the policy
+func (p Policy) Validate(password string) error {
+	if unmet := p.Check(password); len(unmet) > 0 {
+		return &PolicyError{Unmet: unmet}
+	}
+	return nil
+}
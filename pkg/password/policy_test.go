@@ -0,0 +1,53 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStrongPassword(t *testing.T) {
+	p := Policy{
+		MinLength:     12,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+	}
+	if err := p.Validate("Correct-Horse-42"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWeakPassword(t *testing.T) {
+	p := Policy{
+		MinLength:     12,
+		RequireUpper:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+	}
+	err := p.Validate("hunter")
+	var perr *PolicyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Wanted PolicyError, got %v", err)
+	}
+
+	want := []string{
+		"at least 12 characters (got 6)",
+		"an uppercase letter",
+		"a digit",
+		"a symbol",
+	}
+	if strings.Join(perr.Unmet, "|") != strings.Join(want, "|") {
+		t.Errorf("Wrong unmet requirements: %q", perr.Unmet)
+	}
+	if !strings.Contains(err.Error(), "a digit") {
+		t.Errorf("Error doesn't list failures: %v", err)
+	}
+}
+
+func TestEmptyPolicy(t *testing.T) {
+	if err := (Policy{}).Validate("x"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,170 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS fetches secrets from AWS Secrets Manager.
+//
+// Names are secret names or ARNs.
+// Text secrets are returned as they are, binary secrets decoded.
+type AWS struct {
+	// Region is the AWS region, like "us-east-1"
+	Region string
+	// AccessKeyID, SecretAccessKey, and SessionToken are the credentials to sign requests with.
+	// SessionToken is only needed for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Endpoint is the Secrets Manager URL; empty means the public endpoint for Region
+	Endpoint string
+	// Client makes the requests; nil means http.DefaultClient
+	Client *http.Client
+}
+
+// NewAWSFromEnv returns a Secrets Manager client configured by the standard
+// AWS_REGION (or AWS_DEFAULT_REGION), AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN, and AWS_ENDPOINT_URL_SECRETS_MANAGER environment variables.
+//
+// Only credentials in the environment are used:
+// there's no support for profiles or instance metadata.
+func NewAWSFromEnv() (*AWS, error) {
+	a := &AWS{
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER"),
+	}
+	if a.Region == "" {
+		a.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if a.Region == "" {
+		return nil, fmt.Errorf("AWS_REGION not set")
+	}
+	if a.AccessKeyID == "" || a.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return a, nil
+}
+
+// awsSecretValue is the part of a GetSecretValue response we use
+type awsSecretValue struct {
+	SecretString *string
+	SecretBinary []byte
+}
+
+// Fetch returns the current version of the secret called name
+func (a *AWS) Fetch(ctx context.Context, name string) ([]byte, error) {
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", a.Region)
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": name})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+	a.sign(req, body, "secretsmanager", time.Now())
+
+	respBody, err := do(a.Client, req)
+	if err != nil {
+		return nil, fmt.Errorf("aws: reading %s: %w", name, err)
+	}
+	var value awsSecretValue
+	if err := json.Unmarshal(respBody, &value); err != nil {
+		return nil, fmt.Errorf("aws: reading %s: %w", name, err)
+	}
+	if value.SecretString != nil {
+		return []byte(*value.SecretString), nil
+	}
+	return value.SecretBinary, nil
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sha256Hex returns the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req,
+// signing every header already set, plus Host and X-Amz-Date.
+func (a *AWS) sign(req *http.Request, body []byte, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, a.Region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+a.SecretAccessKey), date)
+	key = hmacSHA256(key, a.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
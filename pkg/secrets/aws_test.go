@@ -0,0 +1,78 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSign checks the worked example from the AWS Signature Version 4 documentation
+func TestSign(t *testing.T) {
+	a := &AWS{
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header = http.Header{}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	a.sign(req, nil, "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Wrong signature:\n got %s\nwant %s", got, want)
+	}
+}
+
+// mockSecretsManager answers GetSecretValue with response
+func mockSecretsManager(t *testing.T, response string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if target := req.Header.Get("X-Amz-Target"); target != "secretsmanager.GetSecretValue" {
+			t.Errorf("Wrong target: %q", target)
+		}
+		if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+			t.Errorf("Not signed: %q", auth)
+		}
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+		if body["SecretId"] != "simpleauth" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException"}`))
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestAWSFetch(t *testing.T) {
+	for _, tc := range []struct{ response, want string }{
+		{`{"Name": "simpleauth", "SecretString": "hello"}`, "hello"},
+		{`{"Name": "simpleauth", "SecretBinary": "aGVsbG8="}`, "hello"},
+	} {
+		ts := mockSecretsManager(t, tc.response)
+		a := &AWS{Region: "us-east-1", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", Endpoint: ts.URL}
+		got, err := a.Fetch(context.Background(), "simpleauth")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("Fetched %q, wanted %q", got, tc.want)
+		}
+	}
+}
+
+func TestAWSFetchMissing(t *testing.T) {
+	ts := mockSecretsManager(t, "")
+	a := &AWS{Region: "us-east-1", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", Endpoint: ts.URL}
+	if _, err := a.Fetch(context.Background(), "nope"); err == nil {
+		t.Error("No error for a missing secret")
+	}
+}
@@ -0,0 +1,39 @@
+// Package secrets fetches secrets from secret managers,
+// for deployments that don't want them in files or environment variables.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Provider fetches secrets by name
+type Provider interface {
+	// Fetch returns the secret called name
+	Fetch(ctx context.Context, name string) ([]byte, error)
+}
+
+// maxResponse limits how much of a response is read: secrets are small
+const maxResponse = 1 << 20
+
+// do sends req, and returns the response body if the status is 200
+func do(client *http.Client, req *http.Request) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return body, nil
+}
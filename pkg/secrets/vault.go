@@ -0,0 +1,87 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultVaultField is the field read when a Vault secret name doesn't say which
+const DefaultVaultField = "value"
+
+// Vault fetches secrets from a HashiCorp Vault KV secrets engine, version 1 or 2.
+//
+// Names are the API path of the secret, with an optional field after a "#",
+// like "secret/data/simpleauth#key".
+// The field must hold a string.
+type Vault struct {
+	// Addr is the URL of the Vault server
+	Addr string
+	// Token authenticates to Vault
+	Token string
+	// Namespace is the Vault Enterprise namespace, if any
+	Namespace string
+	// Client makes the requests; nil means http.DefaultClient
+	Client *http.Client
+}
+
+// NewVaultFromEnv returns a Vault client configured by the standard
+// VAULT_ADDR, VAULT_TOKEN, and VAULT_NAMESPACE environment variables
+func NewVaultFromEnv() (*Vault, error) {
+	v := &Vault{
+		Addr:      os.Getenv("VAULT_ADDR"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+	}
+	if v.Addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR not set")
+	}
+	if v.Token == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN not set")
+	}
+	return v, nil
+}
+
+// vaultResponse is the part of a Vault read response we use.
+// KV version 1 puts the fields in Data; version 2 puts them in Data["data"].
+type vaultResponse struct {
+	Data map[string]any `json:"data"`
+}
+
+// Fetch returns a field of the secret at name
+func (v *Vault) Fetch(ctx context.Context, name string) ([]byte, error) {
+	path, field, ok := strings.Cut(name, "#")
+	if !ok {
+		field = DefaultVaultField
+	}
+	url := strings.TrimSuffix(v.Addr, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+
+	body, err := do(v.Client, req)
+	if err != nil {
+		return nil, fmt.Errorf("vault: reading %s: %w", path, err)
+	}
+	var resp vaultResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("vault: reading %s: %w", path, err)
+	}
+	fields := resp.Data
+	if nested, ok := fields["data"].(map[string]any); ok {
+		fields = nested
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault: %s has no string field %q", path, field)
+	}
+	return []byte(value), nil
+}
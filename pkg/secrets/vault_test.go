@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// mockVault serves a KV version 2 secret at secret/data/simpleauth, and a version 1 secret at kv/simpleauth
+func mockVault(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/simpleauth":
+			w.Write([]byte(`{"data": {"data": {"value": "v2 secret", "users": "alice:hash"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/simpleauth":
+			w.Write([]byte(`{"data": {"value": "v1 secret"}}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestVaultFetch(t *testing.T) {
+	ts := mockVault(t)
+	v := &Vault{Addr: ts.URL + "/", Token: "root"}
+
+	for name, want := range map[string]string{
+		"secret/data/simpleauth":       "v2 secret",
+		"secret/data/simpleauth#users": "alice:hash",
+		"/kv/simpleauth":               "v1 secret",
+	} {
+		got, err := v.Fetch(context.Background(), name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s: fetched %q, wanted %q", name, got, want)
+		}
+	}
+}
+
+func TestVaultFetchErrors(t *testing.T) {
+	ts := mockVault(t)
+
+	v := &Vault{Addr: ts.URL, Token: "root"}
+	for _, name := range []string{"secret/data/missing", "secret/data/simpleauth#missing", "secret/data/simpleauth#metadata"} {
+		if _, err := v.Fetch(context.Background(), name); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	v.Token = "wrong"
+	if _, err := v.Fetch(context.Background(), "secret/data/simpleauth"); err == nil {
+		t.Error("No error for a bad token")
+	}
+}
@@ -6,76 +6,212 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 )
 
+// Version is the token format issued by New.
+//
+// Version 1 tokens are gob-encoded, and can't gain new fields
+// without invalidating every token already issued.
+// Version 2 tokens are JSON with empty fields omitted,
+// so fields can be added without changing how older tokens are signed.
+const Version = 2
+
+// v2Prefix starts the string encoding of a version 2 token.
+// Version 1 strings are standard base64, which never contains a '.'.
+const v2Prefix = "v2."
+
+// Reasons a token isn't valid
+var (
+	ErrMalformed    = errors.New("malformed token")
+	ErrBadSignature = errors.New("bad token signature")
+	ErrExpired      = errors.New("token expired")
+	ErrNotYetValid  = errors.New("token not yet valid")
+	ErrRevoked      = errors.New("token revoked")
+)
+
 type T struct {
-	Expiration time.Time
-	Username   string
-	Mac        []byte
+	Version    int       `json:"v"`
+	Expiration time.Time `json:"exp"`
+	Username   string    `json:"user"`
+	Groups     []string  `json:"groups,omitempty"`
+	// NotBefore, if set, is when the token starts being valid
+	NotBefore *time.Time `json:"nbf,omitempty"`
+	// IssuedAt, if set, is when the user logged in for this token
+	IssuedAt *time.Time `json:"iat,omitempty"`
+	// Lifespan, if set, is how long the token lasted when the user logged in,
+	// so a reissued token can be extended by that much, however old the session is
+	Lifespan time.Duration `json:"span,omitempty"`
+	// UserAgent, if set, is a hash of the User-Agent the token was issued to
+	UserAgent string `json:"ua,omitempty"`
+	// Audience, if set, lists the services the token may be used with
+	Audience []string `json:"aud,omitempty"`
+	Mac      []byte   `json:"mac,omitempty"`
 }
 
-func (t T) computeMac(secret []byte) []byte {
-	zt := t
-	zt.Mac = nil
+// encodeV1 gob-encodes the original token layout.
+// It must not change, or version 1 signatures won't verify.
+// Gob includes the type name in its encoding, so the layout is declared here, still called T.
+func encodeV1(expiration time.Time, username string, mac []byte) []byte {
+	type T struct {
+		Expiration time.Time
+		Username   string
+		Mac        []byte
+	}
+	f := new(bytes.Buffer)
+	enc := gob.NewEncoder(f)
+	if err := enc.Encode(T{expiration, username, mac}); err != nil {
+		log.Fatal(err)
+	}
+	return f.Bytes()
+}
 
+// decodeV1 decodes a version 1 token
+func decodeV1(b []byte) (T, error) {
+	var old struct {
+		Expiration time.Time
+		Username   string
+		Mac        []byte
+	}
+	f := bytes.NewReader(b)
+	dec := gob.NewDecoder(f)
+	err := dec.Decode(&old)
+	return T{
+		Version:    1,
+		Expiration: old.Expiration,
+		Username:   old.Username,
+		Mac:        old.Mac,
+	}, err
+}
+
+func (t T) computeMac(secret []byte) []byte {
 	mac := hmac.New(sha256.New, secret)
-	mac.Write(zt.Bytes())
+	mac.Write(t.signedBytes())
 	return mac.Sum([]byte{})
 }
 
+// signedBytes returns the bytes covered by the token's MAC
+func (t T) signedBytes() []byte {
+	zt := t
+	zt.Mac = nil
+	return zt.Bytes()
+}
+
 // Bytes encodes the token
 func (t T) Bytes() []byte {
-	f := new(bytes.Buffer)
-	enc := gob.NewEncoder(f)
-	if err := enc.Encode(t); err != nil {
+	if t.Version < 2 {
+		return encodeV1(t.Expiration, t.Username, t.Mac)
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
 		log.Fatal(err)
 	}
-	return f.Bytes()
+	return b
 }
 
 // String returns the ASCII string encoding of the token
 func (t T) String() string {
-	return base64.StdEncoding.EncodeToString(t.Bytes())
+	if t.Version < 2 {
+		return base64.StdEncoding.EncodeToString(t.Bytes())
+	}
+	return v2Prefix + base64.RawURLEncoding.EncodeToString(t.Bytes())
 }
 
 // Valid returns true iff the token is valid for the given secret and current time
 func (t T) Valid(secret []byte) bool {
-	if time.Now().After(t.Expiration) {
-		return false
-	}
+	return t.Check(secret) == nil
+}
+
+// Check returns nil if the token is valid for the given secret and current time,
+// or ErrBadSignature, ErrMalformed, ErrExpired, or ErrNotYetValid, saying why not.
+// The signature is checked first, so the rest is only reported for genuine tokens.
+// A token without a username is never valid, however it was signed.
+func (t T) Check(secret []byte) error {
 	if !hmac.Equal(t.Mac, t.computeMac(secret)) {
-		return false
+		return ErrBadSignature
+	}
+	if t.Username == "" {
+		return fmt.Errorf("%w: no username", ErrMalformed)
+	}
+	now := time.Now()
+	if now.After(t.Expiration) {
+		return ErrExpired
 	}
+	if t.NotBefore != nil && now.Before(*t.NotBefore) {
+		return ErrNotYetValid
+	}
+	return nil
+}
 
-	return true
+// IssuedBefore returns true iff the token was issued before cutoff.
+// Tokens that don't record when they were issued count as issued before any cutoff.
+func (t T) IssuedBefore(cutoff time.Time) bool {
+	return t.IssuedAt == nil || t.IssuedAt.Before(cutoff)
+}
+
+// ExpiresWithin returns true iff the token expires no more than d from now
+func (t T) ExpiresWithin(d time.Duration) bool {
+	return !t.Expiration.After(time.Now().Add(d))
 }
 
 // New returns a new token
 func New(secret []byte, username string, expiration time.Time) T {
+	return NewWithGroups(secret, username, nil, expiration)
+}
+
+// NewWithGroups returns a new token carrying the user's groups
+func NewWithGroups(secret []byte, username string, groups []string, expiration time.Time) T {
 	t := T{
 		Username:   username,
+		Groups:     groups,
 		Expiration: expiration,
 	}
+	return t.Sign(secret)
+}
+
+// Sign returns t in the current version, signed with secret.
+// Use it after setting fields that New doesn't.
+func (t T) Sign(secret []byte) T {
+	t.Version = Version
 	t.Mac = t.computeMac(secret)
 	return t
 }
 
-// Parse returns a new token from the given bytes
+// Parse returns a new token from the given bytes.
+// Errors wrap ErrMalformed.
 func Parse(b []byte) (T, error) {
-	var t T
-	f := bytes.NewReader(b)
-	dec := gob.NewDecoder(f)
-	err := dec.Decode(&t)
-	return t, err
+	if len(b) > 0 && b[0] == '{' {
+		var t T
+		if err := json.Unmarshal(b, &t); err == nil && t.Version >= 2 {
+			return t, nil
+		}
+	}
+
+	t, err := decodeV1(b)
+	if err != nil {
+		return t, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return t, nil
 }
 
-// ParseString parses an ASCII-encoded string, as created by T.String()
+// ParseString parses an ASCII-encoded string, as created by T.String().
+// Errors wrap ErrMalformed.
 func ParseString(s string) (T, error) {
-	b, err := base64.StdEncoding.DecodeString(s)
+	var b []byte
+	var err error
+	if strings.HasPrefix(s, v2Prefix) {
+		b, err = base64.RawURLEncoding.DecodeString(s[len(v2Prefix):])
+	} else {
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
 	if err != nil {
-		return T{}, nil
+		return T{}, fmt.Errorf("%w: %v", ErrMalformed, err)
 	}
 	return Parse(b)
 }
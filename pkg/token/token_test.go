@@ -1,6 +1,8 @@
 package token
 
 import (
+	"errors"
+	"strings"
 	"testing"
 	"time"
 )
@@ -34,3 +36,221 @@ func TestExpired(t *testing.T) {
 		t.Error("Expired token still valid")
 	}
 }
+
+func TestExpiresWithin(t *testing.T) {
+	secret := []byte("bloop")
+	token := New(secret, "rodney", time.Now().Add(10*time.Hour))
+
+	if !token.ExpiresWithin(11 * time.Hour) {
+		t.Error("Token should expire within 11 hours")
+	}
+	if token.ExpiresWithin(time.Hour) {
+		t.Error("Token should not expire within an hour")
+	}
+}
+
+// v1Token was issued by the original gob-only token code, with secret "bloop"
+const v1Token = "M38DAQEBVAH/gAABAwEKRXhwaXJhdGlvbgH/ggABCFVzZXJuYW1lAQwAAQNNYWMBCgAAABD/gQUBAQRUaW1lAf+CAAAAPv+AAQ8BAAAAD2wYTgAAAAAA//8BBnJvZG5leQEg58I9J2+o7a/I5fOe2iXl4VW7FuahisUnoUk5bzVyRjEA"
+
+func TestDecodeV1(t *testing.T) {
+	token, err := ParseString(v1Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Version != 1 {
+		t.Errorf("Wrong version: %d", token.Version)
+	}
+	if token.Username != "rodney" {
+		t.Errorf("Wrong username: %q", token.Username)
+	}
+	if !token.Valid([]byte("bloop")) {
+		t.Error("Version 1 token not valid")
+	}
+	if token.Valid([]byte("blarg")) {
+		t.Error("Version 1 token valid with wrong secret")
+	}
+	if token.String() != v1Token {
+		t.Error("Version 1 token didn't re-encode identically")
+	}
+}
+
+func TestDecodeV2(t *testing.T) {
+	secret := []byte("bloop")
+	tokenStr := New(secret, "rodney", time.Now().Add(time.Hour)).String()
+	if !strings.HasPrefix(tokenStr, "v2.") {
+		t.Errorf("New token isn't version 2: %s", tokenStr)
+	}
+
+	token, err := ParseString(tokenStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Version != 2 {
+		t.Errorf("Wrong version: %d", token.Version)
+	}
+	if token.Username != "rodney" {
+		t.Errorf("Wrong username: %q", token.Username)
+	}
+	if !token.Valid(secret) {
+		t.Error("Version 2 token not valid")
+	}
+
+	token.Username = "mallory"
+	if token.Valid(secret) {
+		t.Error("Tampered version 2 token still valid")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	secret := []byte("bloop")
+	tokenStr := NewWithGroups(secret, "rodney", []string{"admin", "dev"}, time.Now().Add(time.Hour)).String()
+
+	token, err := ParseString(tokenStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(token.Groups, ",") != "admin,dev" {
+		t.Errorf("Wrong groups: %v", token.Groups)
+	}
+	if !token.Valid(secret) {
+		t.Error("Token with groups not valid")
+	}
+
+	token.Groups = append(token.Groups, "root")
+	if token.Valid(secret) {
+		t.Error("Token with tampered groups still valid")
+	}
+}
+
+func TestAudience(t *testing.T) {
+	secret := []byte("bloop")
+	tok := T{
+		Username:   "rodney",
+		Expiration: time.Now().Add(time.Hour),
+		Audience:   []string{"wiki", "files"},
+	}.Sign(secret)
+
+	token, err := ParseString(tok.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(token.Audience, ",") != "wiki,files" {
+		t.Errorf("Wrong audience: %v", token.Audience)
+	}
+	if !token.Valid(secret) {
+		t.Error("Token with audience not valid")
+	}
+
+	token.Audience = append(token.Audience, "billing")
+	if token.Valid(secret) {
+		t.Error("Token with tampered audience still valid")
+	}
+}
+
+func TestNotBefore(t *testing.T) {
+	secret := []byte("bloop")
+	nbf := time.Now().Add(time.Hour)
+	token := T{
+		Username:   "rodney",
+		Expiration: time.Now().Add(2 * time.Hour),
+		NotBefore:  &nbf,
+	}.Sign(secret)
+
+	parsed, err := ParseString(token.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Valid(secret) {
+		t.Error("Token valid before its not-before time")
+	}
+
+	past := time.Now().Add(-time.Minute)
+	token.NotBefore = &past
+	token = token.Sign(secret)
+	if parsed, _ = ParseString(token.String()); !parsed.Valid(secret) {
+		t.Error("Token not valid after its not-before time")
+	}
+
+	// Moving the not-before time invalidates the signature
+	parsed.NotBefore = nil
+	if parsed.Valid(secret) {
+		t.Error("Token with tampered not-before time still valid")
+	}
+}
+
+func TestIssuedBefore(t *testing.T) {
+	secret := []byte("bloop")
+	cutoff := time.Now()
+	before := cutoff.Add(-time.Hour)
+	after := cutoff.Add(time.Minute)
+
+	old := T{Username: "rodney", Expiration: after.Add(time.Hour), IssuedAt: &before}.Sign(secret)
+	if parsed, _ := ParseString(old.String()); !parsed.IssuedBefore(cutoff) {
+		t.Error("Token issued before the cutoff isn't reported as such")
+	}
+	fresh := T{Username: "rodney", Expiration: after.Add(time.Hour), IssuedAt: &after}.Sign(secret)
+	if parsed, _ := ParseString(fresh.String()); parsed.IssuedBefore(cutoff) {
+		t.Error("Token issued after the cutoff reported as issued before it")
+	}
+	if unknown := New(secret, "rodney", after); !unknown.IssuedBefore(cutoff) {
+		t.Error("Token without an issue time isn't reported as issued before the cutoff")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	secret := []byte("bloop")
+	good := New(secret, "rodney", time.Now().Add(time.Hour))
+
+	malformed := []string{
+		"",
+		"not base64!",
+		"v2.not base64!",
+		"v2." + strings.Repeat("A", 20),
+		"AAAA",
+	}
+	for _, s := range malformed {
+		if _, err := ParseString(s); !errors.Is(err, ErrMalformed) {
+			t.Errorf("ParseString(%q) returned %v, wanted ErrMalformed", s, err)
+		}
+	}
+
+	if err := good.Check(secret); err != nil {
+		t.Errorf("Good token: %v", err)
+	}
+	if err := good.Check([]byte("blarg")); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Wrong secret returned %v, wanted ErrBadSignature", err)
+	}
+	tampered := good
+	tampered.Username = "mallory"
+	if err := tampered.Check(secret); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Tampered token returned %v, wanted ErrBadSignature", err)
+	}
+
+	expired := New(secret, "rodney", time.Now().Add(-time.Hour))
+	if err := expired.Check(secret); !errors.Is(err, ErrExpired) {
+		t.Errorf("Expired token returned %v, wanted ErrExpired", err)
+	}
+
+	nbf := time.Now().Add(time.Hour)
+	early := T{Username: "rodney", Expiration: time.Now().Add(2 * time.Hour), NotBefore: &nbf}.Sign(secret)
+	if err := early.Check(secret); !errors.Is(err, ErrNotYetValid) {
+		t.Errorf("Early token returned %v, wanted ErrNotYetValid", err)
+	}
+}
+
+func TestEmptyUsername(t *testing.T) {
+	secret := []byte("bloop")
+	for _, version := range []int{1, 2} {
+		token := New(secret, "", time.Now().Add(time.Hour))
+		if version == 1 {
+			token = T{Version: 1, Expiration: token.Expiration}
+			token.Mac = token.computeMac(secret)
+		}
+		if token.Valid(secret) {
+			t.Errorf("Version %d token with no username is valid", version)
+		}
+		if err := token.Check(secret); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Version %d token with no username returned %v, wanted ErrMalformed", version, err)
+		}
+	}
+}
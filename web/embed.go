@@ -0,0 +1,19 @@
+// Package web holds the default login page and other static files, embedded so simpleauth can run without an HTML directory
+package web
+
+import _ "embed"
+
+// LoginHTML is the default login page
+//
+//go:embed login.html
+var LoginHTML []byte
+
+// FaviconICO is served at /favicon.ico, so browsers visiting the login page don't log a failed request
+//
+//go:embed favicon.ico
+var FaviconICO []byte
+
+// RobotsTXT asks crawlers to stay away
+//
+//go:embed robots.txt
+var RobotsTXT []byte